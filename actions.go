@@ -1013,7 +1013,12 @@ func (v *View) saveToFile(filename string) {
 	} else {
 		v.Buf.Path = filename
 		v.Buf.name = filename
-		messenger.Message("Saved " + filename)
+		if v.Buf.session != nil && len(v.Buf.unsynced) > 0 {
+			// the file may miss operations of these peers, or they ours
+			messenger.Error("Saved " + filename + ", but not in sync with " + strings.Join(v.Buf.unsynced, ", "))
+		} else {
+			messenger.Message("Saved " + filename)
+		}
 	}
 }
 
@@ -1844,7 +1849,7 @@ func (v *View) Quit(usePlugin bool) bool {
 		// Make sure not to quit if there are unsaved changes
 		if v.CanClose() {
 			v.CloseBuffer()
-			SeqVectorToStorage(true) // update storage here as well upon exit
+			v.Buf.releaseSession(v) // stop sharing once the last view of the buffer is closed
 			if len(tabs[curTab].Views) > 1 {
 				v.splitNode.Delete()
 				tabs[v.TabNum].Cleanup()
@@ -1867,6 +1872,7 @@ func (v *View) Quit(usePlugin bool) bool {
 					PostActionCall("Quit", v)
 				}
 
+				CloseSessions()
 				screen.Fini()
 				messenger.SaveHistory()
 				os.Exit(0)
@@ -1911,6 +1917,7 @@ func (v *View) QuitAll(usePlugin bool) bool {
 					PostActionCall("QuitAll", v)
 				}
 
+				CloseSessions()
 				screen.Fini()
 				messenger.SaveHistory()
 				os.Exit(0)
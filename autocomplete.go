@@ -29,9 +29,6 @@ func FileComplete(input string) (string, []string) {
 	}
 
 	var suggestions []string
-	if err != nil {
-		return "", suggestions
-	}
 	for _, f := range files {
 		name := f.Name()
 		if f.IsDir() {
@@ -41,6 +38,19 @@ func FileComplete(input string) (string, []string) {
 			suggestions = append(suggestions, name)
 		}
 	}
+	// the files shared by the peers may not be on the disk
+	dir := ""
+	if len(dirs) > 1 {
+		dir = strings.Join(dirs[:len(dirs)-1], sep) + sep
+	}
+	for _, name := range workspaceCompletions(dir, dirs[len(dirs)-1]) {
+		if !contains(suggestions, name) {
+			suggestions = append(suggestions, name)
+		}
+	}
+	if err != nil && len(suggestions) == 0 {
+		return "", suggestions
+	}
 
 	var chosen string
 	if len(suggestions) == 1 {
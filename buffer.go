@@ -6,20 +6,22 @@ import (
 	"crypto/md5"
 	"encoding/gob"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
 	"unicode/utf8"
 
+	"github.com/zyedidia/micro/cmd/micro/crdt"
 	"github.com/zyedidia/micro/cmd/micro/highlight"
+	"github.com/zyedidia/micro/cmd/micro/session"
 )
 
 const LargeFileThreshold = 50000
@@ -39,8 +41,9 @@ type Buffer struct {
 	*EventHandler
 	// This stores all the text in the buffer as an array of lines
 	*LineArray
-	// This stores document CRDT
-	*Document
+	// This stores document CRDT, a Logoot document unless the buffer is
+	// shared as another kind of sequence
+	Document crdt.Sequence
 
 	Cursor    Cursor
 	cursors   []*Cursor // for multiple cursors
@@ -70,6 +73,40 @@ type Buffer struct {
 
 	// Buffer local settings
 	Settings map[string]interface{}
+
+	// The session this buffer is shared in, nil if not shared
+	session *session.Session
+	// whether the text is kept out of the CRDT document, as for the log
+	// or the help, which are never shared
+	private bool
+	// chat of the session, nil until needed
+	chat *Buffer
+	// messages of the chat history not handed to addChat yet
+	chatLoaded map[string]bool
+	// number of chat messages received while the chat was hidden
+	unread int
+	// the shared buffer this buffer is the chat of, if it is one
+	chatOf *Buffer
+	// state of the session, nil until needed
+	info *Buffer
+	// the shared buffer this buffer is the session info of, if it is one
+	infoOf *Buffer
+	// comment threads of the session, nil until needed
+	comments *Buffer
+	// the shared buffer this buffer lists the comments of, if it is one
+	commentsOf *Buffer
+	// peers which had not synced when the buffer was last saved
+	unsynced []string
+	// changes of the peers the lines do not have yet, protected by the
+	// document lock
+	pending []pendingEdit
+	// changes of the peers the plugins are not told about yet, protected
+	// by the document lock
+	remoteEdits []remoteEdit
+	// lines the peers changed since the last redraw, protected by damageMu
+	damage lineDamage
+	// whether we edit the ranges the peers claimed anyway
+	forceClaims bool
 }
 
 // The SerializedBuffer holds the types that get serialized when a buffer is saved
@@ -127,17 +164,12 @@ func NewBuffer(reader io.Reader, size int64, path string, cursorPosition []strin
 
 	b := new(Buffer)
 
-	// create a new document for now, later need to be restored from memory, id set to 1
-	// currently hardcoding site numbers TODO:
-	i, _ := strconv.Atoi(clientID)
-	site := i % 100
-
-	b.Document = LoadDocument(uint8(site))
-
-	// get the entire content of the document ready passed into LineArray
-	text := b.Document.Content()
 	// load from existing file.
-	b.LineArray = NewLineArray(size, strings.NewReader(text)) // reader contains a file desciptor opened
+	b.LineArray = NewLineArray(size, reader) // reader contains a file desciptor opened
+
+	// create a new document from the content. The document is replaced by the
+	// stored one if the buffer is shared later on
+	b.Document = crdt.NewDocument(0, b.LineArray.String())
 
 	b.Settings = DefaultLocalSettings()
 	for k, v := range globalSettings {
@@ -201,6 +233,8 @@ func NewBuffer(reader io.Reader, size int64, path string, cursorPosition []strin
 				if b.ModTime == buffer.ModTime {
 					b.EventHandler = buffer.EventHandler
 					b.EventHandler.buf = b
+					// the identifiers refer to the document of the last session
+					b.forgetOps()
 				}
 			}
 		}
@@ -451,6 +485,12 @@ func (b *Buffer) Serialize() error {
 		return nil
 	}
 
+	// the undo history of a shared buffer is kept with the document, as the
+	// identifiers of the atoms it refers to
+	if b.session != nil {
+		saveUndo(b)
+	}
+
 	name := configDir + "/buffers/" + EscapePath(b.AbsPath)
 
 	return overwriteFile(name, func(file io.Writer) error {
@@ -515,11 +555,32 @@ func (b *Buffer) SaveAs(filename string) error {
 		}
 	}
 
+	// peers may change a shared buffer while it is written, so the lines are
+	// copied with the document locked, together with the sequence vector
+	// they correspond to and the peers which had not synced then
+	if b.session != nil {
+		b.lockDoc()
+	}
+	lines := make([][]byte, len(b.lines))
+	for i, l := range b.lines {
+		lines[i] = append([]byte(nil), l.data...)
+	}
+	var version map[string]uint64
+	var unsynced []string
+	if b.session != nil {
+		version = b.session.Version()
+		unsynced = b.session.Unsynced()
+		if !b.Settings["fastdirty"].(bool) {
+			calcHash(b, &b.origHash)
+		}
+		b.unlockDoc()
+	}
+
 	var fileSize int
 
-	// the following supplies an anonymous function for writing lines, add support for CRDT here
+	// the following supplies an anonymous function for writing lines
 	err := overwriteFile(absFilename, func(file io.Writer) (e error) {
-		if len(b.lines) == 0 {
+		if len(lines) == 0 {
 			return
 		}
 
@@ -533,20 +594,20 @@ func (b *Buffer) SaveAs(filename string) error {
 		}
 
 		// write the first line
-		if fileSize, e = file.Write(b.lines[0].data); e != nil {
+		if fileSize, e = file.Write(lines[0]); e != nil {
 			return
 		}
 		// write lines
-		for _, l := range b.lines[1:] {
+		for _, l := range lines[1:] {
 			if _, e = file.Write(eol); e != nil {
 				return
 			}
 
-			if _, e = file.Write(l.data); e != nil {
+			if _, e = file.Write(l); e != nil {
 				return
 			}
 
-			fileSize += len(eol) + len(l.data)
+			fileSize += len(eol) + len(l)
 		}
 
 		return
@@ -556,51 +617,19 @@ func (b *Buffer) SaveAs(filename string) error {
 		return err
 	}
 
-	// save CRDT document here, may need to Serialize
-	var crdtDocument = "CRDT" + absFilename
-
-	err = overwriteFile(crdtDocument, func(file io.Writer) (e error) {
-		// end of line
-		var eol []byte
-		if b.Settings["fileformat"] == "dos" {
-			eol = []byte{'\r', '\n'}
-		} else {
-			eol = []byte{'\n'}
+	if b.session != nil {
+		// tell which operations of the peers the file reflects
+		b.unsynced = unsynced
+		if err := saveVersion(absFilename, b.session.DocID, version, b.unsynced); err != nil {
+			return err
 		}
-
-		// data is []string
-		data := strings.Split(b.Document.Content(), "\n")
-
-		// write the first line
-		if fileSize, e = file.Write([]byte(data[0])); e != nil {
-			return
-		}
-
-		// write lines
-		for _, line := range data[1:] {
-			if _, e = file.Write(eol); e != nil {
-				return
-			}
-
-			if _, e = file.Write([]byte(line)); e != nil {
-				return
-			}
-
-			fileSize += len(eol) + len([]byte(line))
-		}
-
-		return
-	})
-
-	if err != nil {
-		return err
 	}
 
 	if !b.Settings["fastdirty"].(bool) {
 		if fileSize > LargeFileThreshold {
 			// For large files 'fastdirty' needs to be on
 			b.Settings["fastdirty"] = true
-		} else {
+		} else if b.session == nil {
 			calcHash(b, &b.origHash)
 		}
 	}
@@ -705,9 +734,18 @@ func (b *Buffer) Modified() bool {
 
 // This insert is also used by commands insert, messager log insert etc
 func (b *Buffer) insert(pos Loc, value []byte) {
+	b.insertOps(pos, value)
+}
+
+// insertOps inserts value at pos, and returns the corresponding CRDT operations
+func (b *Buffer) insertOps(pos Loc, value []byte) []crdt.Operation {
 
 	if len(value) == 0 { // need to check when (stacktrace) such a scenario happens
-		return
+		return nil
+	}
+	if b.session != nil { // peers modify the buffer concurrently
+		b.lockDoc()
+		defer b.unlockDoc()
 	}
 	// LOCAL
 	b.IsModified = true // where it is set to false ?
@@ -717,158 +755,148 @@ func (b *Buffer) insert(pos Loc, value []byte) {
 
 	b.Update()
 
-	if b.name == "Log" || b.name == "Help" { // private domains, don't bother CRDTize data
-		return
+	if b.private { // private domains, don't bother CRDTize data
+		return nil
 	}
 
-	// START is at index 0, may be off a little.
-	// given pos, and a byte array (usually just one byte), insert sequentially to CRDT
+	// given pos, and a byte array, insert sequentially to CRDT, one atom per rune
 	// first converts pos into CRDT document index. The index is the would-be inserted index
-	dbID := NextDocID()
-	posIdentifier, _ := b.Document.insertMultiple(b.Document.pairs[index].Pos, value, dbID)
-	// insertMultiple is necessary as user can delete a text region indicated by a cursor range
-
-	// last thing in the local operation is to increment the logical clock
-	// Do not actually need to lock the clock increment because local inserts are serialized
-	seqVector[localClient].Clock = seqVector[localClient].Clock + 1
-	seqVector[localClient].Dirty = true
-
-	// id and clock are passed into the anonymous function to resolve race conditions.
-	// can also do something similar in the delete function
-	// write operation to local storage and docdb, can open a writer in the buffer field using TX
-	go func(id, clock uint64, atom string, pos []Identifier) { // do this in a separate go routine
-		err := writeOpToStorage(atom, true, clock, pos)
-		if err != nil {
-			fmt.Println("Error", err.Error())
-		}
-		err = InsertCharToDocDB(id, atom, pos)
-		if err != nil {
-			fmt.Println("Error", err.Error())
-		}
-	}(dbID, seqVector[localClient].Clock, string(value), posIdentifier)
-
-	// REMOTE.
-	if IsOffline() { // checking connection
-		return
-	}
-	// now send to peers
-	InsertArgs := InsertArgs{
-		Clientid: localClient, // hardcoding for now TODO:
-		Clock:    seqVector[localClient].Clock,
-		Pair: pair{
-			Pos:  posIdentifier,
-			Atom: string(value),
-		},
-	}
-	var kvVal ValReply
-	// currently only one peer. This is blocking, in production, may need to timeout TODO:
-	// This can be put in connection.go
-
-	for i, _ := range peerServices {
-
-		if peerServices[i] == nil {
-			continue
-		}
-
-		go func(index int) {
-			c := make(chan error, 1) // not really necessary
-			select {                 // select blocks until one of the following cases is able to run
-			case c <- peerServices[index].Call("EntangleClient.Insert", InsertArgs, &kvVal):
-				// use err and reply
-				v := <-c
-				if v != nil { // for whatever reason, there is an error
-					peerServices[index] = nil // set to nil naively and immediately
-				}
-			case <-time.After(5 * time.Second): // receive from time.After channel
-				// call timed out, setting peerServices[0] to nil for now
-				peerServices[index] = nil
-			}
-
-		}(i) // rpc
-	}
+	return b.crdtInsert(index, string(value))
 }
 
 // remove from start up to end (not including end). This is used by many other files
 func (b *Buffer) remove(start, end Loc) string {
+	value, _ := b.removeOps(start, end)
+	return value
+}
+
+// removeOps removes from start up to end, and returns the removed text together
+// with the corresponding CRDT operations
+func (b *Buffer) removeOps(start, end Loc) (string, []crdt.Operation) {
 	// start == end -> we are not deleting, should disallow this case
 	if start.X == end.X && start.Y == end.Y {
-		return ""
+		return "", nil
+	}
+	if b.session != nil { // peers modify the buffer concurrently
+		b.lockDoc()
+		defer b.unlockDoc()
 	}
 
 	b.IsModified = true
 
 	// compute CRDT indices before lineArray removal!!
-	startIndex := ToCharPos(start, b) + 1 // shift by one
-	endIndex := ToCharPos(end, b) + 1
+	startIndex := ToCharPos(start, b)
+	endIndex := ToCharPos(end, b)
 
 	value := b.LineArray.remove(start, end) // TODO: change to b.document.delete
 
 	b.Update()
 
-	if b.name == "Log" || b.name == "Help" { // private domains
-		return value
+	if b.private { // private domains
+		return value, nil
 	}
 
-	// delete pairs[startIndex:endIndex], not including endIndex
-	posIdentifier, dbID := b.Document.deleteMultiple(startIndex, endIndex)
+	// delete the atoms from startIndex up to endIndex, not including endIndex
+	return value, b.crdtDelete(startIndex, endIndex)
+}
+
+// revertOps reverts local operations: the atoms that were inserted are deleted
+// if they still exist, and the atoms that were deleted are inserted again at new
+// identifiers sorting where the old ones used to be. Operations of other peers
+// made in the meantime are left untouched.
+// The returned operations revert the revert, which is what redo needs.
+func (b *Buffer) revertOps(ops []crdt.Operation) []crdt.Operation {
+	if b.session != nil { // peers modify the buffer concurrently
+		b.lockDoc()
+		defer b.unlockDoc()
+	}
 
-	// last thing in the local operation is to increment the logical clock
-	seqVector[localClient].Clock = seqVector[localClient].Clock + 1
-	seqVector[localClient].Dirty = true
+	b.IsModified = true
 
-	// write operation to local storage, can open a writer in the buffer field using TX
-	go func(id, clock uint64, atom string, pos []Identifier) { // do this in a separate go routine, note it is set to false
-		err := writeOpToStorage(atom, false, clock, pos)
-		if err != nil {
-			fmt.Println("Error", err.Error())
+	// indices of the inserted atoms that still exist, from the last one,
+	// the runs being reverted rune by rune
+	var indices []int
+	var removed []crdt.Operation
+	var runes []crdt.Operation
+	for _, op := range ops {
+		runes = append(runes, op.Runes()...)
+	}
+	for _, op := range runes {
+		if op.OpType == false {
+			removed = append(removed, op)
+		} else if i, exists := b.Document.Index(crdt.NewPos(op.Pos)); exists {
+			indices = append(indices, i)
 		}
-		err = DeleteCharFromDocDB(id)
-		if err != nil {
-			fmt.Println("Error", err.Error())
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(indices)))
+
+	// delete runs of contiguous atoms at once
+	var reverted []crdt.Operation
+	for j := 0; j < len(indices); {
+		k := j + 1
+		for k < len(indices) && indices[k] >= indices[k-1]-1 {
+			k++
 		}
-	}(dbID, seqVector[localClient].Clock, string(value), posIdentifier)
-	// REMOTE. This can also be wrapped into a function in connection.go
-	// Currently, the following code assumes deleting just one char.
-
-	if IsOffline() { // checking connection
-		return value
-	}
-	// now send to peers
-	DeleteArgs := DeleteArgs{
-		Clientid: localClient, // hardcoding for now TODO:
-		Clock:    seqVector[localClient].Clock,
-		Pair: pair{
-			Pos:  posIdentifier,
-			Atom: string(value),
-		},
-	}
-	var kvVal ValReply
-	// currently only one peer. This is blocking, in production, may need to timeout TODO:
-	// later need to extent to loops
-	for i, _ := range peerServices {
-
-		if peerServices[i] == nil {
+		startIndex, endIndex := indices[k-1]-1, indices[j] // off by 1
+		b.LineArray.remove(FromCharPos(startIndex, b), FromCharPos(endIndex, b))
+		b.Update()
+		reverted = append(reverted, b.crdtDelete(startIndex, endIndex)...)
+		j = k
+	}
+
+	// atoms that used to be next to each other are inserted together, so
+	// that they keep their order
+	sort.Slice(removed, func(i, j int) bool {
+		return b.Document.Compare(crdt.NewPos(removed[i].Pos), crdt.NewPos(removed[j].Pos)) < 0
+	})
+	for j := 0; j < len(removed); {
+		index, exists := b.Document.Index(crdt.NewPos(removed[j].Pos))
+		text := removed[j].Atom
+		k := j + 1
+		for ; k < len(removed); k++ {
+			i, _ := b.Document.Index(crdt.NewPos(removed[k].Pos))
+			if i != index {
+				break
+			}
+			text += removed[k].Atom
+		}
+		j = k
+		if exists { // should not happen, identifiers are never reused
 			continue
 		}
 
-		go func(index int) {
-			c := make(chan error, 1) // not really necessary
-			select {                 // select blocks until one of the following cases is able to run
-			case c <- peerServices[index].Call("EntangleClient.Delete", DeleteArgs, &kvVal):
-				// use err and reply
-				v := <-c
-				if v != nil { // for whatever reason, there is an error
-					peerServices[index] = nil // set to nil naively and immediately
-				}
-			case <-time.After(5 * time.Second): // receive from time.After channel
-				// call timed out, setting peerServices[0] to nil for now
-				peerServices[index] = nil
-			}
+		b.LineArray.insert(FromCharPos(index-1, b), []byte(text)) // off by 1
+		b.Update()
+		reverted = append(reverted, b.crdtInsert(index-1, text)...)
+	}
 
-		}(i) // rpc
+	if reverted == nil {
+		reverted = []crdt.Operation{}
 	}
+	return reverted
+}
 
-	return value
+// crdtInsert inserts text in the document at the given char index. If the
+// buffer is shared, the operations are also logged and sent to the peers
+// Pre: the document is locked if shared
+func (b *Buffer) crdtInsert(index int, text string) []crdt.Operation {
+	if b.session != nil {
+		return b.session.Insert(index, text)
+	}
+	inserted, _ := b.Document.InsertMultiple(b.Document.Pos(index), text)
+	return crdt.Operations(inserted, true)
+}
+
+// crdtDelete deletes the atoms from start up to end (not including end) from
+// the document. If the buffer is shared, the operations are also logged and
+// sent to the peers
+// Pre: the document is locked if shared
+func (b *Buffer) crdtDelete(start, end int) []crdt.Operation {
+	if b.session != nil {
+		return b.session.Delete(start, end)
+	}
+	deleted := b.Document.DeleteMultiple(start+1, end+1) // shift by one for Start
+	return crdt.Operations(deleted, false)
 }
 
 // where is this function called?
@@ -2,6 +2,8 @@ package main
 
 import (
 	"testing"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
 )
 
 func TestGetBufferCursorLocationEmptyArgs(t *testing.T) {
@@ -115,3 +117,78 @@ func TestGetBufferCursorLocationNoErrorWhenOverflowWithCursorPosition(t *testing
 //	buf := new(Buffer)
 
 //}
+
+// remoteInsert inserts an atom after the rune at index, as if a peer did it
+func remoteInsert(b *Buffer, index int, atom string) {
+	p, _ := crdt.GeneratePos(b.Document.Pos(index), b.Document.Pos(index+1), 42)
+	b.LineArray.insert(FromCharPos(index, b), []byte(atom))
+	b.Document.InsertPos(p, atom, 0)
+	b.Update()
+}
+
+func TestUndoOnlyOwnInsert(t *testing.T) {
+	buf := NewBufferFromString("hello world", "")
+
+	buf.Insert(Loc{5, 0}, ",")
+	remoteInsert(buf, 0, ">")
+	assertEqual(t, ">hello, world", buf.String())
+
+	buf.Undo()
+	assertEqual(t, ">hello world", buf.String())
+	assertEqual(t, buf.String(), buf.Document.Content())
+
+	buf.Redo()
+	assertEqual(t, ">hello, world", buf.String())
+	assertEqual(t, buf.String(), buf.Document.Content())
+}
+
+func TestUndoOnlyOwnRemove(t *testing.T) {
+	buf := NewBufferFromString("one two three", "")
+
+	buf.Remove(Loc{3, 0}, Loc{7, 0})
+	remoteInsert(buf, buf.Document.Len(), "!")
+	assertEqual(t, "one three!", buf.String())
+
+	buf.Undo()
+	assertEqual(t, "one two three!", buf.String())
+	assertEqual(t, buf.String(), buf.Document.Content())
+
+	buf.Redo()
+	assertEqual(t, "one three!", buf.String())
+	assertEqual(t, buf.String(), buf.Document.Content())
+}
+
+func TestRestoreUndo(t *testing.T) {
+	buf := NewBufferFromString("hello world", "")
+
+	buf.Insert(Loc{5, 0}, ",")
+	buf.Remove(Loc{0, 0}, Loc{1, 0})
+	buf.UndoOneEvent()
+	assertEqual(t, "hello, world", buf.String())
+
+	u := buf.SerializeUndo()
+	assertEqual(t, 1, len(u.Undo))
+	assertEqual(t, 1, len(u.Redo))
+
+	buf.UndoStack = new(Stack)
+	buf.RedoStack = new(Stack)
+	buf.RestoreUndo(u, nil)
+
+	remoteInsert(buf, 0, ">")
+	buf.UndoOneEvent()
+	assertEqual(t, ">hello world", buf.String())
+	buf.RedoOneEvent()
+	buf.RedoOneEvent()
+	assertEqual(t, ">ello, world", buf.String())
+}
+
+func TestPrivateBuffer(t *testing.T) {
+	buf := NewBufferFromString("one", "Log")
+	buf.Insert(Loc{3, 0}, " two")
+	assertEqual(t, buf.String(), buf.Document.Content())
+
+	buf.private = true
+	buf.Insert(Loc{7, 0}, " three")
+	assertEqual(t, "one two three", buf.String())
+	assertEqual(t, "one two", buf.Document.Content())
+}
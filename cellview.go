@@ -62,6 +62,9 @@ type Char struct {
 
 type CellView struct {
 	lines [][]*Char
+	// damage holds the lines of the buffer to draw again on the screen,
+	// all of them if nil
+	damage *lineDamage
 }
 
 // This is the actual text drawing function
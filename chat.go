@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/zyedidia/micro/cmd/micro/session"
+)
+
+// chatBuffer returns the buffer displaying the chat of the shared buffer. It is
+// created on first use from the messages stored with the document
+func (b *Buffer) chatBuffer() *Buffer {
+	if b.chat == nil {
+		b.chat = NewBufferFromString("", "")
+		b.chat.name = "Chat" // setting buffer name to "Chat"
+		b.chat.private = true
+		b.chat.chatOf = b
+		// messages are stored before they are handed to addChat, which
+		// skips those loaded here
+		b.chatLoaded = make(map[string]bool)
+		for _, m := range b.session.ChatHistory() {
+			b.chatLoaded[chatKey(m)] = true
+			appendChat(b.chat, m)
+		}
+	}
+	return b.chat
+}
+
+// chatKey identifies a chat message, whether it was loaded from the storage or not
+func chatKey(m session.ChatMessage) string {
+	return m.From + " " + strconv.FormatInt(m.Time.UnixNano(), 10) + " " + m.Text
+}
+
+// addChat appends a message to the chat buffer, like AddLog does for the log,
+// unless the buffer was created with it already
+func (b *Buffer) addChat(m session.ChatMessage) {
+	buffer := b.chatBuffer()
+	if key := chatKey(m); b.chatLoaded[key] {
+		delete(b.chatLoaded, key)
+		return
+	}
+	appendChat(buffer, m)
+}
+
+// appendChat appends a message to a chat buffer and moves the cursor after it
+func appendChat(buffer *Buffer, m session.ChatMessage) {
+	buffer.insert(buffer.End(), []byte(m.String()+"\n"))
+	buffer.Cursor.Loc = buffer.End()
+	buffer.Cursor.Relocate()
+}
+
+// chatVisible returns whether the chat of the buffer is shown in the current tab
+func (b *Buffer) chatVisible() bool {
+	if b.chat == nil {
+		return false
+	}
+	for _, v := range tabs[curTab].Views {
+		if v.Buf == b.chat {
+			return true
+		}
+	}
+	return false
+}
+
+// receiveChat displays a message from a peer
+// This must be called from the main goroutine
+func (b *Buffer) receiveChat(m session.ChatMessage) {
+	if b.session == nil {
+		return
+	}
+	b.addChat(m)
+	if !b.chatVisible() {
+		b.unread++
+	}
+}
+
+// UpdatePresence sends the position of the cursor and the viewport in every
+// shared buffer, the one of the current view being the active one
+// This is called by the main loop
+func UpdatePresence() {
+	views := []*View{CurView()}
+	for _, t := range tabs {
+		views = append(views, t.Views...)
+	}
+
+	sent := make(map[*Buffer]bool)
+	for _, v := range views {
+		s := v.Buf.session
+		if s == nil || sent[v.Buf] {
+			continue
+		}
+		sent[v.Buf] = true
+		s.UpdatePresence(session.Presence{
+			Line:    v.Buf.Cursor.Y,
+			Topline: v.Topline,
+			LeftCol: v.leftCol,
+			Active:  v == CurView(),
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+	"github.com/zyedidia/micro/cmd/micro/session"
+)
+
+func TestChatHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host := session.NewHost(session.TCP, dir)
+	if err := host.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	s, _, err := host.Share("chat.txt", crdt.NewDocument(0, "chat\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Unshare()
+
+	buf := NewBufferFromString("chat\n", "chat.txt")
+	buf.session = s
+
+	// the first message creates the chat from the history, which has it
+	first := s.Say("first")
+	buf.addChat(first)
+	assertEqual(t, first.String()+"\n", buf.chat.String())
+
+	// messages stored before the chat was shown are not added twice
+	buf.chat = nil
+	second := s.Say("second")
+	third := s.Say("third")
+	buf.chatBuffer()
+	buf.addChat(second)
+	buf.addChat(third)
+	lines := strings.Split(buf.chat.String(), "\n")
+	assertEqual(t, 4, len(lines))
+	assertEqual(t, second.String(), lines[1])
+	assertEqual(t, third.String(), lines[2])
+
+	fourth := s.Say("fourth")
+	buf.addChat(fourth)
+	assertTrue(t, strings.HasSuffix(buf.chat.String(), third.String()+"\n"+fourth.String()+"\n"))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+	"github.com/zyedidia/micro/cmd/micro/session"
+)
+
+// Claim claims the selection of the shared buffer, the current line if
+// nothing is selected, or the whole buffer with claim all, so that the peers
+// do not edit it meanwhile. claim release releases our claims, and claim
+// force lets us edit the ranges the peers claimed anyway, or stops it
+func Claim(args []string) {
+	b := CurView().Buf
+	if b.session == nil {
+		messenger.Error(b.GetName() + " is not shared")
+		return
+	}
+	if len(args) > 1 {
+		messenger.Error("Usage: claim [all|release|force]")
+		return
+	}
+	if (len(args) == 0 || args[0] == "all") && !b.session.CanEdit(b.session.LocalAddr()) {
+		messenger.Error("Only the editors of " + b.GetName() + " can claim")
+		return
+	}
+
+	if len(args) == 1 {
+		switch args[0] {
+		case "all":
+			b.session.ClaimAll()
+			messenger.Message("Claimed the whole of " + b.GetName())
+		case "release":
+			n := b.session.Release()
+			if n == 0 {
+				messenger.Error("No claim to release")
+				return
+			}
+			messenger.Message(fmt.Sprintf("Released %d claims", n))
+		case "force":
+			b.forceClaims = !b.forceClaims
+			if b.forceClaims {
+				messenger.Message("Editing the ranges the peers claimed")
+			} else {
+				messenger.Message("The ranges the peers claimed are left alone")
+			}
+		default:
+			messenger.Error("Usage: claim [all|release|force]")
+		}
+		return
+	}
+
+	c := b.Cursor
+	var start, end Loc
+	if c.HasSelection() {
+		start, end = c.CurSelection[0], c.CurSelection[1]
+		if end.LessThan(start) {
+			start, end = end, start
+		}
+	} else {
+		start, end = Loc{0, c.Y}, Loc{Count(b.Line(c.Y)), c.Y}
+		if c.Y < b.NumLines-1 {
+			// the newline goes with the line
+			end = end.Move(1, b)
+		}
+	}
+	if start == end {
+		messenger.Error("Nothing to claim")
+		return
+	}
+
+	b.lockDoc()
+	b.session.ClaimRange(ToCharPos(start, b), ToCharPos(end, b))
+	b.unlockDoc()
+	if start.Y == end.Y || end.X == 0 && start.Y == end.Y-1 {
+		messenger.Message("Claimed line ", start.Y+1)
+	} else {
+		messenger.Message(fmt.Sprintf("Claimed lines %d-%d", start.Y+1, end.Y+1))
+	}
+}
+
+// claimLines returns the first and last lines of the buffer a claim is
+// about, ok is false once its text is deleted
+// Pre: the session is locked
+func (b *Buffer) claimLines(c session.Claim) (first, last int, ok bool) {
+	i, j, ok := b.session.ClaimSpan(c)
+	if !ok {
+		return 0, 0, false
+	}
+	start, end := FromCharPos(i, b), FromCharPos(j, b)
+	if end.X == 0 && end.Y > start.Y {
+		// the range ends with a newline
+		end.Y--
+	}
+	return start.Y, end.Y, true
+}
+
+// claimedByPeer tells whether an edit from start up to end falls into a
+// range another peer claimed, with a warning, unless claim force is on
+func (b *Buffer) claimedByPeer(start, end Loc) bool {
+	if b.session == nil || b.forceClaims {
+		return false
+	}
+	b.lockDoc()
+	c, claimed := b.session.ClaimedByPeer(ToCharPos(start, b), ToCharPos(end, b))
+	b.unlockDoc()
+	if claimed {
+		messenger.Error(c.From + " claimed this text, claim force to edit it anyway")
+	}
+	return claimed
+}
+
+// revertClaimedByPeer tells whether undoing or redoing an edit, by reverting
+// its operations, falls into a range another peer claimed, with a warning,
+// unless claim force is on
+func (b *Buffer) revertClaimedByPeer(ops []crdt.Operation) bool {
+	if b.session == nil || b.forceClaims || ops == nil {
+		return false
+	}
+	b.lockDoc()
+	c, claimed := b.session.RevertClaimedByPeer(ops)
+	b.unlockDoc()
+	if claimed {
+		messenger.Error(c.From + " claimed this text, claim force to edit it anyway")
+	}
+	return claimed
+}
+
+// receiveClaim tells about a claim of a peer, or its release
+// This must be called from the main goroutine
+func (b *Buffer) receiveClaim(c session.Claim) {
+	if b.session == nil {
+		return
+	}
+	what := "the whole of " + b.GetName()
+	if !c.Whole {
+		b.lockDoc()
+		first, last, ok := b.claimLines(c)
+		b.unlockDoc()
+		if !ok {
+			return
+		}
+		what = fmt.Sprintf("lines %d-%d of %s", first+1, last+1, b.GetName())
+	}
+	if c.Released {
+		messenger.Message(c.From + " released " + what)
+	} else {
+		messenger.Message(c.From + " claimed " + what)
+	}
+}
+
+// UpdateClaims marks the claimed lines the views of the current tab show in
+// their gutter, the ones the peers claimed as warnings, as the ranges move
+// with the text
+// This is called by the main loop
+func UpdateClaims() {
+	for _, v := range tabs[curTab].Views {
+		b := v.Buf
+		if b.session == nil {
+			continue
+		}
+
+		v.ClearGutterMessages("claims")
+		claims := b.session.Claims()
+		if len(claims) == 0 {
+			continue
+		}
+		b.lockDoc()
+		for _, c := range claims {
+			first, last, ok := b.claimLines(c)
+			if !ok {
+				continue
+			}
+			kind, msg := GutterWarning, "Claimed by "+c.From
+			if c.From == b.session.LocalAddr() {
+				kind, msg = GutterInfo, "Claimed by you, claim release to release it"
+			}
+			// the lines out of sight are not marked
+			if first < v.Topline {
+				first = v.Topline
+			}
+			if last >= v.Topline+v.Height {
+				last = v.Topline + v.Height - 1
+			}
+			for line := first; line <= last; line++ {
+				v.GutterMessage("claims", line+1, msg, kind)
+			}
+		}
+		b.unlockDoc()
+	}
+}
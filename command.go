@@ -6,11 +6,14 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	humanize "github.com/dustin/go-humanize"
+	"github.com/zyedidia/micro/cmd/micro/session"
 	"github.com/zyedidia/micro/cmd/micro/shellwords"
 )
 
@@ -58,6 +61,21 @@ func init() {
 		"MemUsage":   MemUsage,
 		"Retab":      Retab,
 		"Raw":        Raw,
+		"Share":      Share,
+		"Join":       Join,
+		"Unshare":    Unshare,
+		"Role":       SetRole,
+		"ToggleChat": ToggleChat,
+		"Say":        Say,
+		"NetStat":    NetStat,
+		"Peers":      Peers,
+		"Session":    SessionInfo,
+		"Follow":     Follow,
+		"Comment":    Comment,
+		"Reply":      Reply,
+		"Comments":   ToggleComments,
+		"Workspace":  Workspace,
+		"Claim":      Claim,
 	}
 }
 
@@ -117,6 +135,21 @@ func DefaultCommands() map[string]StrCommand {
 		"memusage":   {"MemUsage", []Completion{NoCompletion}},
 		"retab":      {"Retab", []Completion{NoCompletion}},
 		"raw":        {"Raw", []Completion{NoCompletion}},
+		"share":      {"Share", []Completion{NoCompletion}},
+		"join":       {"Join", []Completion{NoCompletion}},
+		"unshare":    {"Unshare", []Completion{NoCompletion}},
+		"role":       {"Role", []Completion{NoCompletion}},
+		"chat":       {"ToggleChat", []Completion{NoCompletion}},
+		"say":        {"Say", []Completion{NoCompletion}},
+		"netstat":    {"NetStat", []Completion{NoCompletion}},
+		"peers":      {"Peers", []Completion{NoCompletion}},
+		"session":    {"Session", []Completion{NoCompletion}},
+		"follow":     {"Follow", []Completion{NoCompletion}},
+		"comment":    {"Comment", []Completion{NoCompletion}},
+		"reply":      {"Reply", []Completion{NoCompletion}},
+		"comments":   {"Comments", []Completion{NoCompletion}},
+		"workspace":  {"Workspace", []Completion{FileCompletion}},
+		"claim":      {"Claim", []Completion{NoCompletion}},
 	}
 }
 
@@ -343,6 +376,13 @@ func Open(args []string) {
 		}
 		filename = strings.Join(args, " ")
 
+		// the files of the workspace are joined from the peers
+		if f, ok := localHost.FileAt(filepath.ToSlash(filename)); ok {
+			if err := openWorkspaceFile(f); err != nil {
+				messenger.Error(err)
+			}
+			return
+		}
 		CurView().Open(filename)
 	} else {
 		messenger.Error("No filename")
@@ -661,12 +701,21 @@ func ReplaceAll(args []string) {
 	Replace(append(args, "-a"))
 }
 
-// Term opens a terminal in the current view
+// Term opens a terminal in the current view. It can also share the
+// terminal with the peers, show the terminal of a peer, and give a peer
+// watching ours input rights or take them back
 func Term(args []string) {
 	var err error
-	if len(args) == 0 {
+	switch {
+	case len(args) > 0 && args[0] == "share":
+		err = TermShare(args[1:])
+	case len(args) > 0 && args[0] == "join":
+		err = TermJoin(args[1:])
+	case len(args) == 2 && (args[0] == "grant" || args[0] == "revoke"):
+		err = TermGrant(args[1], args[0] == "grant")
+	case len(args) == 0:
 		err = CurView().StartTerminal([]string{os.Getenv("SHELL"), "-i"}, true, false, "")
-	} else {
+	default:
 		err = CurView().StartTerminal(args, true, false, "")
 	}
 	if err != nil {
@@ -690,3 +739,252 @@ func HandleCommand(input string) {
 		commands[inputCmd].action(args[1:])
 	}
 }
+
+// Share starts sharing the current buffer. The document ID defaults to
+// the name of the buffer
+func Share(args []string) {
+	b := CurView().Buf
+	docID := b.GetName()
+	if len(args) > 0 {
+		docID = args[0]
+	}
+
+	s, err := ShareBuffer(b, docID)
+	if err != nil {
+		messenger.Error(err)
+		return
+	}
+	messenger.Message(fmt.Sprintf("Sharing %s on %s", s.DocID, localHost.Addr()))
+}
+
+// Join joins a document shared by a peer and opens it in a new tab
+func Join(args []string) {
+	if len(args) < 1 {
+		messenger.Error("Usage: join host:port [document]")
+		return
+	}
+
+	docID := ""
+	if len(args) > 1 {
+		docID = args[1]
+	}
+
+	messenger.Message("Joining " + args[0] + "...")
+	RedrawAll()
+
+	buf, err := JoinSession(args[0], docID)
+	if err != nil {
+		messenger.Error(err)
+		return
+	}
+
+	tab := NewTabFromView(NewView(buf))
+	tab.SetNum(len(tabs))
+	tabs = append(tabs, tab)
+	curTab = len(tabs) - 1
+	if len(tabs) == 2 {
+		for _, t := range tabs {
+			for _, v := range t.Views {
+				v.ToggleTabbar()
+			}
+		}
+	}
+	r, _ := buf.session.Role(buf.session.LocalAddr())
+	messenger.Message("Joined " + buf.session.DocID + " as " + r.String())
+}
+
+// Unshare stops sharing the current buffer
+func Unshare(args []string) {
+	b := CurView().Buf
+	if b.session == nil {
+		messenger.Error(b.GetName() + " is not shared")
+		return
+	}
+
+	docID := b.session.DocID
+	b.unshare()
+	messenger.Message("Stopped sharing " + docID)
+}
+
+// SetRole lists the roles of the peers of the current buffer, or changes
+// the role of a peer if one is given
+func SetRole(args []string) {
+	s := CurView().Buf.session
+	if s == nil {
+		messenger.Error(CurView().Buf.GetName() + " is not shared")
+		return
+	}
+
+	if len(args) == 0 {
+		messenger.Message(s.RolesString())
+		return
+	}
+	if len(args) < 2 {
+		messenger.Error("Usage: role [host:port editor|viewer]")
+		return
+	}
+
+	r, err := session.ParseRole(args[1])
+	if err != nil {
+		messenger.Error(err)
+		return
+	}
+	if err := s.ChangeRole(args[0], r); err != nil {
+		messenger.Error(err)
+		return
+	}
+	messenger.Message(args[0] + " is now " + r.String())
+}
+
+// ToggleChat toggles the chat split of the shared buffer in the current view
+func ToggleChat(args []string) {
+	if CurView().Type == vtChat {
+		CurView().Quit(true)
+		return
+	}
+
+	b := CurView().Buf
+	if b.session == nil {
+		messenger.Error(b.GetName() + " is not shared")
+		return
+	}
+
+	buffer := b.chatBuffer()
+	CurView().HSplit(buffer)
+	CurView().Type = vtChat
+	b.unread = 0
+	RedrawAll()
+	buffer.Cursor.Loc = buffer.Start()
+	CurView().Relocate()
+	buffer.Cursor.Loc = buffer.End()
+	CurView().Relocate()
+}
+
+// Say sends a chat message to the peers of the shared buffer in the current view
+func Say(args []string) {
+	if len(args) < 1 {
+		messenger.Error("Not enough arguments")
+		return
+	}
+
+	b := CurView().Buf
+	if CurView().Type == vtChat {
+		// the message goes to the session of the chat being viewed
+		b = CurView().Buf.chatOf
+	}
+	if b == nil || b.session == nil {
+		messenger.Error(CurView().Buf.GetName() + " is not shared")
+		return
+	}
+
+	m := b.session.Say(strings.Join(args, " "))
+	b.addChat(m)
+}
+
+// NetStat writes the state of the connections to the peers of every shared
+// buffer to the log
+func NetStat(args []string) {
+	sessions := localHost.Sessions()
+	if len(sessions) == 0 {
+		messenger.Message("No buffer is shared")
+		return
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].DocID < sessions[j].DocID })
+
+	peers, queued := 0, 0
+	messenger.AddLog("----------------")
+	for _, s := range sessions {
+		messenger.AddLog(s.DocID + ":")
+		for _, st := range s.NetStats() {
+			state := "disconnected"
+			if st.CatchUp && st.Connected {
+				state = "catching up"
+			} else if st.Connected {
+				state = "connected"
+			}
+			messenger.AddLog(fmt.Sprintf("  %s %s, %d queued, delivered up to %d, stored up to %d, %d ops in %d messages",
+				st.Peer, state, st.Queued, st.Delivered, st.Acked, st.Sent, st.Messages))
+			peers++
+			queued += st.Queued
+		}
+	}
+	messenger.AddLog("----------------")
+	messenger.Message(fmt.Sprintf("%d peers, %d operations queued, see the log for details", peers, queued))
+}
+
+// discovered holds the sessions found by the last peers discover, in the
+// order they were listed
+var discovered []discoveredSession
+
+type discoveredSession struct {
+	addr  string
+	docID string
+}
+
+// Peers looks for the sessions shared on the local network, or joins one
+// of the sessions found
+func Peers(args []string) {
+	if len(args) == 2 && args[0] == "join" {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 || n > len(discovered) {
+			messenger.Error("No discovered session ", args[1])
+			return
+		}
+		d := discovered[n-1]
+		Join([]string{d.addr, d.docID})
+		return
+	}
+	if len(args) != 1 || args[0] != "discover" {
+		messenger.Error("Usage: peers discover|join N")
+		return
+	}
+
+	messenger.Message("Looking for sessions...")
+	RedrawAll()
+
+	found, err := session.Discover(session.DiscoveryGroup, time.Second)
+	if err != nil {
+		messenger.Error(err)
+		return
+	}
+	discovered = nil
+	for _, a := range found {
+		if a.Addr == localHost.Addr() {
+			continue
+		}
+		for _, docID := range a.DocIDs {
+			discovered = append(discovered, discoveredSession{a.Addr, docID})
+		}
+	}
+	if len(discovered) == 0 {
+		messenger.Message("No session found")
+		return
+	}
+
+	messenger.AddLog("----------------")
+	for i, d := range discovered {
+		messenger.AddLog(fmt.Sprintf("  %d. %s at %s", i+1, d.docID, d.addr))
+	}
+	messenger.AddLog("----------------")
+	messenger.Message(fmt.Sprintf("%d sessions found, see the log and join one with peers join N", len(discovered)))
+}
+
+// SessionInfo toggles the split showing the state of the session of the
+// shared buffer in the current view, refreshed as the peers come and go
+func SessionInfo(args []string) {
+	if CurView().Type == vtInfo {
+		CurView().Quit(true)
+		return
+	}
+
+	b := CurView().Buf
+	if b.session == nil {
+		messenger.Error(b.GetName() + " is not shared")
+		return
+	}
+
+	b.refreshInfo()
+	CurView().HSplit(b.infoBuffer())
+	CurView().Type = vtInfo
+	RedrawAll()
+}
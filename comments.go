@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zyedidia/micro/cmd/micro/session"
+)
+
+// A commentThread is a comment on a range of the shared buffer and the
+// replies to it, oldest first
+type commentThread struct {
+	root    session.Comment
+	replies []session.Comment
+}
+
+// commentThreads returns the threads of the session, numbered from 1 in the
+// order they were started
+func commentThreads(s *session.Session) []*commentThread {
+	var threads []*commentThread
+	byID := make(map[string]*commentThread)
+	comments := s.Comments()
+	for _, c := range comments {
+		if c.ReplyTo == "" {
+			t := &commentThread{root: c}
+			threads = append(threads, t)
+			byID[c.ID] = t
+		}
+	}
+	for _, c := range comments {
+		if t, ok := byID[c.ReplyTo]; ok {
+			t.replies = append(t.replies, c)
+		}
+	}
+	return threads
+}
+
+// commentLoc returns where the commented range of the buffer starts and
+// ends, ok is false once its text is deleted
+// Pre: the session is locked
+func (b *Buffer) commentLoc(c session.Comment) (start, end Loc, ok bool) {
+	i, j, ok := b.session.CommentSpan(c)
+	if !ok {
+		return Loc{}, Loc{}, false
+	}
+	return FromCharPos(i, b), FromCharPos(j, b), true
+}
+
+// commentsBuffer returns the buffer displaying the comments of the shared
+// buffer. It is created on first use
+func (b *Buffer) commentsBuffer() *Buffer {
+	if b.comments == nil {
+		b.comments = NewBufferFromString("", "")
+		b.comments.name = "Comments"
+		b.comments.private = true
+		b.comments.commentsOf = b
+	}
+	return b.comments
+}
+
+// commentsText lists the threads with the text they are about
+func (b *Buffer) commentsText() string {
+	threads := commentThreads(b.session)
+	if len(threads) == 0 {
+		return "No comments, add one with comment text\n"
+	}
+
+	var lines []string
+	b.lockDoc()
+	for i, t := range threads {
+		about := "(text deleted)"
+		if start, end, ok := b.commentLoc(t.root); ok {
+			text := strings.Replace(b.Substr(start, end), "\n", " ", -1)
+			if Count(text) > 40 {
+				text = string([]rune(text)[:40]) + "..."
+			}
+			about = fmt.Sprintf("line %d: %q", start.Y+1, text)
+		}
+		if i > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, fmt.Sprintf("#%d %s", i+1, about))
+		lines = append(lines, "  "+t.root.String())
+		for _, c := range t.replies {
+			lines = append(lines, "    "+c.String())
+		}
+	}
+	b.unlockDoc()
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// refreshComments rewrites the comments of the buffer if they changed
+func (b *Buffer) refreshComments() {
+	if b.session == nil || b.comments == nil {
+		return
+	}
+	buffer := b.comments
+	text := b.commentsText()
+	if buffer.String() == text {
+		return
+	}
+	buffer.remove(buffer.Start(), buffer.End())
+	buffer.insert(buffer.Start(), []byte(text))
+	buffer.IsModified = false
+	buffer.Cursor.Loc = buffer.Start()
+}
+
+// receiveComment displays a comment from a peer
+// This must be called from the main goroutine
+func (b *Buffer) receiveComment(c session.Comment) {
+	if b.session == nil {
+		return
+	}
+	b.refreshComments()
+	messenger.Message("New comment from " + c.From + ", see the comments")
+}
+
+// UpdateComments marks the commented lines in the gutter of the shared
+// buffers of the current tab, and refreshes the comments shown there, as
+// the ranges move with the text
+// This is called by the main loop
+func UpdateComments() {
+	for _, v := range tabs[curTab].Views {
+		if v.Type == vtComments && v.Buf.commentsOf != nil {
+			v.Buf.commentsOf.refreshComments()
+			continue
+		}
+		b := v.Buf
+		if b.session == nil {
+			continue
+		}
+
+		v.ClearGutterMessages("comments")
+		threads := commentThreads(b.session)
+		b.lockDoc()
+		for i, t := range threads {
+			start, _, ok := b.commentLoc(t.root)
+			if !ok {
+				continue
+			}
+			msg := fmt.Sprintf("#%d %s", i+1, t.root.Text)
+			if len(t.replies) > 0 {
+				msg += fmt.Sprintf(" (%d replies)", len(t.replies))
+			}
+			v.GutterMessage("comments", start.Y+1, msg, GutterInfo)
+		}
+		b.unlockDoc()
+	}
+}
+
+// commentedBuffer returns the shared buffer the current view shows or
+// shows the comments of
+func commentedBuffer() *Buffer {
+	b := CurView().Buf
+	if CurView().Type == vtComments {
+		b = b.commentsOf
+	}
+	if b == nil || b.session == nil {
+		messenger.Error(CurView().Buf.GetName() + " is not shared")
+		return nil
+	}
+	return b
+}
+
+// Comment comments the selection of the shared buffer in the current view,
+// or the current line if nothing is selected
+func Comment(args []string) {
+	if len(args) < 1 {
+		messenger.Error("Not enough arguments")
+		return
+	}
+	if CurView().Type == vtComments {
+		messenger.Error("Comment from the shared buffer, or reply with reply N text")
+		return
+	}
+	b := commentedBuffer()
+	if b == nil {
+		return
+	}
+
+	c := b.Cursor
+	var start, end Loc
+	if c.HasSelection() {
+		start, end = c.CurSelection[0], c.CurSelection[1]
+		if end.LessThan(start) {
+			start, end = end, start
+		}
+	} else {
+		start, end = Loc{0, c.Y}, Loc{Count(b.Line(c.Y)), c.Y}
+		if start == end && c.Y < b.NumLines-1 {
+			// an empty line, comment its newline
+			end = end.Move(1, b)
+		}
+	}
+	if start == end {
+		messenger.Error("Nothing to comment")
+		return
+	}
+
+	b.lockDoc()
+	b.session.AddComment(ToCharPos(start, b), ToCharPos(end, b), strings.Join(args, " "))
+	b.unlockDoc()
+	b.refreshComments()
+	messenger.Message("Comment added on line ", start.Y+1)
+}
+
+// Reply answers a comment thread of the shared buffer in the current view
+func Reply(args []string) {
+	if len(args) < 2 {
+		messenger.Error("Usage: reply N text")
+		return
+	}
+	b := commentedBuffer()
+	if b == nil {
+		return
+	}
+
+	threads := commentThreads(b.session)
+	n, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil || n < 1 || n > len(threads) {
+		messenger.Error("No comment thread ", args[0])
+		return
+	}
+	b.session.Reply(threads[n-1].root, strings.Join(args[1:], " "))
+	b.refreshComments()
+	messenger.Message("Replied to #", n)
+}
+
+// ToggleComments toggles the split listing the comment threads of the
+// shared buffer in the current view
+func ToggleComments(args []string) {
+	if CurView().Type == vtComments {
+		CurView().Quit(true)
+		return
+	}
+
+	b := CurView().Buf
+	if b.session == nil {
+		messenger.Error(b.GetName() + " is not shared")
+		return
+	}
+
+	b.commentsBuffer()
+	b.refreshComments()
+	CurView().HSplit(b.comments)
+	CurView().Type = vtComments
+	RedrawAll()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/zyedidia/micro/cmd/micro/session"
+)
+
+func TestCommentsText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-comments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host := session.NewHost(session.TCP, dir)
+	if err := host.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := NewBufferFromString(strings.Repeat("é", 60)+"\n", "comments.txt")
+	s, _, err := host.Share("comments.txt", buf.Document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Unshare()
+	buf.session = s
+
+	// the text commented on is cut after 40 runes, not in the middle of one
+	s.Lock()
+	s.AddComment(0, 50, "why?")
+	s.Unlock()
+	text := buf.commentsText()
+	assertTrue(t, utf8.ValidString(text))
+	assertTrue(t, strings.Contains(text, `"`+strings.Repeat("é", 40)+`..."`))
+}
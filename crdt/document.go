@@ -0,0 +1,692 @@
+// Package crdt implements the sequences shared by the peers, Logoot and RGA
+// documents behind the Sequence interface: position identifiers, their
+// allocation and serialization, and the operations exchanged between peers.
+package crdt
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"unicode/utf8"
+)
+
+// Adapted from Ravern Koh's implementation
+// Document represents a Logoot Documentument. Actions like Insert and Delete can be performed
+// on Document. If at any time an invalid position is given, a panic will occur, so raw
+// positions should only be used for debugging purposes.
+// The pairs of the document are runs, see run.go, while indexes count runes.
+type Document struct {
+	site  uint8
+	pairs []Pair
+	// hash of the runes, see Hash
+	hash uint64
+	// index of the first rune of every pair, followed by the number of
+	// runes, Start and End included. It is rebuilt after a change
+	offsets []int
+	valid   bool
+	// position of the last rune inserted locally, the run typed after it
+	// goes on from there, see InsertMultiple
+	tip     []Identifier
+	storage Storage
+}
+
+// Pos is an element of a position identifier. A position identifier identifies an
+// atom within a Doc. The behaviour of an empty position identifier (length == 0) is
+// undefined, so just do not pass in empty position identifiers to any method/function.
+type Identifier struct {
+	Ident uint16
+	Site  uint8
+}
+
+// Pair is a position identifier and its atom.
+type Pair struct {
+	Pos  []Identifier // a position is a list of identifiers, the one of the first rune
+	Atom string       // a run of one or more runes, see RunPos
+	ID   uint64       // unique constant as identified in the docdb, 0 if not stored
+}
+
+// Start and end positions. These will always exist within a Documentument.
+var (
+	Start = []Identifier{{0, 0}}
+	End   = []Identifier{{^uint16(0), 0}}
+)
+
+// NewDocument returns a Document holding the given content. The content is
+// split into runs as long as they can be, at evenly spaced identifiers, so a
+// document loaded from a file does not start out with deep positions. All of
+// the initial atoms use site 0, which makes the result only depend on the content:
+// two peers loading the same file end up with identical documents.
+// The site is the one used for the identifiers generated locally.
+func NewDocument(site uint8, content string) *Document {
+	const size = int(^uint16(0)) - 1 // runes of a run, counting from 1
+	d := &Document{site: site}
+	atoms := []rune(content)
+
+	n := (len(atoms) + size - 1) / size
+	d.pairs = make([]Pair, 0, n+2)
+	d.pairs = append(d.pairs, Pair{Pos: Start})
+	for i, p := range spreadPos(n) {
+		p = append(p, Identifier{1, 0})
+		end := (i + 1) * size
+		if end > len(atoms) {
+			end = len(atoms)
+		}
+		atom := string(atoms[i*size : end])
+		d.pairs = append(d.pairs, Pair{Pos: p, Atom: atom})
+		d.hash ^= runHash(p, atom)
+	}
+	d.pairs = append(d.pairs, Pair{Pos: End})
+	return d
+}
+
+// Site returns the site used for the identifiers generated locally
+func (d *Document) Site() uint8 {
+	return d.site
+}
+
+// SetSite changes the site used for the identifiers generated locally
+func (d *Document) SetSite(site uint8) {
+	d.site = site
+}
+
+// SetStorage sets the storage the changes of the pairs go to
+func (d *Document) SetStorage(st Storage) {
+	d.storage = st
+}
+
+// nextID hands out the docdb ID of a new pair, 0 if the document is not stored
+func (d *Document) nextID() uint64 {
+	if d.storage == nil {
+		return 0
+	}
+	return d.storage.NextAtomID()
+}
+
+// put stores a new or changed pair
+func (d *Document) put(p Pair) {
+	if d.storage != nil {
+		d.storage.PutAtom(p.ID, p.Atom, p.Pos)
+	}
+}
+
+// size returns the number of runes of the pair at i, Start and End count as one
+func (d *Document) size(i int) int {
+	if i == 0 || i == len(d.pairs)-1 {
+		return 1
+	}
+	if d.valid {
+		return d.offsets[i+1] - d.offsets[i]
+	}
+	return utf8.RuneCountInString(d.pairs[i].Atom)
+}
+
+// rebuild updates the offsets after a change
+func (d *Document) rebuild() {
+	if d.valid {
+		return
+	}
+	d.offsets = d.offsets[:0]
+	n := 0
+	for i := range d.pairs {
+		d.offsets = append(d.offsets, n)
+		n += d.size(i)
+	}
+	d.offsets = append(d.offsets, n)
+	d.valid = true
+}
+
+// Len returns the number of runes in the document
+func (d *Document) Len() int {
+	d.rebuild()
+	return d.offsets[len(d.pairs)] - 2
+}
+
+// Pos returns the position of the rune at index i, Start at 0 and End at Len()+1
+func (d *Document) Pos(i int) []Identifier {
+	d.rebuild()
+	k := sort.Search(len(d.pairs), func(k int) bool { return d.offsets[k+1] > i })
+	if k == len(d.pairs) {
+		return End
+	}
+	return RunPos(d.pairs[k].Pos, i-d.offsets[k])
+}
+
+// Author returns the site which inserted the rune at index i: positions end
+// with an identifier of the site which generated them
+func (d *Document) Author(i int) uint8 {
+	return d.SiteOf(d.Pos(i))
+}
+
+// SiteOf returns the site which generated the position: the one of its last
+// identifier
+func (d *Document) SiteOf(p []Identifier) uint8 {
+	if len(p) == 0 {
+		return 0
+	}
+	return p[len(p)-1].Site
+}
+
+// spreadPos returns n increasing position identifiers spread evenly between Start
+// and End. Every level uses the digits 1 to 65534 so that there is always room
+// left on both sides of the generated positions.
+func spreadPos(n int) [][]Identifier {
+	const base = uint64(^uint16(0)) - 1
+	depth, total := 1, base
+	for total <= uint64(n) {
+		depth++
+		total *= base
+	}
+	step := total / uint64(n+1)
+
+	ps := make([][]Identifier, n)
+	for i := range ps {
+		v := uint64(i+1) * step
+		p := make([]Identifier, depth)
+		for j := depth - 1; j >= 0; j-- {
+			p[j] = Identifier{uint16(v%base) + 1, 0}
+			v /= base
+		}
+		ps[i] = p
+	}
+	return ps
+}
+
+/* Basic methods */
+
+// locate returns the pair holding the rune at the position, or after which
+// it would be, and the rune of the pair it is, or would be before
+func (d *Document) locate(p []Identifier) (i, k int, exists bool) {
+	i = sort.Search(len(d.pairs), func(i int) bool { return ComparePos(d.pairs[i].Pos, p) > 0 }) - 1
+	if i < 0 {
+		return 0, 0, false
+	}
+	pos, n := d.pairs[i].Pos, d.size(i)
+	k = sort.Search(n, func(k int) bool { return compareRun(pos, k, p) >= 0 })
+	return i, k, k < n && compareRun(pos, k, p) == 0
+}
+
+// Index of a position in the Document. Secondary value indicates whether the value exists.
+// If the value doesn't exist, the index returned is the index that the position would
+// have been in, should it have existed.
+func (d *Document) Index(p []Identifier) (int, bool) {
+	d.rebuild()
+	i, k, exists := d.locate(p)
+	return d.offsets[i] + k, exists
+}
+
+// ComparePos compares two position identifiers, returning -1 if the left is less than the
+// right, 0 if equal, and 1 if greater.
+func ComparePos(lp []Identifier, rp []Identifier) int8 {
+	for i := 0; i < len(lp); i++ {
+		if len(rp) == i {
+			return 1
+		}
+		if lp[i].Ident < rp[i].Ident {
+			return -1
+		}
+		if lp[i].Ident > rp[i].Ident {
+			return 1
+		}
+		if lp[i].Site < rp[i].Site {
+			return -1
+		}
+		if lp[i].Site > rp[i].Site {
+			return 1
+		}
+	}
+	if len(rp) > len(lp) {
+		return -1
+	}
+	return 0
+}
+
+// Atom at the position. Secondary return value indicates whether the value exists.
+func (d *Document) Get(p []Identifier) (string, bool) {
+	i, exists := d.Index(p)
+	if !exists || i == 0 || i == d.Len()+1 {
+		return "", false
+	}
+	var atom string
+	d.pieces(i, i+1, func(k int, piece Pair) {
+		atom = piece.Atom
+	})
+	return atom, true
+}
+
+// InsertPos inserts a run at the position, returning success or failure: none of its
+// runes may exist already, nor any other rune lie between them.
+// docdbID is the ID the run is stored with, 0 for a new one. A new run that
+// continues the one before it is appended to it
+func (d *Document) InsertPos(p []Identifier, atom string, docdbID uint64) bool {
+	n := utf8.RuneCountInString(atom)
+	if n == 0 || !runFits(p, n) {
+		return false
+	}
+	d.rebuild()
+	i, k, exists := d.locate(p)
+	if exists || i == len(d.pairs)-1 {
+		return false
+	}
+	// the rune following the run must come after its last rune
+	size := d.size(i)
+	next := d.pairs[i+1].Pos
+	if k < size {
+		next = RunPos(d.pairs[i].Pos, k)
+	}
+	if compareRun(p, n-1, next) >= 0 {
+		return false
+	}
+
+	d.hash ^= runHash(p, atom)
+	d.valid = false
+	switch {
+	case k < size:
+		d.split(i, k)
+	case docdbID == 0 && i > 0 && size < runGrowth && compareRun(d.pairs[i].Pos, size, p) == 0:
+		d.pairs[i].Atom += atom
+		d.put(d.pairs[i])
+		return true
+	}
+	if docdbID == 0 {
+		docdbID = d.nextID()
+	}
+	pair := Pair{p, atom, docdbID}
+	d.pairs = append(d.pairs[:i+1], append([]Pair{pair}, d.pairs[i+1:]...)...)
+	d.put(pair)
+	return true
+}
+
+// split splits the pair at i before its k-th rune. The second half is stored anew
+func (d *Document) split(i, k int) {
+	pair := d.pairs[i]
+	off := runeOffset(pair.Atom, k)
+	left := Pair{pair.Pos, pair.Atom[:off], pair.ID}
+	right := Pair{RunPos(pair.Pos, k), pair.Atom[off:], d.nextID()}
+	d.pairs[i] = left
+	d.pairs = append(d.pairs[:i+1], append([]Pair{right}, d.pairs[i+1:]...)...)
+	d.put(left)
+	d.put(right)
+	d.valid = false
+}
+
+// InsertMultiple, given a position identifier, inserts text to the right of the given position.
+// The text is inserted as a run, or as few runs as the room between the
+// position and the next one allows, which are returned for the caller to
+// log and transmit. Text typed after the text inserted last continues its run
+func (d *Document) InsertMultiple(p []Identifier, value string) ([]Pair, bool) {
+	runes := []rune(value)
+	i, exists := d.Index(p)
+	if len(runes) < 1 || !exists || i > d.Len() {
+		return nil, false
+	}
+	rp := d.Pos(i + 1)
+
+	var inserted []Pair
+	for len(runes) > 0 {
+		n := 0
+		var np []Identifier
+		if d.tip != nil && ComparePos(p, d.tip) == 0 && runFits(p, 2) {
+			np = RunPos(p, 1)
+			n = runLength(np, len(runes), rp)
+		}
+		if n == 0 {
+			var success bool
+			if np, success = d.GeneratePos(p, rp); !success {
+				return inserted, false
+			}
+			n = runLength(np, len(runes), rp)
+			// a random position may leave little room for a run, one
+			// level deeper there is room for the rest of the text
+			deep := append(append([]Identifier{}, p...), Identifier{1, d.site})
+			if m := runLength(deep, len(runes), rp); m > n {
+				np, n = deep, m
+			}
+		}
+		atom := string(runes[:n])
+		if !d.InsertPos(np, atom, 0) {
+			return inserted, false
+		}
+		inserted = append(inserted, Pair{np, atom, 0})
+		p = RunPos(np, n-1)
+		d.tip = p
+		runes = runes[n:]
+	}
+	return inserted, true
+}
+
+// runLength returns how many of n runes fit in a run at p, before rp
+func runLength(p []Identifier, n int, rp []Identifier) int {
+	return sort.Search(n, func(k int) bool {
+		return !runFits(p, k+1) || compareRun(p, k, rp) >= 0
+	})
+}
+
+// DeletePos deletes the rune at the position, returning success or failure (non-existent position).
+func (d *Document) DeletePos(p []Identifier) bool {
+	i, exists := d.Index(p)
+	if !exists {
+		return false
+	}
+	return d.DeleteMultiple(i, i+1) != nil
+}
+
+// DeleteMultiple deletes runes starting at startIndex and up to endIndex
+// Returns the deleted parts of the runs so that they can be logged and transmitted
+func (d *Document) DeleteMultiple(startIndex, endIndex int) []Pair {
+
+	if startIndex == 0 || endIndex >= d.Len()+2 { // cannot delete Start and End
+		return nil
+	}
+
+	if startIndex >= endIndex { // endIndex must be at least on higher than startIndex
+		return nil
+	}
+
+	var deleted, kept []Pair
+	first, last := -1, -1
+	d.pieces(startIndex, endIndex, func(i int, piece Pair) {
+		if first < 0 {
+			first = i
+		}
+		last = i
+		deleted = append(deleted, piece)
+		d.hash ^= runHash(piece.Pos, piece.Atom)
+
+		// the runes before and after the deleted ones are kept, the ones
+		// after are stored anew if both are
+		pair, size := d.pairs[i], d.offsets[i+1]-d.offsets[i]
+		id, removed := pair.ID, true
+		if k := startIndex - d.offsets[i]; k > 0 {
+			kept = append(kept, Pair{pair.Pos, pair.Atom[:runeOffset(pair.Atom, k)], id})
+			removed = false
+		}
+		if k := endIndex - d.offsets[i]; k < size {
+			if !removed {
+				id = d.nextID()
+			}
+			kept = append(kept, Pair{RunPos(pair.Pos, k), pair.Atom[runeOffset(pair.Atom, k):], id})
+			removed = false
+		}
+		if removed && d.storage != nil {
+			d.storage.DeleteAtom(pair.ID)
+		}
+	})
+	for _, p := range kept {
+		d.put(p)
+	}
+	d.pairs = append(d.pairs[:first], append(kept, d.pairs[last+1:]...)...)
+	d.valid = false
+	return deleted
+}
+
+// Left returns the position to the left of the given position, and a flag indicating
+// whether it exists (when the given position is the start, there is no position to the
+// left of it). Will be false if the given position is invalid. The Start pair is not
+// considered as an actual pair.
+func (d *Document) Left(p []Identifier) ([]Identifier, bool) {
+	i, exists := d.Index(p)
+	if !exists || i == 0 {
+		return nil, false
+	}
+	return d.Pos(i - 1), true
+}
+
+// Right returns the position to the right of the given position, and a flag indicating
+// whether it exists (when the given position is the end, there is no position to the
+// right of it). Will be false if the given position is invalid. The End pair is not
+// considered as an actual pair.
+func (d *Document) Right(p []Identifier) ([]Identifier, bool) {
+	i, exists := d.Index(p)
+	if !exists || i >= d.Len()+1 {
+		return nil, false
+	}
+	return d.Pos(i + 1), true
+}
+
+// random number between x and y, where y is greater than x.
+func random(x, y uint16) uint16 {
+	return uint16(rand.Intn(int(y-x-1))) + 1 + x
+}
+
+// GeneratePos generates a new position identifier between the two positions provided.
+// Secondary return value indicates whether it was successful (when the two positions
+// are equal, or the left is greater than right, position cannot be generated).
+// Later will be optimized if time permits to LSEQ
+func GeneratePos(lp, rp []Identifier, site uint8) ([]Identifier, bool) {
+	if ComparePos(lp, rp) != -1 { // lp should be less than rp
+		return nil, false
+	}
+	p := []Identifier{}
+	for i := 0; i < len(lp); i++ { // why len(lp)? could be len(rp)
+		l := lp[i]
+		r := rp[i]
+		if l.Ident == r.Ident && l.Site == r.Site { //all same, append
+			p = append(p, Identifier{l.Ident, l.Site})
+			continue
+		}
+		if d := r.Ident - l.Ident; d > 1 { // there are spaces in this level
+			r := random(l.Ident, r.Ident)
+			p = append(p, Identifier{r, site})
+		} else if d == 1 { // no space in this level
+			if site > l.Site { // if site is larger, TOTest:
+				p = append(p, Identifier{l.Ident, site})
+			} else if site < r.Site {
+				p = append(p, Identifier{r.Ident, site})
+			} else { // we now that rp[i] - lp[i] == 1 in this case, go through rest of lp to find a place to generate
+				// if lp[i+1] does not exist, then min := 0, else
+				min := uint16(0)
+				if len(lp) > i+1 {
+					min = lp[i+1].Ident // this should be lp[i+1].Ident
+				} // TODO: edge case need to check if min = max - 1
+				if len(lp) > len(rp) { // long lp, hard case
+					min = lp[len(rp)].Ident
+					// Super edge case
+					// left  => {3 1} {65534 1}
+					// right => {4 1}. some optimization can be made here, but stick it for now
+					// In this case, 65534 can't be min, because no number is in between
+					// it and MAX. So need to extend the positions further.
+					if min == ^uint16(0)-1 { // maxium is 65535, no space in lp's last level
+						r := random(0, ^uint16(0))
+						p = append(p, Identifier{l.Ident, l.Site}) // append previous
+						p = append(p, lp[len(rp):]...)
+						p = append(p, Identifier{r, site})
+						return p, true
+					}
+				}
+				// need to take in account the case of min = ^uint16(0) - 1
+				var r uint16
+				if min == ^uint16(0)-1 {
+					r = ^uint16(0)
+				} else {
+					r = random(min, ^uint16(0))
+				}
+				//r := random(min, ^uint16(0)) // if min = ^uint16(0) - 1, then, need to append one more
+				p = append(p, Identifier{l.Ident, l.Site}, Identifier{r, site})
+			}
+		} else {
+			if site > l.Site && site < r.Site { //good case of three peers
+				p = append(p, Identifier{l.Ident, site})
+			} else {
+				min := uint16(0)
+				if len(lp) > i+1 {
+					min = lp[i+1].Ident // this should be lp[i+1].Ident
+				} // TODO: edge case need to check if min = max - 1
+				// special cases where there are no spaces oin this level
+				// which basically means we need to extend positions further
+				if len(lp) > len(rp) { // long lp, hard case
+					min = lp[len(rp)].Ident
+					// Super edge case
+					// left  => {3 1} {65534 1}
+					// right => {4 1}. some optimization can be made here, but stick it for now
+					// In this case, 65534 can't be min, because no number is in between
+					// it and MAX. So need to extend the positions further.
+					if min == ^uint16(0)-1 { // maxium is 65535, no space in lp's last level
+						r := random(0, ^uint16(0))
+						p = append(p, Identifier{l.Ident, l.Site}) // append previous
+						p = append(p, lp[len(rp):]...)
+						p = append(p, Identifier{r, site})
+						return p, true
+					}
+				}
+
+				// need to take in account the case of min = ^uint16(0) - 1
+				var r uint16
+				if min == ^uint16(0)-1 {
+					r = ^uint16(0)
+				} else {
+					r = random(min, ^uint16(0))
+				}
+
+				p = append(p, Identifier{l.Ident, l.Site}, Identifier{r, site})
+
+			}
+		}
+		return p, true
+	}
+	var r uint16
+	if len(rp) > len(lp) { // easy case, make a random integer in new level
+		// TODO: need to account for cases where rp[len(lp)].Ident == 1
+		for i := len(lp); i < len(rp); i++ {
+			if rp[i].Ident == 1 {
+				r = 0
+				p = append(p, Identifier{r, site})
+				r := random(0, ^uint16(0))
+				p = append(p, Identifier{r, site})
+				return p, true
+			} else if rp[i].Ident == 0 {
+				// just append all the identifiers except the last
+				p = append(p, rp[i])
+				continue
+			} else {
+				r = random(0, rp[i].Ident)
+				p = append(p, Identifier{r, site})
+				return p, true
+			}
+			//p = append(p, Identifier{r, site})
+		}
+	}
+	return p, true
+}
+
+// use this one when insert
+// GeneratePos generates a new position identifier between the two positions provided.
+// Secondary return value indicates whether it was successful (when the two positions
+// are equal, or the left is greater than right, position cannot be generated).
+func (d *Document) GeneratePos(lp []Identifier, rp []Identifier) ([]Identifier, bool) {
+	return GeneratePos(lp, rp, d.site)
+}
+
+/* Convenience methods */
+
+// InsertLeft inserts the atom to the left of the given position, returning the inserted
+// position and whether it is successful (when the given position doesn't exist,
+// InsertLeft won't do anything and return false).
+func (d *Document) InsertLeft(p []Identifier, atom string, docdbID uint64) ([]Identifier, bool) {
+	lp, success := d.Left(p)
+	if !success {
+		return nil, false
+	}
+	np, success := d.GeneratePos(lp, p)
+	if !success {
+		return nil, false
+	}
+	return np, d.InsertPos(np, atom, docdbID)
+}
+
+// InsertRight inserts the atom to the right of the given position, returning the inserted
+// position whether it is successful (when the given position doesn't exist, InsertRight
+// won't do anything and return false).
+func (d *Document) InsertRight(p []Identifier, atom string, docdbID uint64) ([]Identifier, bool) {
+	rp, success := d.Right(p)
+	if !success {
+		return nil, false
+	}
+	np, success := d.GeneratePos(p, rp) // generate a position identifier between p and rp
+	if !success {
+		return nil, false
+	}
+	return np, d.InsertPos(np, atom, docdbID)
+}
+
+// DeleteLeft deletes the atom to the left of the given position, returning whether it
+// was successful (when the given position is the start, there is no position to the left
+// of it).
+func (d *Document) DeleteLeft(p []Identifier) bool {
+	lp, success := d.Left(p)
+	if !success {
+		return false
+	}
+	return d.DeletePos(lp)
+}
+
+// DeleteRight deletes the atom to the right of the given position, returning whether it
+// was successful (when the given position is the end, there is no position to the right
+// of it).
+func (d *Document) DeleteRight(p []Identifier) bool {
+	rp, success := d.Right(p)
+	if !success {
+		return false
+	}
+	return d.DeletePos(rp)
+}
+
+// Content of the entire Documentument.
+func (d *Document) Content() string {
+	var b bytes.Buffer
+	for i := 1; i < len(d.pairs)-1; i++ {
+		b.WriteString(d.pairs[i].Atom)
+	}
+	return b.String()
+}
+
+// Other useful functions for serialization
+
+// PosBytes returns the position as a byte slice. The leading length byte
+// wraps around past 255 identifiers, NewPos relies on the slice length instead.
+func PosBytes(p []Identifier) []byte {
+	b := []byte{byte(len(p))}
+	for _, c := range p {
+		b = append(b, byte(c.Ident>>8), byte(c.Ident), byte(c.Site))
+	}
+	return b
+}
+
+// NewPos returns a position from the bytes. It doesn't validate the byte slice, so only
+// pass into it valid bytes.
+func NewPos(b []byte) []Identifier {
+	p := []Identifier{}
+	for i := 0; i < (len(b)-1)/3; i++ {
+		offset := i*3 + 1
+		ident := uint16(b[offset])<<8 + uint16(b[offset+1])
+		site := uint8(b[offset+2])
+		p = append(p, Identifier{ident, site})
+	}
+	return p
+}
+
+// Sequence methods, see sequence.go
+
+// Kind returns Logoot
+func (d *Document) Kind() string {
+	return Logoot
+}
+
+// Atoms returns the runs of the document, Start and End excluded
+func (d *Document) Atoms() []Pair {
+	return d.pairs[1 : len(d.pairs)-1]
+}
+
+// KeepsDeleted returns false, Logoot positions do not refer to other atoms
+func (d *Document) KeepsDeleted() bool {
+	return false
+}
+
+// Compare orders two positions, see ComparePos
+func (d *Document) Compare(p, q []Identifier) int8 {
+	return ComparePos(p, q)
+}
+
+// Ready returns true, an atom can be inserted at any position
+func (d *Document) Ready(p []Identifier) bool {
+	return true
+}
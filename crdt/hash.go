@@ -0,0 +1,115 @@
+package crdt
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// The hash of a document is the XOR of the hashes of its runes. It is kept up
+// to date as runes are inserted and deleted, and the hash of any range of
+// positions can be computed the same way, which lets two peers narrow down
+// where their documents differ without sending them whole. The hash does not
+// depend on how the runes are grouped into runs.
+
+// pairHash returns the hash of a rune at a position
+func pairHash(p []Identifier, atom string) uint64 {
+	return bytesHash(PosBytes(p)[1:], atom)
+}
+
+// runHash returns the hash of the runes of a run, see RunPos
+func runHash(p []Identifier, atom string) uint64 {
+	b := PosBytes(p)[1:]
+	ident := p[len(p)-1].Ident
+	var h uint64
+	for _, r := range atom {
+		b[len(b)-3], b[len(b)-2] = byte(ident>>8), byte(ident)
+		h ^= bytesHash(b, string(r))
+		ident++
+	}
+	return h
+}
+
+// bytesHash returns the hash of a rune at a serialized position
+func bytesHash(pos []byte, atom string) uint64 {
+	h := fnv.New64a()
+	h.Write(pos)
+	h.Write([]byte{0})
+	h.Write([]byte(atom))
+	// spread the bits, FNV alone is weak for XOR sums of similar inputs
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Hash returns the hash of the content of the document, positions included.
+// Documents holding the same runes at the same positions have the same hash
+func (d *Document) Hash() uint64 {
+	return d.hash
+}
+
+// rangeIndexes returns the indexes of the runes from lo (included) up to hi
+// (excluded). A nil lo starts after Start, a nil hi stops before End
+func (d *Document) rangeIndexes(lo, hi []Identifier) (int, int) {
+	i, j := 1, d.Len()+1
+	if lo != nil {
+		if i, _ = d.Index(lo); i < 1 {
+			i = 1
+		}
+	}
+	if hi != nil {
+		if j, _ = d.Index(hi); j > d.Len()+1 {
+			j = d.Len() + 1
+		}
+	}
+	if j < i {
+		j = i
+	}
+	return i, j
+}
+
+// pieces calls f with the part of every run from the rune at index i up to
+// the one at j (excluded), and the index of the run
+func (d *Document) pieces(i, j int, f func(k int, piece Pair)) {
+	d.rebuild()
+	k := sort.Search(len(d.pairs), func(k int) bool { return d.offsets[k+1] > i })
+	for ; k < len(d.pairs) && d.offsets[k] < j; k++ {
+		pair := d.pairs[k]
+		a, b := 0, d.offsets[k+1]-d.offsets[k]
+		if i > d.offsets[k] {
+			a = i - d.offsets[k]
+		}
+		if j < d.offsets[k+1] {
+			b = j - d.offsets[k]
+		}
+		lo, hi := runeOffset(pair.Atom, a), runeOffset(pair.Atom, b)
+		f(k, Pair{RunPos(pair.Pos, a), pair.Atom[lo:hi], pair.ID})
+	}
+}
+
+// RangeHash returns the hash of the runes from lo (included) up to hi
+// (excluded), and how many there are. A nil lo starts at the beginning of
+// the document, a nil hi stops at its end
+func (d *Document) RangeHash(lo, hi []Identifier) (uint64, int) {
+	i, j := d.rangeIndexes(lo, hi)
+	var h uint64
+	d.pieces(i, j, func(k int, piece Pair) {
+		h ^= runHash(piece.Pos, piece.Atom)
+	})
+	return h, j - i
+}
+
+// Range returns the runes from lo (included) up to hi (excluded), one pair
+// each. A nil lo starts at the beginning of the document, a nil hi stops at
+// its end
+func (d *Document) Range(lo, hi []Identifier) []Pair {
+	i, j := d.rangeIndexes(lo, hi)
+	pairs := make([]Pair, 0, j-i)
+	d.pieces(i, j, func(k int, piece Pair) {
+		pairs = append(pairs, piece.Runes()...)
+	})
+	return pairs
+}
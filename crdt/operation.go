@@ -0,0 +1,40 @@
+package crdt
+
+// Operation is an insertion or a deletion of an atom, as sent to the peers
+// and logged in storage
+type Operation struct {
+	Atom   string // content, a run of runes for insertions and deletions, see RunPos
+	OpType bool   // true for insert, false for delete
+	Pos    []byte // a serilized position in bytes for sending and receiving
+	Clock  uint64 // logical clock
+}
+
+// Operations turns pairs that have been inserted (or deleted) into
+// operations. The clocks are left to the caller
+func Operations(pairs []Pair, insert bool) []Operation {
+	ops := make([]Operation, len(pairs))
+	for i, p := range pairs {
+		ops[i] = Operation{
+			Atom:   p.Atom,
+			OpType: insert,
+			Pos:    PosBytes(p.Pos),
+		}
+	}
+	return ops
+}
+
+// Runes returns the operations of the runes of a run, one each, with the
+// clock of the operation
+func (op Operation) Runes() []Operation {
+	if len(op.Atom) <= 1 {
+		return []Operation{op}
+	}
+	p := NewPos(op.Pos)
+	ops := make([]Operation, 0, len(op.Atom))
+	k := 0
+	for _, r := range op.Atom {
+		ops = append(ops, Operation{string(r), op.OpType, PosBytes(RunPos(p, k)), op.Clock})
+		k++
+	}
+	return ops
+}
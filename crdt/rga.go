@@ -0,0 +1,454 @@
+package crdt
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// RGADocument is a Replicated Growable Array. Every atom is named by the
+// Lamport clock of its insertion and its site, and remembers the atom it
+// was inserted after, its origin. An atom goes right after its origin,
+// after the atoms inserted there later on: the text typed at the same spot
+// by two peers at the same time is kept in two runs instead of being
+// interleaved. The positions have a fixed size, the ID of the atom followed
+// by the one of its origin, so they do not grow as the text is edited.
+// Deleted atoms are kept, with an empty atom, since other atoms may go
+// after them. Atoms are single runes, RGADocument does not make runs.
+type RGADocument struct {
+	site uint8
+	// clock is the highest clock seen
+	clock uint32
+	// atoms holds every atom in order, Start and End included
+	atoms []Pair
+	// waiting holds the atoms inserted before their origin, by origin
+	waiting map[rgaID][]Pair
+	// hash of the atoms which are not deleted, see Hash
+	hash    uint64
+	storage Storage
+
+	// valid tells whether pairs and the indexes are up to date
+	valid bool
+	// pairs holds the atoms which are not deleted
+	pairs []Pair
+	// visible maps the IDs to indexes in pairs, index to indexes in atoms
+	visible map[rgaID]int
+	index   map[rgaID]int
+}
+
+// rgaID names an atom of an RGADocument
+type rgaID struct {
+	clock uint32
+	site  uint8
+}
+
+// later returns whether a was inserted after b, by Lamport order
+func (a rgaID) later(b rgaID) bool {
+	if a.clock != b.clock {
+		return a.clock > b.clock
+	}
+	return a.site > b.site
+}
+
+// IDs of Start and End
+var (
+	rgaStart = rgaID{0, 0}
+	rgaEnd   = rgaID{^uint32(0), ^uint8(0)}
+)
+
+// rgaPos returns the position of an atom inserted after origin
+func rgaPos(id, origin rgaID) []Identifier {
+	return []Identifier{
+		{uint16(id.clock >> 16), id.site}, {uint16(id.clock), id.site},
+		{uint16(origin.clock >> 16), origin.site}, {uint16(origin.clock), origin.site},
+	}
+}
+
+// rgaIDs returns the ID of the atom at the position and the ID of its
+// origin. ok is false if this is not the position of an RGADocument
+func rgaIDs(p []Identifier) (id, origin rgaID, ok bool) {
+	if len(p) != 4 {
+		return rgaID{}, rgaID{}, false
+	}
+	id = rgaID{uint32(p[0].Ident)<<16 | uint32(p[1].Ident), p[0].Site}
+	origin = rgaID{uint32(p[2].Ident)<<16 | uint32(p[3].Ident), p[2].Site}
+	return id, origin, true
+}
+
+// NewRGADocument returns an RGADocument holding the given content. Like the
+// ones of NewDocument, the initial atoms use site 0 so that the result only
+// depends on the content. The site is the one used for the atoms inserted
+// locally
+func NewRGADocument(site uint8, content string) *RGADocument {
+	d := &RGADocument{site: site, waiting: make(map[rgaID][]Pair)}
+	atoms := []rune(content)
+
+	d.atoms = make([]Pair, 0, len(atoms)+2)
+	d.atoms = append(d.atoms, Pair{Pos: rgaPos(rgaStart, rgaStart)})
+	origin := rgaStart
+	for _, a := range atoms {
+		d.clock++
+		id := rgaID{d.clock, 0}
+		p := rgaPos(id, origin)
+		d.atoms = append(d.atoms, Pair{Pos: p, Atom: string(a)})
+		d.hash ^= pairHash(p, string(a))
+		origin = id
+	}
+	d.atoms = append(d.atoms, Pair{Pos: rgaPos(rgaEnd, rgaEnd)})
+	return d
+}
+
+// Kind returns RGA
+func (d *RGADocument) Kind() string {
+	return RGA
+}
+
+// Site returns the site used for the atoms inserted locally
+func (d *RGADocument) Site() uint8 {
+	return d.site
+}
+
+// SetSite changes the site used for the atoms inserted locally
+func (d *RGADocument) SetSite(site uint8) {
+	d.site = site
+}
+
+// SetStorage sets the storage the changes of the atoms go to
+func (d *RGADocument) SetStorage(st Storage) {
+	d.storage = st
+}
+
+// nextID hands out the docdb ID of a new atom, 0 if the document is not stored
+func (d *RGADocument) nextID() uint64 {
+	if d.storage == nil {
+		return 0
+	}
+	return d.storage.NextAtomID()
+}
+
+// put stores a new or changed atom
+func (d *RGADocument) put(p Pair) {
+	if d.storage != nil {
+		d.storage.PutAtom(p.ID, p.Atom, p.Pos)
+	}
+}
+
+// KeepsDeleted returns true, the deleted atoms may be the origin of others
+func (d *RGADocument) KeepsDeleted() bool {
+	return true
+}
+
+// deleted returns whether the atom at i in atoms is deleted
+func (d *RGADocument) deleted(i int) bool {
+	return i > 0 && i < len(d.atoms)-1 && d.atoms[i].Atom == ""
+}
+
+// rebuild updates pairs and the indexes after a change
+func (d *RGADocument) rebuild() {
+	if d.valid {
+		return
+	}
+	d.pairs = make([]Pair, 0, len(d.atoms))
+	d.visible = make(map[rgaID]int, len(d.atoms))
+	d.index = make(map[rgaID]int, len(d.atoms))
+	for i, p := range d.atoms {
+		id, _, _ := rgaIDs(p.Pos)
+		d.index[id] = i
+		if !d.deleted(i) {
+			d.visible[id] = len(d.pairs)
+			d.pairs = append(d.pairs, p)
+		}
+	}
+	d.valid = true
+}
+
+// Len returns the number of atoms which are not deleted
+func (d *RGADocument) Len() int {
+	d.rebuild()
+	return len(d.pairs) - 2
+}
+
+// Pos returns the position of the atom at index i among the ones which
+// are not deleted
+func (d *RGADocument) Pos(i int) []Identifier {
+	d.rebuild()
+	return d.pairs[i].Pos
+}
+
+// Author returns the site which inserted the rune at index i, the one of
+// its ID
+func (d *RGADocument) Author(i int) uint8 {
+	return d.SiteOf(d.Pos(i))
+}
+
+// SiteOf returns the site which generated the position: the one of the ID
+// of its atom
+func (d *RGADocument) SiteOf(p []Identifier) uint8 {
+	id, _, _ := rgaIDs(p)
+	return id.site
+}
+
+// Atoms returns every atom, the deleted ones with an empty atom
+func (d *RGADocument) Atoms() []Pair {
+	// the docdb IDs may be changed, pairs must see them
+	d.valid = false
+	return d.atoms[1 : len(d.atoms)-1]
+}
+
+// locate returns the index in atoms of the atom at the position, or where it
+// would be integrated. ready is false if its origin is missing, the index
+// is then the one of End
+func (d *RGADocument) locate(p []Identifier) (i int, exists, ready bool) {
+	id, origin, ok := rgaIDs(p)
+	if !ok {
+		return len(d.atoms) - 1, false, false
+	}
+	d.rebuild()
+	if i, ok := d.index[id]; ok {
+		return i, true, true
+	}
+	o, ok := d.index[origin]
+	if !ok {
+		return len(d.atoms) - 1, false, false
+	}
+	return d.integration(o, id), false, true
+}
+
+// integration returns where an atom goes in atoms, given the index of its
+// origin: after the atoms inserted later than itself, which are either
+// inserted after the same origin or after one of those
+func (d *RGADocument) integration(o int, id rgaID) int {
+	j := o + 1
+	for ; j < len(d.atoms)-1; j++ {
+		other, _, _ := rgaIDs(d.atoms[j].Pos)
+		if !other.later(id) {
+			break
+		}
+	}
+	return j
+}
+
+// Index of the atom at the position, and whether it is there and not
+// deleted. A deleted atom gives the index of the next atom
+func (d *RGADocument) Index(p []Identifier) (int, bool) {
+	i, exists, _ := d.locate(p)
+	if exists && !d.deleted(i) {
+		id, _, _ := rgaIDs(p)
+		return d.visible[id], true
+	}
+	n := 0
+	for k := 0; k < i; k++ {
+		if !d.deleted(k) {
+			n++
+		}
+	}
+	return n, false
+}
+
+// Compare orders two positions as their atoms are, or would be, in the sequence
+func (d *RGADocument) Compare(p, q []Identifier) int8 {
+	i, _, _ := d.locate(p)
+	j, _, _ := d.locate(q)
+	if i == j {
+		// atoms to be integrated at the same place, the later one first
+		a, _, _ := rgaIDs(p)
+		b, _, _ := rgaIDs(q)
+		switch {
+		case a == b:
+			return 0
+		case a.later(b):
+			return -1
+		}
+		return 1
+	}
+	if i < j {
+		return -1
+	}
+	return 1
+}
+
+// Ready returns whether the origin of the atom at the position is there
+func (d *RGADocument) Ready(p []Identifier) bool {
+	_, _, ready := d.locate(p)
+	return ready
+}
+
+// InsertPos inserts an atom at its position. An atom arriving before its
+// origin waits for it
+func (d *RGADocument) InsertPos(p []Identifier, atom string, docdbID uint64) bool {
+	id, origin, ok := rgaIDs(p)
+	if !ok || id == rgaStart || id == rgaEnd || utf8.RuneCountInString(atom) > 1 {
+		return false
+	}
+	d.rebuild()
+	if _, exists := d.index[id]; exists {
+		return false
+	}
+	o, ok := d.index[origin]
+	if !ok {
+		for _, w := range d.waiting[origin] {
+			if bytes.Equal(PosBytes(w.Pos), PosBytes(p)) {
+				return false
+			}
+		}
+	}
+	if docdbID == 0 {
+		docdbID = d.nextID()
+	}
+	pair := Pair{p, atom, docdbID}
+	d.put(pair)
+	if !ok {
+		d.waiting[origin] = append(d.waiting[origin], pair)
+		return true
+	}
+	d.integrate(o, pair)
+	return true
+}
+
+// integrate inserts a pair whose origin is at o in atoms, and then the pairs
+// which were waiting for it
+func (d *RGADocument) integrate(o int, pair Pair) {
+	id, _, _ := rgaIDs(pair.Pos)
+	j := d.integration(o, id)
+	d.atoms = append(d.atoms[:j], append([]Pair{pair}, d.atoms[j:]...)...)
+	if pair.Atom != "" {
+		d.hash ^= pairHash(pair.Pos, pair.Atom)
+	}
+	if id.clock > d.clock {
+		d.clock = id.clock
+	}
+	d.valid = false
+
+	waiting := d.waiting[id]
+	delete(d.waiting, id)
+	for _, w := range waiting {
+		d.rebuild()
+		d.integrate(d.index[id], w)
+	}
+}
+
+// InsertMultiple inserts text after the atom at the position, one atom per
+// rune. Every atom goes after the previous one
+func (d *RGADocument) InsertMultiple(p []Identifier, value string) ([]Pair, bool) {
+	if len(value) < 1 {
+		return nil, false
+	}
+	origin, _, ok := rgaIDs(p)
+	d.rebuild()
+	o, exists := d.index[origin]
+	if !ok || !exists || origin == rgaEnd {
+		return nil, false
+	}
+
+	inserted := make([]Pair, 0, len(value))
+	for _, r := range value {
+		d.clock++
+		id := rgaID{d.clock, d.site}
+		pair := Pair{rgaPos(id, origin), string(r), d.nextID()}
+		d.hash ^= pairHash(pair.Pos, pair.Atom)
+		d.put(pair)
+		inserted = append(inserted, pair)
+		origin = id
+	}
+	// the new atoms are later than any other, so each one goes right after
+	// the previous one
+	d.atoms = append(d.atoms[:o+1], append(append([]Pair{}, inserted...), d.atoms[o+1:]...)...)
+	d.valid = false
+	return inserted, true
+}
+
+// DeletePos deletes the atom at the position, keeping it as deleted
+func (d *RGADocument) DeletePos(p []Identifier) bool {
+	i, exists, _ := d.locate(p)
+	if !exists || i == 0 || i == len(d.atoms)-1 || d.deleted(i) {
+		return false
+	}
+	d.hash ^= pairHash(d.atoms[i].Pos, d.atoms[i].Atom)
+	d.atoms[i].Atom = ""
+	d.put(d.atoms[i])
+	d.valid = false
+	return true
+}
+
+// DeleteMultiple deletes the atoms from startIndex up to endIndex
+func (d *RGADocument) DeleteMultiple(startIndex, endIndex int) []Pair {
+	d.rebuild()
+	if startIndex == 0 || endIndex >= len(d.pairs) || startIndex >= endIndex {
+		return nil
+	}
+
+	deleted := make([]Pair, 0, endIndex-startIndex)
+	for _, p := range d.pairs[startIndex:endIndex] {
+		id, _, _ := rgaIDs(p.Pos)
+		i := d.index[id]
+		deleted = append(deleted, d.atoms[i])
+		d.hash ^= pairHash(p.Pos, d.atoms[i].Atom)
+		d.atoms[i].Atom = ""
+		d.put(d.atoms[i])
+	}
+	d.valid = false
+	return deleted
+}
+
+// Content of the sequence
+func (d *RGADocument) Content() string {
+	var b bytes.Buffer
+	for _, p := range d.atoms {
+		b.WriteString(p.Atom)
+	}
+	return b.String()
+}
+
+// Hash returns the hash of the atoms which are not deleted
+func (d *RGADocument) Hash() uint64 {
+	return d.hash
+}
+
+// rangeIndexes returns the indexes in pairs from lo (included) up to hi
+// (excluded), ok is false if a bound cannot be placed
+func (d *RGADocument) rangeIndexes(lo, hi []Identifier) (i, j int, ok bool) {
+	d.rebuild()
+	i, j = 1, len(d.pairs)-1
+	if lo != nil {
+		if !d.Ready(lo) {
+			return 0, 0, false
+		}
+		if i, _ = d.Index(lo); i < 1 {
+			i = 1
+		}
+	}
+	if hi != nil {
+		if !d.Ready(hi) {
+			return 0, 0, false
+		}
+		if j, _ = d.Index(hi); j > len(d.pairs)-1 {
+			j = len(d.pairs) - 1
+		}
+	}
+	if j < i {
+		j = i
+	}
+	return i, j, true
+}
+
+// RangeHash returns the hash of the atoms from lo up to hi, and how many
+// there are
+func (d *RGADocument) RangeHash(lo, hi []Identifier) (uint64, int) {
+	i, j, ok := d.rangeIndexes(lo, hi)
+	if !ok {
+		return 0, -1
+	}
+	var h uint64
+	for _, p := range d.pairs[i:j] {
+		h ^= pairHash(p.Pos, p.Atom)
+	}
+	return h, j - i
+}
+
+// Range returns the atoms from lo up to hi
+func (d *RGADocument) Range(lo, hi []Identifier) []Pair {
+	i, j, ok := d.rangeIndexes(lo, hi)
+	if !ok {
+		return nil
+	}
+	return d.pairs[i:j]
+}
@@ -0,0 +1,93 @@
+package crdt
+
+import (
+	"unicode/utf8"
+)
+
+// Text typed or pasted in one go is kept as a run: a single pair whose atom
+// holds several runes. The position of the pair is the one of its first rune,
+// and the k-th rune is at RunPos(Pos, k), the last identifier counting up.
+// A run takes one pair in the document, one row in storage and one operation
+// on the wire. The runes of a run are ordered like any other position, so
+// an atom inserted in the middle of a run goes one level deeper and splits
+// it in two, and so does a deletion.
+
+// runGrowth is the size up to which a run grows as text is typed at its end.
+// Past it new runs are started, so that every keystroke does not store a
+// large run again
+const runGrowth = 1024
+
+// RunPos returns the position of the k-th rune of a run at p. The position
+// of the first rune, p itself, is returned as is
+func RunPos(p []Identifier, k int) []Identifier {
+	if k == 0 {
+		return p
+	}
+	q := make([]Identifier, len(p))
+	copy(q, p)
+	q[len(q)-1].Ident += uint16(k)
+	return q
+}
+
+// compareRun compares the position of the k-th rune of a run at p with q,
+// like ComparePos, without building it
+func compareRun(p []Identifier, k int, q []Identifier) int8 {
+	last := len(p) - 1
+	for i := 0; i < len(p); i++ {
+		if len(q) == i {
+			return 1
+		}
+		ident := int(p[i].Ident)
+		if i == last {
+			ident += k
+		}
+		if ident < int(q[i].Ident) {
+			return -1
+		}
+		if ident > int(q[i].Ident) {
+			return 1
+		}
+		if p[i].Site < q[i].Site {
+			return -1
+		}
+		if p[i].Site > q[i].Site {
+			return 1
+		}
+	}
+	if len(q) > len(p) {
+		return -1
+	}
+	return 0
+}
+
+// runFits returns whether a run of n runes can start at p: the last
+// identifier cannot count past its maximum
+func runFits(p []Identifier, n int) bool {
+	return int(p[len(p)-1].Ident)+n-1 <= int(^uint16(0))
+}
+
+// runeOffset returns the byte offset of the k-th rune of s
+func runeOffset(s string, k int) int {
+	for i := range s {
+		if k == 0 {
+			return i
+		}
+		k--
+	}
+	return len(s)
+}
+
+// Runes returns the runes of the pair, one pair each. A pair with an empty
+// atom, deleted, is returned as is
+func (p Pair) Runes() []Pair {
+	if utf8.RuneCountInString(p.Atom) <= 1 {
+		return []Pair{p}
+	}
+	pairs := make([]Pair, 0, len(p.Atom))
+	k := 0
+	for _, r := range p.Atom {
+		pairs = append(pairs, Pair{RunPos(p.Pos, k), string(r), p.ID})
+		k++
+	}
+	return pairs
+}
@@ -0,0 +1,123 @@
+package crdt
+
+import (
+	"errors"
+	"strings"
+)
+
+// Sequence is a replicated sequence of atoms. Every atom has a position
+// identifier, unique among the peers, which the operations refer to, and
+// the peers applying the same operations end up with the same sequence.
+// The implementations differ in how positions are generated and ordered:
+// Logoot positions order the atoms by themselves, RGA positions name the
+// atom they were inserted after.
+// An atom is a run of runes, see RunPos, or a single rune for the sequences
+// which do not make runs. Indexes count runes, Start as 0 and the first rune
+// as 1.
+type Sequence interface {
+	// Kind returns the kind of the sequence, one of SequenceKinds
+	Kind() string
+	// Site returns the site used for the positions generated locally
+	Site() uint8
+	// SetSite changes the site used for the positions generated locally
+	SetSite(site uint8)
+	// SetStorage sets the storage the changes of the atoms go to from now
+	// on. The atoms already there keep the IDs they have, see Atoms
+	SetStorage(st Storage)
+
+	// Len returns the number of runes in the sequence
+	Len() int
+	// Pos returns the position of the rune at index i, Start at 0 and End
+	// at Len()+1
+	Pos(i int) []Identifier
+	// Author returns the site which inserted the rune at index i, 0 for the
+	// initial content
+	Author(i int) uint8
+	// SiteOf returns the site which generated the position, 0 for the
+	// initial content
+	SiteOf(p []Identifier) uint8
+	// Atoms returns every atom the sequence keeps, Start and End excluded,
+	// in order. Sequences keeping their deleted atoms return them with an
+	// empty atom. The slice belongs to the sequence, only the docdb IDs of
+	// the pairs may be modified
+	Atoms() []Pair
+	// KeepsDeleted returns whether the deleted atoms are kept, because the
+	// positions of other atoms refer to them
+	KeepsDeleted() bool
+
+	// Index returns the index of the rune at the position, and whether it
+	// is there. If not, the index is where it would be
+	Index(p []Identifier) (int, bool)
+	// Compare orders two positions the way the runes at them are, or would
+	// be, in the sequence: -1 if p comes first, 0 if equal and 1 otherwise
+	Compare(p, q []Identifier) int8
+	// Ready returns whether the atom at the position can be inserted, that
+	// is the atoms its position refers to were inserted already
+	Ready(p []Identifier) bool
+
+	// InsertPos inserts an atom of a peer at its position, returning false
+	// if any of its runes is there already or if other runes lie between
+	// them. An empty atom is inserted deleted. docdbID is the ID the atom
+	// is stored with, 0 for the storage to hand out one
+	InsertPos(p []Identifier, atom string, docdbID uint64) bool
+	// InsertMultiple inserts text after the rune at the position and
+	// returns the inserted atoms
+	InsertMultiple(p []Identifier, value string) ([]Pair, bool)
+	// DeletePos deletes the rune at the position, returning whether it was there
+	DeletePos(p []Identifier) bool
+	// DeleteMultiple deletes the runes from startIndex up to endIndex (not
+	// included) and returns them, as atoms
+	DeleteMultiple(startIndex, endIndex int) []Pair
+
+	// Content returns the text of the sequence
+	Content() string
+	// Hash returns the hash of the runes and their positions, see hash.go
+	Hash() uint64
+	// RangeHash returns the hash of the runes from lo (included) up to hi
+	// (excluded), and how many there are. A nil lo starts at the beginning,
+	// a nil hi stops at the end. The count is -1 if a bound cannot be placed
+	RangeHash(lo, hi []Identifier) (uint64, int)
+	// Range returns the runes from lo (included) up to hi (excluded), one
+	// pair each, with the same bounds as RangeHash
+	Range(lo, hi []Identifier) []Pair
+}
+
+// Storage keeps the atoms of a sequence. The sequence calls it as its atoms
+// change, with the sequence locked
+type Storage interface {
+	// NextAtomID hands out the ID of a new atom
+	NextAtomID() uint64
+	// PutAtom stores the atom with the given ID, or replaces it
+	PutAtom(id uint64, atom string, pos []Identifier)
+	// DeleteAtom removes the atom with the given ID
+	DeleteAtom(id uint64)
+}
+
+// The kinds of sequences
+const (
+	Logoot = "logoot"
+	RGA    = "rga"
+)
+
+// SequenceKinds returns the kinds of sequences
+func SequenceKinds() []string {
+	return []string{Logoot, RGA}
+}
+
+// NewSequence returns a sequence of the given kind holding the content.
+// Two peers creating a sequence of the same kind from the same content end
+// up with identical sequences
+func NewSequence(kind string, site uint8, content string) (Sequence, error) {
+	switch kind {
+	case Logoot:
+		return NewDocument(site, content), nil
+	case RGA:
+		return NewRGADocument(site, content), nil
+	}
+	return nil, errors.New("unknown sequence " + kind + ", expected one of " + strings.Join(SequenceKinds(), ", "))
+}
+
+var (
+	_ Sequence = (*Document)(nil)
+	_ Sequence = (*RGADocument)(nil)
+)
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"strings"
 	"time"
 
 	dmp "github.com/sergi/go-diff/diffmatchpatch"
 	"github.com/yuin/gopher-lua"
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+	"github.com/zyedidia/micro/cmd/micro/session"
 )
 
 const (
@@ -26,6 +29,11 @@ type TextEvent struct {
 	EventType int
 	Deltas    []Delta
 	Time      time.Time
+
+	// Ops holds the CRDT operations of the event. Once the event has been
+	// executed, undo and redo use them instead of the deltas, so that they
+	// still apply to the right atoms after remote edits
+	Ops []crdt.Operation
 }
 
 // A Delta is a change to the buffer
@@ -35,20 +43,50 @@ type Delta struct {
 	End   Loc
 }
 
+// An UndoRef refers to an operation of a text event. Operations logged in the
+// ops table of a shared document are referred to by their clock and identifier,
+// the others (made before the document was shared) are kept whole
+type UndoRef struct {
+	Clock  uint64
+	Pos    []byte
+	OpType bool
+	Atom   string // only set if Clock is 0
+}
+
+// SerializedEvent is a text event as stored with a shared document
+type SerializedEvent struct {
+	C         Cursor
+	EventType int
+	Time      time.Time
+	Ops       []UndoRef
+}
+
+// SerializedUndo holds the undo and redo stacks of a shared document,
+// starting from the bottom of the stacks
+type SerializedUndo struct {
+	Undo []SerializedEvent
+	Redo []SerializedEvent
+}
+
 // ExecuteTextEvent runs a text event. This modifies the buffer
 func ExecuteTextEvent(t *TextEvent, buf *Buffer) {
+	var ops []crdt.Operation
 	if t.EventType == TextEventInsert {
 		for _, d := range t.Deltas {
-			buf.insert(d.Start, []byte(d.Text)) // insert to both lineArray and CRDT
+			ops = append(ops, buf.insertOps(d.Start, []byte(d.Text))...) // insert to both lineArray and CRDT
 		}
 	} else if t.EventType == TextEventRemove {
 		for i, d := range t.Deltas {
-			t.Deltas[i].Text = buf.remove(d.Start, d.End) // remove
+			var removed []crdt.Operation
+			t.Deltas[i].Text, removed = buf.removeOps(d.Start, d.End) // remove
+			ops = append(ops, removed...)
 		}
 	} else if t.EventType == TextEventReplace {
 		for i, d := range t.Deltas {
-			t.Deltas[i].Text = buf.remove(d.Start, d.End)
-			buf.insert(d.Start, []byte(d.Text))
+			var removed []crdt.Operation
+			t.Deltas[i].Text, removed = buf.removeOps(d.Start, d.End)
+			ops = append(ops, removed...)
+			ops = append(ops, buf.insertOps(d.Start, []byte(d.Text))...)
 			t.Deltas[i].Start = d.Start
 			t.Deltas[i].End = Loc{d.Start.X + Count(d.Text), d.Start.Y}
 		}
@@ -56,12 +94,18 @@ func ExecuteTextEvent(t *TextEvent, buf *Buffer) {
 			t.Deltas[i], t.Deltas[j] = t.Deltas[j], t.Deltas[i]
 		}
 	}
+	t.Ops = ops
 }
 
 // UndoTextEvent undoes a text event
+// Events without CRDT operations (e.g. in the log buffer) are undone with their deltas
 func UndoTextEvent(t *TextEvent, buf *Buffer) {
 	t.EventType = -t.EventType
-	ExecuteTextEvent(t, buf)
+	if t.Ops == nil {
+		ExecuteTextEvent(t, buf)
+		return
+	}
+	t.Ops = buf.revertOps(t.Ops)
 }
 
 // EventHandler executes text manipulations and allows undoing and redoing
@@ -102,6 +146,9 @@ func (eh *EventHandler) ApplyDiff(new string) {
 
 // Insert creates an insert text event and executes it
 func (eh *EventHandler) Insert(start Loc, text string) {
+	if eh.buf.claimedByPeer(start, start) {
+		return
+	}
 	e := &TextEvent{
 		C:         *eh.buf.cursors[eh.buf.curCursor],
 		EventType: TextEventInsert,
@@ -132,6 +179,9 @@ func (eh *EventHandler) Insert(start Loc, text string) {
 
 // Remove creates a remove text event and executes it
 func (eh *EventHandler) Remove(start, end Loc) {
+	if eh.buf.claimedByPeer(start, end) {
+		return
+	}
 	e := &TextEvent{
 		C:         *eh.buf.cursors[eh.buf.curCursor],
 		EventType: TextEventRemove,
@@ -160,6 +210,11 @@ func (eh *EventHandler) Remove(start, end Loc) {
 
 // MultipleReplace creates an multiple insertions executes them
 func (eh *EventHandler) MultipleReplace(deltas []Delta) {
+	for _, d := range deltas {
+		if eh.buf.claimedByPeer(d.Start, d.End) {
+			return
+		}
+	}
 	e := &TextEvent{
 		C:         *eh.buf.cursors[eh.buf.curCursor],
 		EventType: TextEventReplace,
@@ -195,6 +250,108 @@ func (eh *EventHandler) Execute(t *TextEvent) {
 	ExecuteTextEvent(t, eh.buf) // important
 }
 
+// forgetOps drops the CRDT operations of the events, so that they are
+// undone with their deltas. This is needed when the document is replaced
+func (eh *EventHandler) forgetOps() {
+	for _, s := range []*Stack{eh.UndoStack, eh.RedoStack} {
+		for e := s.Top; e != nil; e = e.Next {
+			e.Value.Ops = nil
+		}
+	}
+}
+
+// SerializeUndo returns the undo history in the form stored with a shared document
+func (eh *EventHandler) SerializeUndo() *SerializedUndo {
+	return &SerializedUndo{
+		Undo: serializeStack(eh.UndoStack),
+		Redo: serializeStack(eh.RedoStack),
+	}
+}
+
+// serializeStack converts the events of the stack, starting from the bottom.
+// Events without CRDT operations cannot be referred to, so they are left
+// out together with the events below them
+func serializeStack(s *Stack) []SerializedEvent {
+	var events []SerializedEvent
+	for e := s.Top; e != nil && e.Value.Ops != nil; e = e.Next {
+		t := e.Value
+		se := SerializedEvent{
+			C:         t.C,
+			EventType: t.EventType,
+			Time:      t.Time,
+			Ops:       make([]UndoRef, len(t.Ops)),
+		}
+		for i, op := range t.Ops {
+			se.Ops[i] = UndoRef{
+				Clock:  op.Clock,
+				Pos:    op.Pos,
+				OpType: op.OpType,
+			}
+			if op.Clock == 0 {
+				se.Ops[i].Atom = op.Atom
+			}
+		}
+		events = append(events, se)
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
+
+// RestoreUndo replaces the undo history with the one stored with a shared document
+func (eh *EventHandler) RestoreUndo(u *SerializedUndo, s *session.Session) {
+	eh.UndoStack = restoreStack(u.Undo, s)
+	eh.RedoStack = restoreStack(u.Redo, s)
+}
+
+// restoreStack looks up the operations of the events in the ops table. An event
+// referring to an operation that is not logged anymore is dropped, together
+// with the events below it
+func restoreStack(events []SerializedEvent, s *session.Session) *Stack {
+	var clocks []uint64
+	for _, se := range events {
+		for _, ref := range se.Ops {
+			if ref.Clock != 0 {
+				clocks = append(clocks, ref.Clock)
+			}
+		}
+	}
+	logged := s.OperationsByClock(clocks)
+
+	stack := new(Stack)
+	for _, se := range events {
+		t := &TextEvent{
+			C:         se.C,
+			EventType: se.EventType,
+			Time:      se.Time,
+			Ops:       make([]crdt.Operation, 0, len(se.Ops)),
+		}
+
+		valid := true
+		for _, ref := range se.Ops {
+			if ref.Clock == 0 {
+				t.Ops = append(t.Ops, crdt.Operation{Atom: ref.Atom, OpType: ref.OpType, Pos: ref.Pos})
+				continue
+			}
+			op, ok := logged[ref.Clock]
+			if !ok || op.OpType != ref.OpType || !bytes.Equal(op.Pos, ref.Pos) {
+				valid = false
+				break
+			}
+			t.Ops = append(t.Ops, op)
+		}
+
+		if !valid {
+			stack = new(Stack)
+			continue
+		}
+		stack.Push(t)
+	}
+	return stack
+}
+
 // Undo the first event in the undo stack
 func (eh *EventHandler) Undo() {
 	t := eh.UndoStack.Peek()
@@ -204,7 +361,9 @@ func (eh *EventHandler) Undo() {
 
 	startTime := t.Time.UnixNano() / int64(time.Millisecond)
 
-	eh.UndoOneEvent()
+	if !eh.UndoOneEvent() {
+		return
+	}
 
 	for {
 		t = eh.UndoStack.Peek()
@@ -217,18 +376,22 @@ func (eh *EventHandler) Undo() {
 		}
 		startTime = t.Time.UnixNano() / int64(time.Millisecond)
 
-		eh.UndoOneEvent()
+		if !eh.UndoOneEvent() {
+			return
+		}
 	}
 }
 
-// UndoOneEvent undoes one event
-func (eh *EventHandler) UndoOneEvent() {
+// UndoOneEvent undoes one event, and returns whether there was one to undo.
+// An event whose undoing falls into a range a peer claimed stays on the stack
+func (eh *EventHandler) UndoOneEvent() bool {
 	// This event should be undone
-	// Pop it off the stack
-	t := eh.UndoStack.Pop()
-	if t == nil {
-		return
+	t := eh.UndoStack.Peek()
+	if t == nil || eh.buf.revertClaimedByPeer(t.Ops) {
+		return false
 	}
+	// Pop it off the stack
+	eh.UndoStack.Pop()
 
 	// Undo it
 	// Modifies the text event
@@ -245,6 +408,7 @@ func (eh *EventHandler) UndoOneEvent() {
 
 	// Push it to the redo stack
 	eh.RedoStack.Push(t)
+	return true
 }
 
 // Redo the first event in the redo stack
@@ -256,7 +420,9 @@ func (eh *EventHandler) Redo() {
 
 	startTime := t.Time.UnixNano() / int64(time.Millisecond)
 
-	eh.RedoOneEvent()
+	if !eh.RedoOneEvent() {
+		return
+	}
 
 	for {
 		t = eh.RedoStack.Peek()
@@ -268,16 +434,20 @@ func (eh *EventHandler) Redo() {
 			return
 		}
 
-		eh.RedoOneEvent()
+		if !eh.RedoOneEvent() {
+			return
+		}
 	}
 }
 
-// RedoOneEvent redoes one event
-func (eh *EventHandler) RedoOneEvent() {
-	t := eh.RedoStack.Pop()
-	if t == nil {
-		return
+// RedoOneEvent redoes one event, and returns whether there was one to redo.
+// An event whose redoing falls into a range a peer claimed stays on the stack
+func (eh *EventHandler) RedoOneEvent() bool {
+	t := eh.RedoStack.Peek()
+	if t == nil || eh.buf.revertClaimedByPeer(t.Ops) {
+		return false
 	}
+	eh.RedoStack.Pop()
 
 	// Modifies the text event
 	UndoTextEvent(t, eh.buf)
@@ -291,4 +461,5 @@ func (eh *EventHandler) RedoOneEvent() {
 	}
 
 	eh.UndoStack.Push(t)
+	return true
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/zyedidia/micro/cmd/micro/session"
+)
+
+// following is the peer whose viewport the current view mirrors, empty if none
+var following string
+
+// Follow makes the current view mirror the buffer a peer is looking at and
+// its viewport, until the user moves. Without argument, it stops following
+func Follow(args []string) {
+	if len(args) == 0 {
+		if following == "" {
+			messenger.Error("Usage: follow host:port")
+			return
+		}
+		stopFollowing()
+		return
+	}
+
+	if _, _, ok := followedPresence(args[0]); !ok {
+		messenger.Error(args[0] + " is not in any shared buffer")
+		return
+	}
+	following = args[0]
+	followPeer()
+	messenger.Message("Following " + following + ", move to stop")
+}
+
+// stopFollowing leaves the follow mode
+func stopFollowing() {
+	messenger.Message("Stopped following " + following)
+	following = ""
+}
+
+// viewState is where the cursor and the viewport of a view are
+type viewState struct {
+	view    *View
+	cursor  Loc
+	topline int
+	leftCol int
+}
+
+// viewStateOf returns where the cursor and the viewport of the view are
+func viewStateOf(v *View) viewState {
+	return viewState{v, v.Cursor.Loc, v.Topline, v.leftCol}
+}
+
+// movedByUser returns whether the events handled since the current view was
+// in the given state moved its cursor or its viewport, or switched to
+// another view, which stops the follow mode. Opening the command bar or
+// copying, for instance, does not
+func movedByUser(before viewState) bool {
+	return viewStateOf(CurView()) != before
+}
+
+// followedPresence returns the shared buffer the followed peer is looking at
+// and where, or the one it last moved in if it is looking at none of ours
+func followedPresence(peer string) (*Buffer, session.Presence, bool) {
+	var found *Buffer
+	var presence session.Presence
+	for _, t := range tabs {
+		for _, v := range t.Views {
+			s := v.Buf.session
+			if s == nil {
+				continue
+			}
+			p, ok := s.PresenceOf(peer)
+			if !ok {
+				continue
+			}
+			better := p.Active && !presence.Active
+			if p.Active == presence.Active && p.Time.After(presence.Time) {
+				better = true
+			}
+			if found == nil || better {
+				found, presence = v.Buf, p
+			}
+		}
+	}
+	return found, presence, found != nil
+}
+
+// followPeer shows the buffer the followed peer is looking at, scrolled like
+// its view, with the cursor on its line
+func followPeer() {
+	b, p, ok := followedPresence(following)
+	if !ok {
+		messenger.Message(following + " left, stopped following")
+		following = ""
+		return
+	}
+
+	v := followView(b)
+	if v == nil {
+		return
+	}
+
+	line := p.Line
+	if line >= b.NumLines {
+		line = b.NumLines - 1
+	}
+	v.Cursor.ResetSelection()
+	v.Cursor.GotoLoc(Loc{0, line})
+	v.Topline = p.Topline
+	if v.Topline >= b.NumLines {
+		v.Topline = b.NumLines - 1
+	}
+	v.leftCol = p.LeftCol
+}
+
+// followView makes the view showing the buffer the current one, switching
+// tabs if needed. The current tab is preferred
+func followView(b *Buffer) *View {
+	if CurView().Buf == b {
+		return CurView()
+	}
+	order := []int{curTab}
+	for i := range tabs {
+		if i != curTab {
+			order = append(order, i)
+		}
+	}
+	for _, i := range order {
+		for _, v := range tabs[i].Views {
+			if v.Buf == b {
+				curTab = i
+				tabs[i].CurView = v.Num
+				return v
+			}
+		}
+	}
+	return nil
+}
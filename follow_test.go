@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMovedByUser(t *testing.T) {
+	buf := NewBufferFromString("one\ntwo\nthree\n", "")
+	v := &View{Buf: buf, Cursor: &buf.Cursor}
+	other := &View{Buf: buf, Cursor: &buf.Cursor}
+	oldTabs, oldCurTab := tabs, curTab
+	defer func() { tabs, curTab = oldTabs, oldCurTab }()
+	tabs = []*Tab{{Views: []*View{v, other}}}
+	curTab = 0
+
+	before := viewStateOf(v)
+	// copying a selection or opening the command bar leave the view as it is
+	v.Cursor.SetSelectionStart(Loc{0, 0})
+	v.Cursor.SetSelectionEnd(Loc{3, 0})
+	assertTrue(t, !movedByUser(before))
+
+	v.Cursor.Loc = Loc{1, 1}
+	assertTrue(t, movedByUser(before))
+
+	before = viewStateOf(v)
+	v.Topline = 1
+	assertTrue(t, movedByUser(before))
+
+	before = viewStateOf(v)
+	v.leftCol = 2
+	assertTrue(t, movedByUser(before))
+
+	before = viewStateOf(v)
+	tabs[0].CurView = 1
+	assertTrue(t, movedByUser(before))
+}
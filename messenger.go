@@ -85,6 +85,7 @@ func (m *Messenger) getBuffer() *Buffer {
 	if m.log == nil {
 		m.log = NewBufferFromString("", "")
 		m.log.name = "Log" // setting buffer name to "Log"
+		m.log.private = true
 	}
 	return m.log
 }
@@ -15,6 +15,7 @@ import (
 	homedir "github.com/mitchellh/go-homedir"
 	lua "github.com/yuin/gopher-lua"
 	"github.com/zyedidia/clipboard"
+	"github.com/zyedidia/micro/cmd/micro/session"
 	"github.com/zyedidia/micro/cmd/micro/terminfo"
 	"github.com/zyedidia/tcell"
 	"github.com/zyedidia/tcell/encoding"
@@ -25,6 +26,7 @@ const (
 	doubleClickThreshold = 400 // How many milliseconds to wait before a second click is not a double click
 	undoThreshold        = 500 // If two events are less than n milliseconds apart, undo both of them
 	saveSeqVTime         = 30  // Number of seconds to wait before autosaving
+	heartbeatTime        = 10  // Number of seconds between the comparisons of the shared documents
 )
 
 var (
@@ -86,19 +88,15 @@ func LoadInput() []*Buffer {
 	// 3. If there is no input file and the input is a terminal, an empty buffer
 	// should be opened
 
-	// The first argument should be a configuration file
-
 	var filename string
 	var input []byte
 	var err error
 	args := flag.Args() // std lib
 	buffers := make([]*Buffer, 0, len(args))
 
-	if len(args) > 0 { // NOTE: the first two arguments are localIP and remoteIP for testing
-		// first argument args[0] is configuration file
-
+	if len(args) > 0 {
 		// We go through each file and load it. can load multiple files into tabs?
-		for i := 1; i < len(args); i++ { // CHANGED from 0-> 2
+		for i := 0; i < len(args); i++ {
 			if strings.HasPrefix(args[i], "+") {
 				if strings.Contains(args[i], ":") {
 					split := strings.Split(args[i], ":")
@@ -235,6 +233,7 @@ func InitScreen() {
 
 // RedrawAll redraws everything -- all the views and the messenger
 func RedrawAll() {
+	takeDamage()
 	messenger.Clear()
 	// clear the screen first
 	w, h := screen.Size()
@@ -245,7 +244,7 @@ func RedrawAll() {
 	}
 
 	for _, v := range tabs[curTab].Views { // draw all meat in each view
-		v.Display()
+		v.display()
 	}
 	DisplayTabs() // display all tabs if we have multiple
 	messenger.Display()
@@ -288,6 +287,8 @@ var flagVersion = flag.Bool("version", false, "Show the version number and infor
 var flagStartPos = flag.String("startpos", "", "LINE,COL to start the cursor at when opening a buffer.")
 var flagConfigDir = flag.String("config-dir", "", "Specify a custom location for the configuration directory")
 var flagOptions = flag.Bool("options", false, "Show all option help")
+var flagPeers = flag.String("peers", "", "Peer configuration file used to share the first file at startup")
+var flagReplay = flag.String("replay", "", "Replay a trace and report where the documents diverge")
 
 func main() {
 	flag.Usage = func() {
@@ -298,6 +299,12 @@ func main() {
 		fmt.Println("+LINE:COL")
 		fmt.Println("    \tSpecify a line and column to start the cursor at when opening a buffer")
 		fmt.Println("    \tThis can also be done by opening file:LINE:COL")
+		fmt.Println("-peers file")
+		fmt.Println("    \tShare the first file at startup with the peers listed in the file")
+		fmt.Println("    \tThe first line is the local ip:port, a peer followed by S is connected to")
+		fmt.Println("-replay trace.jsonl")
+		fmt.Println("    \tReplay a trace recorded with the trace option, and report the first")
+		fmt.Println("    \tstep where the content of a document differs from the trace")
 		fmt.Println("-options")
 		fmt.Println("    \tShow all option help")
 		fmt.Println("-version")
@@ -335,6 +342,10 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *flagReplay != "" {
+		os.Exit(ReplayTrace(*flagReplay))
+	}
+
 	// Start the Lua VM for running plugins
 	L = lua.NewState()
 	defer L.Close()
@@ -355,13 +366,6 @@ func main() {
 	InitCommands() //command.go
 	InitBindings() //bindings.go
 
-	// TODO: the following two init can also be moved below even under tab initialization
-	// for faster screen loading
-	// init all peers information
-	InitPeersInfo()
-	// init ops storage somewhere here
-	InitStorage()
-
 	// Start the screen
 	InitScreen()
 
@@ -369,8 +373,6 @@ func main() {
 	// mess up the terminal being worked in
 	// In other words we need to shut down tcell before the program crashes
 	defer func() {
-		// saving to storage here as well upon exit
-		SeqVectorToStorage(true) // this code seems not executed, unable to test this
 		if err := recover(); err != nil {
 			screen.Fini()
 			fmt.Println("Micro encountered an error:", err)
@@ -412,10 +414,23 @@ func main() {
 		}
 	}
 
+	// the peers hand work to the main goroutine as soon as they can reach us
+	jobs = make(chan JobFunction, 100)
+
+	// the storage of the shared documents is kept in the config directory
+	localHost = session.NewHost(session.TCP, filepath.Join(configDir, "sessions"))
+	localHost.WatchFiles(func(old, f session.File) {
+		// the messenger belongs to the main goroutine
+		jobs <- JobFunction{func(string, ...string) {
+			fileChanged(old, f)
+		}, "", nil}
+	})
+
 	// can init connections over here to avoid the problem of tab not initialized during synching
-	// note that seqVector storage is initialized during the connection initiazation
-	// init connection
-	InitConnections()
+	// sharing is optional, buffers can also be shared later on with the share command
+	if *flagPeers != "" {
+		InitConnections(buffers[0], *flagPeers)
+	}
 
 	// Load all the plugin stuff
 	// We give plugins access to a bunch of variables here which could be useful to them
@@ -460,6 +475,11 @@ func main() {
 	L.SetGlobal("ByteOffset", luar.New(L, ByteOffset))
 	L.SetGlobal("ToCharPos", luar.New(L, ToCharPos))
 
+	// Collaboration on shared buffers
+	L.SetGlobal("SessionPeers", luar.New(L, SessionPeers))
+	L.SetGlobal("SendPluginMessage", luar.New(L, SendPluginMessage))
+	L.SetGlobal("Author", luar.New(L, Author))
+
 	// Used for asynchronous jobs
 	L.SetGlobal("JobStart", luar.New(L, JobStart))
 	L.SetGlobal("JobSpawn", luar.New(L, JobSpawn))
@@ -476,7 +496,6 @@ func main() {
 	// Access to Go stdlib
 	L.SetGlobal("import", luar.New(L, Import))
 
-	jobs = make(chan JobFunction, 100)
 	events = make(chan tcell.Event, 100)
 	//saveSeqV = make(chan bool)
 	updateterm = make(chan bool)
@@ -508,17 +527,53 @@ func main() {
 	go func() {
 		for {
 			time.Sleep(saveSeqVTime * time.Second)
-			SeqVectorToStorage(true) // update Storage
+			localHost.SaveSessions() // update Storage
 		}
 	}()
 
+	// This goroutine compares the shared documents with the ones of the peers,
+	// and repairs them if they diverged
+	go func() {
+		for {
+			time.Sleep(heartbeatTime * time.Second)
+			localHost.Heartbeat()
+		}
+	}()
+
+	// This goroutine wakes the main loop up so that the session info follows
+	// the connections even when nothing happens
+	go func() {
+		for {
+			time.Sleep(infoRefreshTime)
+			if len(localHost.Sessions()) > 0 {
+				updateterm <- true
+			}
+		}
+	}()
+
+	// This goroutine wakes the main loop up to draw what the peers changed,
+	// at most once per frame
+	go passRedraws()
+
 	// can add a async routine here for listening from the network
 	// use CurView().Buf to access the buffer and insert and delete
 	// TODO:
 
+	damagedOnly := false
 	for { // main infinite loop
-		// Display everything
-		RedrawAll() // this is called after each event is executed
+		// Tell the peers where we are in the shared buffers
+		UpdatePresence()
+		UpdateSessionInfo()
+		UpdateComments()
+		UpdateClaims()
+
+		// Display everything, or what the peers changed if nothing else did
+		if damagedOnly {
+			RedrawDamaged()
+		} else {
+			RedrawAll() // this is called after each event is executed
+		}
+		damagedOnly = false
 
 		var event tcell.Event
 
@@ -529,12 +584,18 @@ func main() {
 			f.function(f.output, f.args...)
 			continue
 		case <-updateterm:
+			publishTerms()
+			continue
+		case <-redraw:
+			damagedOnly = true
 			continue
 		case vnum := <-closeterm:
 			tabs[curTab].Views[vnum].CloseTerminal()
 		case event = <-events: // receive from screen events
 		}
 
+		// following stops once the user moves in the current view
+		before := viewStateOf(CurView())
 		for event != nil {
 			didAction := false
 
@@ -607,5 +668,8 @@ func main() {
 				event = nil // if no events received, set to nil, this will exit the inner for loop
 			}
 		}
+		if following != "" && movedByUser(before) {
+			stopFollowing()
+		}
 	}
 }
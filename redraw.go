@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The operations of the peers are applied from the goroutines serving them,
+// which do not draw: they mark the lines they changed as damaged and ask the
+// main loop to redraw. The requests are merged so that the screen is drawn
+// at most once per frame, and when nothing but the peers changed the
+// buffers since the last redraw, only the damaged lines are drawn again.
+// Since the lines change under the goroutines serving the peers, the views
+// of a shared buffer are drawn with its document locked.
+
+// frameTime is the shortest time between two redraws asked for by the peers
+const frameTime = time.Second / 60
+
+var (
+	// redrawRequests holds a request to redraw not passed on yet
+	redrawRequests = make(chan bool, 1)
+	// redraw wakes the main loop up to draw the damaged lines
+	redraw = make(chan bool)
+
+	// protects the damage of the buffers
+	damageMu sync.Mutex
+)
+
+// lineDamage is the range of lines of a buffer which changed since the last
+// redraw
+type lineDamage struct {
+	start int
+	end   int // not included, -1 when the lines up to the end changed
+	set   bool
+}
+
+// add adds lines from start up to end (not included) to the damage, end is
+// -1 for the lines up to the end of the buffer
+func (d *lineDamage) add(start, end int) {
+	if !d.set {
+		*d = lineDamage{start, end, true}
+		return
+	}
+	if start < d.start {
+		d.start = start
+	}
+	if end == -1 || d.end != -1 && end > d.end {
+		d.end = end
+	}
+}
+
+// has returns whether the line is damaged
+func (d *lineDamage) has(line int) bool {
+	return d.set && line >= d.start && (d.end == -1 || line < d.end)
+}
+
+// damageLines marks lines of the buffer as changed by a peer, from start up
+// to end (not included) or to the end of the buffer if end is -1, and asks
+// for a redraw
+func (b *Buffer) damageLines(start, end int) {
+	damageMu.Lock()
+	b.damage.add(start, end)
+	damageMu.Unlock()
+	requestRedraw()
+}
+
+// requestRedraw asks the main loop to redraw, unless it is asked already
+func requestRedraw() {
+	select {
+	case redrawRequests <- true:
+	default:
+	}
+}
+
+// passRedraws wakes the main loop up for the requests to redraw, waiting a
+// frame after each so that the requests made meanwhile are merged
+func passRedraws() {
+	for range redrawRequests {
+		redraw <- true
+		time.Sleep(frameTime)
+	}
+}
+
+// takeDamage returns the damage of the buffers of the current tab, and
+// forgets the damage of every buffer since it is redrawn
+func takeDamage() map[*Buffer]lineDamage {
+	damageMu.Lock()
+	defer damageMu.Unlock()
+	damage := make(map[*Buffer]lineDamage)
+	for i, t := range tabs {
+		for _, v := range t.Views {
+			if i == curTab && v.Buf.damage.set {
+				damage[v.Buf] = v.Buf.damage
+			}
+		}
+	}
+	for _, t := range tabs {
+		for _, v := range t.Views {
+			v.Buf.damage = lineDamage{}
+		}
+	}
+	return damage
+}
+
+// RedrawDamaged draws again what the peers changed since the last redraw:
+// the damaged lines of the views of shared buffers, the other views whole,
+// and the statuslines
+func RedrawDamaged() {
+	damage := takeDamage()
+	messenger.Clear()
+	for _, v := range tabs[curTab].Views {
+		d, ok := damage[v.Buf]
+		// wrapped lines and the scrollbar move with the lines around them
+		if v.Type.Kind == vtDefault.Kind && !v.Buf.Settings["softwrap"].(bool) && !v.Buf.Settings["scrollbar"].(bool) {
+			if ok {
+				v.cellview.damage = &d
+			} else {
+				v.cellview.damage = &lineDamage{}
+			}
+		} else {
+			v.clear()
+		}
+		v.display()
+		v.cellview.damage = nil
+	}
+	DisplayTabs()
+	messenger.Display()
+	if globalSettings["keymenu"].(bool) {
+		DisplayKeyMenu()
+	}
+	screen.Show()
+}
+
+// display draws the view, with the document of its buffer locked if it is
+// shared
+func (v *View) display() {
+	if v.Buf.session != nil {
+		v.Buf.lockDoc()
+		defer v.Buf.unlockDoc()
+	}
+	v.Display()
+}
+
+// clear clears the area of the view on the screen, without the statusline
+func (v *View) clear() {
+	for y := v.y; y < v.y+v.Height; y++ {
+		v.clearLine(y)
+	}
+}
+
+// clearLine clears a line of the view on the screen
+func (v *View) clearLine(y int) {
+	for x := v.x; x < v.x+v.Width; x++ {
+		screen.SetContent(x, y, ' ', nil, defStyle)
+	}
+}
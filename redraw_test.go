@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLineDamage(t *testing.T) {
+	var d lineDamage
+	if d.has(0) {
+		t.Error("no line is damaged yet")
+	}
+	d.add(4, 5)
+	d.add(2, 3)
+	var tests = []struct {
+		line int
+		want bool
+	}{
+		{1, false},
+		{2, true},
+		{3, true},
+		{4, true},
+		{5, false},
+	}
+	for _, test := range tests {
+		if got := d.has(test.line); got != test.want {
+			t.Errorf("has(%d) = %v after adding 2-3 and 4-5", test.line, got)
+		}
+	}
+
+	// a newline moves every line below
+	d.add(3, -1)
+	if !d.has(1000) || d.has(1) {
+		t.Errorf("unexpected damage %+v", d)
+	}
+	d.add(0, 1)
+	if d.end != -1 || d.start != 0 {
+		t.Errorf("unexpected damage %+v", d)
+	}
+}
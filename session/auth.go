@@ -0,0 +1,119 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/rpc"
+)
+
+// The address a call says it comes from cannot be trusted: anyone reaching
+// our port can put the address of another peer in it. Instead, every
+// connection is authenticated as the peer which dialed it, with a token we
+// handed to that peer over a connection we dialed ourselves, so that only
+// the host listening at its address has it. When a peer connects to us in
+// a session, it first gives us the token we authenticate with to it, we
+// dial it back, authenticate and give it ours, and it then authenticates
+// the connection it called us on. The calls which change anything are only
+// accepted on a connection authenticated as the peer they say they come from.
+
+// args in token(args) and authenticate(args)
+type TokenArgs struct {
+	Clientid string
+	Token    string
+}
+
+// newToken returns a random token
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// issue returns the token the peer authenticates its connections to us with,
+// the same one for as long as we run
+func (h *Host) issue(peer string) string {
+	h.tokensMu.Lock()
+	defer h.tokensMu.Unlock()
+	token, ok := h.issued[peer]
+	if !ok {
+		token = newToken()
+		h.issued[peer] = token
+	}
+	return token
+}
+
+// authenticate authenticates a connection we dialed to the peer, with the
+// token it gave us
+func (h *Host) authenticate(client *rpc.Client, peer string) error {
+	h.tokensMu.Lock()
+	token, ok := h.tokens[peer]
+	h.tokensMu.Unlock()
+	if !ok {
+		return errors.New(peer + " gave us no token")
+	}
+	args := TokenArgs{
+		Clientid: h.addr,
+		Token:    token,
+	}
+	var reply ValReply
+	return callPeer(client, "EntangleClient.Authenticate", args, &reply)
+}
+
+// giveToken gives the peer the token it authenticates its connections to us
+// with, over a connection we dialed
+func (h *Host) giveToken(client *rpc.Client, peer string) error {
+	args := TokenArgs{
+		Clientid: h.addr,
+		Token:    h.issue(peer),
+	}
+	var reply ValReply
+	return callPeer(client, "EntangleClient.Token", args, &reply)
+}
+
+// Token receives the token we authenticate our connections to a peer with.
+// Once the connection is authenticated, only its peer may change its token
+func (ec *EntangleClient) Token(args *TokenArgs, reply *ValReply) error {
+	if peer := ec.caller(); peer != "" && peer != args.Clientid {
+		return errors.New("the connection is authenticated as " + peer)
+	}
+	ec.host.tokensMu.Lock()
+	defer ec.host.tokensMu.Unlock()
+	ec.host.tokens[args.Clientid] = args.Token
+	return nil
+}
+
+// Authenticate authenticates the connection as the peer, if it has the
+// token we gave it
+func (ec *EntangleClient) Authenticate(args *TokenArgs, reply *ValReply) error {
+	ec.host.tokensMu.Lock()
+	token, ok := ec.host.issued[args.Clientid]
+	ec.host.tokensMu.Unlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(args.Token)) != 1 {
+		return errors.New("unable to authenticate " + args.Clientid)
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.peer = args.Clientid
+	return nil
+}
+
+// caller returns the peer the connection is authenticated as, empty if it
+// is not
+func (ec *EntangleClient) caller() string {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.peer
+}
+
+// from returns an error unless the connection is authenticated as the peer
+// the call says it comes from
+func (ec *EntangleClient) from(clientid string) error {
+	if peer := ec.caller(); peer == "" || peer != clientid {
+		return errors.New("the connection is not authenticated as " + clientid)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package session
+
+import (
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChatMessage is a message sent to the peers of a session
+type ChatMessage struct {
+	From string // ip:port of the sender
+	Text string
+	Time time.Time
+}
+
+// Presence tells where a peer is in a shared document
+type Presence struct {
+	Line    int  // line of the cursor, starting from 0
+	Topline int  // first line shown, starting from 0
+	LeftCol int  // first column shown, starting from 0
+	Active  bool // whether the peer is looking at this document
+	Time    time.Time
+}
+
+// String formats the message as displayed in the chat view
+func (m ChatMessage) String() string {
+	return "[" + m.Time.Format("15:04") + "] " + m.From + ": " + m.Text
+}
+
+// ChatHistory returns the stored chat messages, oldest first
+func (s *Session) ChatHistory() []ChatMessage {
+	// the messages queued for the storage writer are part of the history
+	s.flush()
+	return s.store.LoadChat()
+}
+
+// Say sends a chat message to every connected peer, and returns it
+func (s *Session) Say(text string) ChatMessage {
+	m := ChatMessage{
+		From: s.host.addr,
+		Text: text,
+		Time: time.Now(),
+	}
+	s.persist(func() {
+		s.storageError(s.store.AppendChat(m))
+	})
+
+	args := ChatArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Msg:      m,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for peer, client := range s.peers {
+		if client == nil {
+			continue
+		}
+		go func(peer string, client *rpc.Client) {
+			var reply ValReply
+			if err := callPeer(client, "EntangleClient.Chat", args, &reply); err != nil {
+				s.dropClient(peer, client, err)
+			}
+		}(peer, client)
+	}
+	return m
+}
+
+// receiveChat stores a message from a peer and hands it to the consumer
+func (s *Session) receiveChat(m ChatMessage) {
+	s.persist(func() {
+		s.storageError(s.store.AppendChat(m))
+	})
+	if s.cb.Chat != nil {
+		s.cb.Chat(m)
+	}
+}
+
+// UpdatePresence tells the peers where our cursor and viewport are, if they
+// have moved since the last time. The time of p is ignored
+func (s *Session) UpdatePresence(p Presence) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.Time = time.Time{}
+	if p == s.lastSent {
+		return
+	}
+	s.lastSent = p
+
+	args := PresenceArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Presence: p,
+	}
+	for _, client := range s.peers {
+		if client == nil {
+			continue
+		}
+		go func(client *rpc.Client) {
+			var reply ValReply
+			callPeer(client, "EntangleClient.Presence", args, &reply)
+		}(client)
+	}
+}
+
+// setPresence records where a peer is, and tells the consumer
+func (s *Session) setPresence(peer string, p Presence) {
+	p.Time = time.Now()
+	s.mu.Lock()
+	s.presence[peer] = p
+	s.mu.Unlock()
+
+	if s.cb.Presence != nil {
+		s.cb.Presence(peer, p)
+	}
+}
+
+// PresenceOf returns where a connected peer is, if it told us
+func (s *Session) PresenceOf(peer string) (Presence, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.presence[peer]
+	return p, ok
+}
+
+// PresenceString describes who is online and where, our own cursor being on line
+func (s *Session) PresenceString(line int) string {
+	desc := []string{"you: " + s.DocID + ":" + strconv.Itoa(line+1)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var peers []string
+	for peer, client := range s.peers {
+		if client != nil {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Strings(peers)
+
+	for _, peer := range peers {
+		if p, ok := s.presence[peer]; ok {
+			desc = append(desc, peer+": "+s.DocID+":"+strconv.Itoa(p.Line+1))
+		} else {
+			desc = append(desc, peer+": online")
+		}
+	}
+	return strings.Join(desc, ", ")
+}
@@ -0,0 +1,282 @@
+package session
+
+import (
+	"net/rpc"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// A peer can claim a range of the document, or the whole of it, to tell the
+// others not to edit it meanwhile. Claims are advisory: the consumer decides
+// what to do with the edits of the others. Like comments, a range is given
+// by the positions of its first and last atoms so that it follows the text.
+// Releasing a claim replaces it with a newer entry, kept so that an older
+// one cannot bring it back. Peers send their claims to the peers they are
+// connected to, and exchange them when they connect. A peer only takes the
+// claims of a peer from that peer, and only from an editor, and forgets
+// them once the peer is gone, so that a peer which crashed does not keep
+// its ranges.
+
+// Claim is a range of the document a peer asked the others not to edit
+type Claim struct {
+	ID       string // author and time, unique in the session
+	From     string // ip:port of the peer who claimed the range
+	Whole    bool   // the whole document is claimed, Start and End are not set
+	Start    []byte // position of the first atom of the range
+	End      []byte // position of the last atom of the range
+	Released bool
+	Time     time.Time // of the claim, or of its release
+}
+
+// newer returns whether c is a later entry of the claim than o, which is
+// only the case of its release
+func (c Claim) newer(o Claim) bool {
+	return c.Released && !o.Released
+}
+
+// Claims returns the claims which are not released, oldest first
+func (s *Session) Claims() []Claim {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []Claim
+	for _, c := range s.claims {
+		if !c.Released {
+			all = append(all, c)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].Time.Equal(all[j].Time) {
+			return all[i].Time.Before(all[j].Time)
+		}
+		return all[i].ID < all[j].ID
+	})
+	return all
+}
+
+// ownClaims returns every entry of our claims, released ones included
+func (s *Session) ownClaims() []Claim {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var own []Claim
+	for _, c := range s.claims {
+		if c.From == s.host.addr {
+			own = append(own, c)
+		}
+	}
+	return own
+}
+
+// ClaimRange claims the atoms from start up to end (not including end), and
+// sends the claim to the peers
+// Pre: the document is locked
+func (s *Session) ClaimRange(start, end int) Claim {
+	c := s.newClaim()
+	c.Start = crdt.PosBytes(s.doc.Pos(start + 1)) // off by 1
+	c.End = crdt.PosBytes(s.doc.Pos(end))
+	s.publishClaims([]Claim{c})
+	return c
+}
+
+// ClaimAll claims the whole document, and sends the claim to the peers
+func (s *Session) ClaimAll() Claim {
+	c := s.newClaim()
+	c.Whole = true
+	s.publishClaims([]Claim{c})
+	return c
+}
+
+// newClaim returns a claim of ours, with no range yet
+func (s *Session) newClaim() Claim {
+	now := time.Now()
+	return Claim{
+		ID:   s.host.addr + "/" + strconv.FormatInt(now.UnixNano(), 10),
+		From: s.host.addr,
+		Time: now,
+	}
+}
+
+// Release releases the claims of ours, and returns how many there were
+func (s *Session) Release() int {
+	var released []Claim
+	for _, c := range s.Claims() {
+		if c.From == s.host.addr {
+			c.Released = true
+			c.Time = time.Now()
+			released = append(released, c)
+		}
+	}
+	if len(released) > 0 {
+		s.publishClaims(released)
+	}
+	return len(released)
+}
+
+// publishClaims keeps entries of claims of ours and sends them to the peers
+func (s *Session) publishClaims(cs []Claim) {
+	s.mergeClaims(cs)
+
+	args := ClaimsArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Claims:   cs,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for peer, client := range s.peers {
+		if client == nil {
+			continue
+		}
+		go func(peer string, client *rpc.Client) {
+			var reply ClaimsReply
+			if err := callPeer(client, "EntangleClient.Claims", args, &reply); err != nil {
+				s.dropClient(peer, client, err)
+			}
+		}(peer, client)
+	}
+}
+
+// mergeClaims keeps the entries of claims which are newer than ours, and
+// returns them. An entry never replaces the claim of another peer
+func (s *Session) mergeClaims(cs []Claim) []Claim {
+	var changed []Claim
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range cs {
+		if old, ok := s.claims[c.ID]; ok && (old.From != c.From || !c.newer(old)) {
+			continue
+		}
+		s.claims[c.ID] = c
+		changed = append(changed, c)
+	}
+	return changed
+}
+
+// receiveClaims keeps the claims of a peer, or their release, and hands the
+// changed ones to the consumer. The entries of the claims of other peers are
+// dropped, and so are new claims unless the peer is an editor
+func (s *Session) receiveClaims(peer string, cs []Claim) {
+	var own []Claim
+	for _, c := range cs {
+		if c.From == peer && (c.Released || s.CanEdit(peer)) {
+			own = append(own, c)
+		}
+	}
+	for _, c := range s.mergeClaims(own) {
+		if s.cb.Claim != nil {
+			s.cb.Claim(c)
+		}
+	}
+}
+
+// expireClaims forgets the claims of a peer which is gone, and tells the
+// consumer they are released
+func (s *Session) expireClaims(peer string) {
+	var expired []Claim
+	s.mu.Lock()
+	for id, c := range s.claims {
+		if c.From != peer {
+			continue
+		}
+		delete(s.claims, id)
+		if !c.Released {
+			c.Released = true
+			c.Time = time.Now()
+			expired = append(expired, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range expired {
+		if s.cb.Claim != nil {
+			s.cb.Claim(c)
+		}
+	}
+}
+
+// exchangeClaims sends the peer our claims and keeps the ones it returns,
+// so that the claims made or released while disconnected are not lost
+func (s *Session) exchangeClaims(peer string, client *rpc.Client) {
+	args := ClaimsArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Claims:   s.ownClaims(),
+	}
+	var reply ClaimsReply
+	if err := callPeer(client, "EntangleClient.Claims", args, &reply); err != nil {
+		s.failed(peer, err)
+		return
+	}
+	s.receiveClaims(peer, reply.Claims)
+}
+
+// ClaimSpan returns the atoms the claim is about, from start up to end (not
+// including end). ok is false once all of them are gone
+// Pre: the document is locked
+func (s *Session) ClaimSpan(c Claim) (start, end int, ok bool) {
+	if c.Whole {
+		return 0, s.doc.Len(), true
+	}
+	i, _ := s.doc.Index(crdt.NewPos(c.Start))
+	j, exists := s.doc.Index(crdt.NewPos(c.End))
+	if exists {
+		j++
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > s.doc.Len()+1 {
+		j = s.doc.Len() + 1
+	}
+	return i - 1, j - 1, j > i // off by 1
+}
+
+// ClaimedByPeer returns the claim of another peer an edit of the atoms from
+// start up to end (not including end) falls into. An insertion, where start
+// is end, falls into a claim if it is before one of its atoms, so that text
+// can still be added right after it
+// Pre: the document is locked
+func (s *Session) ClaimedByPeer(start, end int) (Claim, bool) {
+	for _, c := range s.Claims() {
+		if c.From == s.host.addr {
+			continue
+		}
+		if c.Whole {
+			return c, true
+		}
+		cs, ce, ok := s.ClaimSpan(c)
+		if !ok {
+			continue
+		}
+		if start == end && start >= cs && start < ce || start < ce && end > cs {
+			return c, true
+		}
+	}
+	return Claim{}, false
+}
+
+// RevertClaimedByPeer returns the claim of another peer reverting operations
+// of ours falls into: the atoms they inserted which are still there are
+// deleted, and the atoms they deleted are inserted again where they were
+// Pre: the document is locked
+func (s *Session) RevertClaimedByPeer(ops []crdt.Operation) (Claim, bool) {
+	for _, op := range ops {
+		for _, r := range op.Runes() {
+			i, exists := s.doc.Index(crdt.NewPos(r.Pos))
+			if r.OpType != exists {
+				// nothing to revert
+				continue
+			}
+			start, end := i-1, i-1 // off by 1
+			if r.OpType {
+				end = i
+			}
+			if c, ok := s.ClaimedByPeer(start, end); ok {
+				return c, true
+			}
+		}
+	}
+	return Claim{}, false
+}
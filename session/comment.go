@@ -0,0 +1,176 @@
+package session
+
+import (
+	"net/rpc"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// Comment is a review comment on a range of the document. The range is given
+// by the positions of its first and last atoms, so that it follows the text
+// wherever it moves
+type Comment struct {
+	ID      string // author and time, unique in the session
+	ReplyTo string // ID of the first comment of the thread, empty if this is the first
+	From    string // ip:port of the author
+	Start   []byte // position of the first atom of the range
+	End     []byte // position of the last atom of the range
+	Text    string
+	Time    time.Time
+}
+
+// String formats the comment as displayed in the comments view
+func (c Comment) String() string {
+	return "[" + c.Time.Format("15:04") + "] " + c.From + ": " + c.Text
+}
+
+// loadComments reads the stored comments in memory
+func (s *Session) loadComments() {
+	for _, c := range s.store.LoadComments() {
+		s.comments[c.ID] = c
+	}
+}
+
+// Comments returns the comments of the document, oldest first
+func (s *Session) Comments() []Comment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]Comment, 0, len(s.comments))
+	for _, c := range s.comments {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].Time.Equal(all[j].Time) {
+			return all[i].Time.Before(all[j].Time)
+		}
+		return all[i].ID < all[j].ID
+	})
+	return all
+}
+
+// AddComment comments the atoms from start up to end (not including end),
+// stores the comment and sends it to the peers
+// Pre: the document is locked
+func (s *Session) AddComment(start, end int, text string) Comment {
+	c := s.newComment(text)
+	c.Start = crdt.PosBytes(s.doc.Pos(start + 1)) // off by 1
+	c.End = crdt.PosBytes(s.doc.Pos(end))
+	s.publishComment(c)
+	return c
+}
+
+// Reply answers the thread of the given comment, on the same range
+func (s *Session) Reply(to Comment, text string) Comment {
+	c := s.newComment(text)
+	c.ReplyTo = to.ID
+	if to.ReplyTo != "" {
+		c.ReplyTo = to.ReplyTo
+	}
+	c.Start, c.End = to.Start, to.End
+	s.publishComment(c)
+	return c
+}
+
+// newComment returns a comment of ours, with no range yet
+func (s *Session) newComment(text string) Comment {
+	now := time.Now()
+	return Comment{
+		ID:   s.host.addr + "/" + strconv.FormatInt(now.UnixNano(), 10),
+		From: s.host.addr,
+		Text: text,
+		Time: now,
+	}
+}
+
+// publishComment stores a comment of ours and sends it to the peers
+func (s *Session) publishComment(c Comment) {
+	s.addComments([]Comment{c})
+
+	args := CommentArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Comment:  c,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for peer, client := range s.peers {
+		if client == nil {
+			continue
+		}
+		go func(peer string, client *rpc.Client) {
+			var reply ValReply
+			if err := callPeer(client, "EntangleClient.Comment", args, &reply); err != nil {
+				s.dropClient(peer, client, err)
+			}
+		}(peer, client)
+	}
+}
+
+// addComments stores the comments we do not have yet, and returns them
+func (s *Session) addComments(cs []Comment) []Comment {
+	var added []Comment
+	s.mu.Lock()
+	for _, c := range cs {
+		if _, ok := s.comments[c.ID]; !ok {
+			s.comments[c.ID] = c
+			added = append(added, c)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(added) > 0 {
+		s.persist(func() {
+			for _, c := range added {
+				s.storageError(s.store.AppendComment(c))
+			}
+		})
+	}
+	return added
+}
+
+// receiveComments stores comments from a peer and hands the new ones to the consumer
+func (s *Session) receiveComments(cs []Comment) {
+	for _, c := range s.addComments(cs) {
+		if s.cb.Comment != nil {
+			s.cb.Comment(c)
+		}
+	}
+}
+
+// exchangeComments sends the peer our comments and gets the ones we miss,
+// so that comments made while disconnected are not lost
+func (s *Session) exchangeComments(peer string, client *rpc.Client) {
+	args := CommentsArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Comments: s.Comments(),
+	}
+	var reply CommentsReply
+	if err := callPeer(client, "EntangleClient.ExchangeComments", args, &reply); err != nil {
+		s.failed(peer, err)
+		return
+	}
+	s.receiveComments(reply.Comments)
+}
+
+// CommentSpan returns the atoms the comment is about, from start up to end
+// (not including end). The range shrinks as its text is deleted, ok is false
+// once all of it is gone
+// Pre: the document is locked
+func (s *Session) CommentSpan(c Comment) (start, end int, ok bool) {
+	i, _ := s.doc.Index(crdt.NewPos(c.Start))
+	j, exists := s.doc.Index(crdt.NewPos(c.End))
+	if exists {
+		j++
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > s.doc.Len()+1 {
+		j = s.doc.Len() + 1
+	}
+	return i - 1, j - 1, j > i // off by 1
+}
@@ -0,0 +1,942 @@
+package session
+
+// This is the connection code with other peers for now.
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// args in apply(args)
+type ApplyArgs struct {
+	DocID    string           // shared document the operations belong to
+	Clientid string           // ip:port
+	Ops      []crdt.Operation // operations, in increasing clock values
+}
+
+// ApplyReply acknowledges a patch with the sequence vector the receiver
+// has stored, once the patch is stored
+type ApplyReply struct {
+	Clocks map[string]uint64
+}
+
+// args in connect(args)
+type ConnectArgs struct { // later need to have more fields
+	DocID    string // shared document to connect to
+	Clientid string // client id who asks to connection
+}
+
+// ConnectReply lists the other peers of the document so that the requester
+// can connect to them as well, together with the roles in the session
+type ConnectReply struct {
+	Peers    []string
+	Owner    string          // peer who shared the document
+	Roles    map[string]Role // roles of the peers, including the requester
+	JoinRole Role            // role given to peers joining the session
+}
+
+// SyncArgs
+type SyncArgs struct {
+	DocID         string
+	Clientid      string // requester
+	SenderClock   uint64 // sender clock
+	ReceiverClock uint64 // sender view of receiver clock
+	StoredClock   uint64 // receiver clock the sender has stored
+	// sites of the peers the sender knows of, see Session.Author
+	Sites map[uint8]string
+}
+
+// SyncReply
+type SyncReply struct {
+	RequesterClock uint64 // receiver's view of requester's clock
+	StoredClock    uint64 // requester clock the receiver has stored
+	Digest         Digest // of the receiver's document
+	// sites of the peers the receiver knows of
+	Sites map[uint8]string
+}
+
+// args in digest(args), sent as a heartbeat
+type DigestArgs struct {
+	DocID    string
+	Clientid string
+}
+
+// Digest is the sequence vector of a document together with its hash, taken
+// at the same time. Peers with the same sequence vector must have the same hash
+type Digest struct {
+	Clocks map[string]uint64
+	Hash   uint64
+}
+
+// args in ranges(args) and atoms(args)
+type RangesArgs struct {
+	DocID    string
+	Clientid string
+	// the ranges go from one bound to the next, the first and last bounds
+	// may be empty for the beginning and the end of the document
+	Bounds [][]byte
+}
+
+// RangesReply holds the hashes of the ranges and how many atoms they hold
+type RangesReply struct {
+	Clocks map[string]uint64
+	Hashes []uint64
+	Counts []int
+}
+
+// AtomsReply holds the atoms of a range as insert operations
+type AtomsReply struct {
+	Clocks map[string]uint64
+	Patch  []crdt.Operation
+}
+
+// args in deleted(args)
+type DeletedArgs struct {
+	DocID    string
+	Clientid string
+	Pos      [][]byte
+}
+
+// DeletedReply holds the positions the receiver deleted
+type DeletedReply struct {
+	Pos [][]byte
+}
+
+// args in disconnect(args)
+type DisconnectArgs struct {
+	DocID    string
+	Clientid string // client id who voluntarilly quit the editor
+}
+
+// args in setRole(args)
+type SetRoleArgs struct {
+	DocID    string
+	Clientid string // the owner of the document
+	Peer     string // peer whose role changes
+	Role     Role
+}
+
+// args in chat(args)
+type ChatArgs struct {
+	DocID    string
+	Clientid string
+	Msg      ChatMessage
+}
+
+// args in comment(args)
+type CommentArgs struct {
+	DocID    string
+	Clientid string
+	Comment  Comment
+}
+
+// args in exchangeComments(args)
+type CommentsArgs struct {
+	DocID    string
+	Clientid string
+	Comments []Comment // every comment of the sender
+}
+
+// CommentsReply holds the comments the sender of CommentsArgs did not have
+type CommentsReply struct {
+	Comments []Comment
+}
+
+// args in setSetting(args) and exchangeSettings(args)
+type SettingsArgs struct {
+	DocID    string
+	Clientid string
+	Settings []Setting // changed settings, or all of them
+}
+
+// SettingsReply holds the settings of the receiver
+type SettingsReply struct {
+	Settings []Setting
+}
+
+// args in publishClaims(args) and exchangeClaims(args)
+type ClaimsArgs struct {
+	DocID    string
+	Clientid string
+	Claims   []Claim // changed claims, or all of them
+}
+
+// ClaimsReply holds the claims of the receiver
+type ClaimsReply struct {
+	Claims []Claim
+}
+
+// args in files(args) and exchangeFiles(args)
+type FilesArgs struct {
+	Clientid string
+	Files    []File // changed entries of the workspace, or all of them
+}
+
+// FilesReply holds the entries of the workspace of the receiver
+type FilesReply struct {
+	Files []File
+}
+
+// args in presence(args)
+type PresenceArgs struct {
+	DocID    string
+	Clientid string
+	Presence Presence // cursor and viewport of the sender
+}
+
+// args in pluginMessage(args)
+type PluginMessageArgs struct {
+	DocID    string
+	Clientid string
+	Msg      PluginMessage
+}
+
+// args in watchTerm(args), unwatchTerm(args), terms(args) and termInput(args)
+type TermArgs struct {
+	Clientid string
+	Term     string // name of the terminal
+	Data     string // what the sender typed, for termInput
+}
+
+// TermsReply lists the terminals a peer shares
+type TermsReply struct {
+	Terms []string
+}
+
+// args in snapshot(args)
+type SnapshotArgs struct {
+	DocID    string
+	Clientid string
+}
+
+// SnapshotReply holds the whole document as insert operations, together
+// with the sequence vector it corresponds to
+type SnapshotReply struct {
+	Patch  []crdt.Operation
+	Clocks map[string]uint64
+}
+
+// SequenceReply holds the kind of sequence a document is shared as, and the
+// site given to the peer joining
+type SequenceReply struct {
+	Kind  string
+	Site  uint8
+	Sites map[uint8]string // the sites known, the one given included
+}
+
+// ListDocsReply holds the IDs of the documents shared by a peer
+type ListDocsReply struct {
+	DocIDs []string
+}
+
+// Reply from service for all the API calls above.
+// This is useful for ensuring delivery success
+type ValReply struct {
+	Val string // value; depends on the call
+}
+
+// EntangleClient is the RPC service a host offers to its peers, over one
+// connection
+type EntangleClient struct {
+	host *Host
+
+	// the peer the connection is authenticated as, empty until it is
+	peer string
+	// protects peer
+	mu sync.Mutex
+}
+
+// rpcTimeout bounds every call made to a peer
+const rpcTimeout = 5 * time.Second
+
+// a patch of operations from a peer
+func (ec *EntangleClient) Apply(args *ApplyArgs, reply *ApplyReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	// set clock for the peer as well, don't need to increment
+	if err := s.applyPatch(args.Clientid, args.Ops); err != nil {
+		return err
+	}
+
+	// acknowledge what is stored once the patch is
+	s.saveSeqVector()
+	s.flush()
+	reply.Clocks = s.storedClocks()
+	return nil
+}
+
+// Received connection request from a peer
+func (ec *EntangleClient) Connect(args *ConnectArgs, reply *ConnectReply) error {
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	client, err := ec.host.dial(args.Clientid)
+	// the above may fail as well
+	if err != nil {
+		return errors.New("unable to connect to the requester")
+	}
+	// the requester gave us the token to authenticate with, and gets the
+	// one it authenticates with to us, see auth.go
+	if err := ec.host.authenticate(client, args.Clientid); err != nil {
+		client.Close()
+		return err
+	}
+	if err := ec.host.giveToken(client, args.Clientid); err != nil {
+		client.Close()
+		return err
+	}
+
+	reply.Peers = s.connectedPeers()
+	s.addPeer(args.Clientid, client)
+	s.assignRole(args.Clientid)
+	reply.Owner = s.owner
+	reply.Roles = s.rolesCopy()
+	reply.JoinRole = s.joinRole
+
+	// now, connected redraw the status line
+	s.changed()
+
+	// should not initiating pair-wise sync protocol here (this is receiver), just return
+	return nil
+}
+
+// received Sync from a peer
+func (ec *EntangleClient) Sync(args *SyncArgs, reply *SyncReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+	s.traceSync(args.Clientid, *args)
+
+	// Requestee and Sender are synonyms, receiver is *this* client.
+	// extract the current view of the requestee's clock.
+	// This extracts from runtime DS
+	requesterClock := s.clock(args.Clientid)
+
+	// if requesterClock < SenderClock, the requester will send the
+	// operations we miss, starting from requesterClock
+	if requesterClock > args.SenderClock {
+		// if requesterClock > SenderClock, this case is unusual but may happen
+		// for example, the storage on the sender side has corrupted and hence reset.
+		// for now in this case, just return an error
+		return errors.New("requesterClock > SenderClock")
+	}
+	reply.RequesterClock = requesterClock
+	reply.Digest = s.digest()
+	if err := s.checkSites(args.Sites); err != nil {
+		return err
+	}
+	s.learnSites(args.Sites)
+	reply.Sites = s.knownSites()
+	// what we have of the requester is stored before telling it so
+	s.saveSeqVector()
+	s.flush()
+	reply.StoredClock = s.storedClock(args.Clientid)
+	// acknowledgements may have been lost with the connection
+	s.ack(args.Clientid, args.StoredClock)
+
+	localClock := s.clock(s.host.addr)
+	if localClock < args.ReceiverClock {
+		// if localClock < ReceiverClock, this case is unusual but could happen
+		// for instance, the local storage has corrupted and hence reset.
+		// for now in this case, just return an error
+		return errors.New("localClock < ReceiverClock")
+	}
+
+	// send the requester the operations it misses, read from the ops log,
+	// and then the new ones
+	s.startOutbox(args.Clientid, args.ReceiverClock)
+	// and the requester sends us the ones we miss
+	s.awaitSync(args.Clientid, args.SenderClock)
+	return nil
+}
+
+// DISCONNECT from a peer.
+func (ec *EntangleClient) Disconnect(args *DisconnectArgs, reply *ValReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return nil
+	}
+
+	s.removePeer(args.Clientid)
+	s.changed()
+	return nil
+}
+
+// SetRole changes the role of a peer. Only the owner can do this
+func (ec *EntangleClient) SetRole(args *SetRoleArgs, reply *ValReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+	if args.Clientid != s.owner {
+		return errors.New("only the owner can change roles")
+	}
+
+	s.setRole(args.Peer, args.Role)
+	s.changed()
+	return nil
+}
+
+// Chat receives a chat message from a peer
+func (ec *EntangleClient) Chat(args *ChatArgs, reply *ValReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	if args.Msg.From != args.Clientid {
+		return errors.New("message from " + args.Msg.From + " sent by " + args.Clientid)
+	}
+	s.receiveChat(args.Msg)
+	return nil
+}
+
+// PluginMessage receives a message from a plugin of a peer
+func (ec *EntangleClient) PluginMessage(args *PluginMessageArgs, reply *ValReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	if args.Msg.From != args.Clientid {
+		return errors.New("message from " + args.Msg.From + " sent by " + args.Clientid)
+	}
+	if s.cb.PluginMessage != nil {
+		s.cb.PluginMessage(args.Msg)
+	}
+	return nil
+}
+
+// Comment receives a comment from a peer
+func (ec *EntangleClient) Comment(args *CommentArgs, reply *ValReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	if args.Comment.From != args.Clientid {
+		return errors.New("comment of " + args.Comment.From + " sent by " + args.Clientid)
+	}
+	s.receiveComments([]Comment{args.Comment})
+	return nil
+}
+
+// ExchangeComments receives the comments of a peer connecting to us, and
+// returns the ones it does not have
+func (ec *EntangleClient) ExchangeComments(args *CommentsArgs, reply *CommentsReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	known := make(map[string]bool, len(args.Comments))
+	for _, c := range args.Comments {
+		known[c.ID] = true
+	}
+	for _, c := range s.Comments() {
+		if !known[c.ID] {
+			reply.Comments = append(reply.Comments, c)
+		}
+	}
+	s.receiveComments(args.Comments)
+	return nil
+}
+
+// Settings receives changes of the settings of a document from a peer, and
+// returns ours
+func (ec *EntangleClient) Settings(args *SettingsArgs, reply *SettingsReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	reply.Settings = s.Settings()
+	s.receiveSettings(args.Clientid, args.Settings)
+	return nil
+}
+
+// Claims receives claims of a peer, or their release, and returns ours
+func (ec *EntangleClient) Claims(args *ClaimsArgs, reply *ClaimsReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	reply.Claims = s.ownClaims()
+	s.receiveClaims(args.Clientid, args.Claims)
+	return nil
+}
+
+// Files receives changes of the workspace from a peer, which must be an
+// editor in a session we share with it
+func (ec *EntangleClient) Files(args *FilesArgs, reply *FilesReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	if !ec.host.isEditor(args.Clientid) {
+		return errors.New(args.Clientid + " cannot change the workspace")
+	}
+	return ec.host.mergeFiles(args.Files)
+}
+
+// ExchangeFiles receives the workspace of a peer connected in a session, and
+// returns ours. Only the workspace of an editor is merged
+func (ec *EntangleClient) ExchangeFiles(args *FilesArgs, reply *FilesReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	if ec.host.clients()[args.Clientid] == nil {
+		return errors.New(args.Clientid + " is not connected in any session")
+	}
+	reply.Files = ec.host.allFiles()
+	if ec.host.isEditor(args.Clientid) {
+		return ec.host.mergeFiles(args.Files)
+	}
+	return nil
+}
+
+// WatchTerm adds a peer to the watchers of a terminal of ours. Only the
+// peers connected in a session may watch
+func (ec *EntangleClient) WatchTerm(args *TermArgs, reply *ValReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	t := ec.host.sharedTerm(args.Term)
+	if t == nil {
+		return errors.New("terminal not shared: " + args.Term)
+	}
+	client := ec.host.clients()[args.Clientid]
+	if client == nil {
+		return errors.New(args.Clientid + " is not connected in any session")
+	}
+	return t.watch(args.Clientid, client)
+}
+
+// UnwatchTerm removes a peer from the watchers of a terminal of ours
+func (ec *EntangleClient) UnwatchTerm(args *TermArgs, reply *ValReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	if t := ec.host.sharedTerm(args.Term); t != nil {
+		t.unwatch(args.Clientid, nil)
+	}
+	return nil
+}
+
+// Terms lists the terminals of ours the peers can watch
+func (ec *EntangleClient) Terms(args *TermArgs, reply *TermsReply) error {
+	reply.Terms = ec.host.SharedTerms()
+	return nil
+}
+
+// TermInput receives what a peer typed in a terminal of ours. Input rights
+// are those of the peer the connection is authenticated as
+func (ec *EntangleClient) TermInput(args *TermArgs, reply *ValReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	t := ec.host.sharedTerm(args.Term)
+	if t == nil {
+		return errors.New("terminal not shared: " + args.Term)
+	}
+	return t.typed(ec.caller(), args.Data)
+}
+
+// TermFrame receives a frame of a terminal we watch
+func (ec *EntangleClient) TermFrame(args *TermFrame, reply *ValReply) error {
+	if err := ec.from(args.From); err != nil {
+		return err
+	}
+	ec.host.receiveFrame(*args)
+	return nil
+}
+
+// Presence receives the position of a peer in the document
+func (ec *EntangleClient) Presence(args *PresenceArgs, reply *ValReply) error {
+	if err := ec.from(args.Clientid); err != nil {
+		return err
+	}
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	s.setPresence(args.Clientid, args.Presence)
+	s.changed()
+	return nil
+}
+
+// Sequence tells a peer joining the session which kind of sequence the
+// document is, see crdt.SequenceKinds, and gives it its site
+func (ec *EntangleClient) Sequence(args *SnapshotArgs, reply *SequenceReply) error {
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+	site, err := s.assignSite(args.Clientid)
+	if err != nil {
+		return err
+	}
+	reply.Kind = s.doc.Kind()
+	reply.Site = site
+	reply.Sites = s.knownSites()
+	return nil
+}
+
+// Snapshot sends the whole document to a peer joining the session
+func (ec *EntangleClient) Snapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	s.docMu.Lock()
+	// the deleted atoms kept by the sequence go as insertions of empty atoms
+	reply.Patch = crdt.Operations(s.doc.Atoms(), true)
+	// the sequence vector must be read under the same lock, so that it
+	// exactly matches the content of the document
+	reply.Clocks = s.clocks()
+	s.docMu.Unlock()
+
+	return nil
+}
+
+// Digest returns the sequence vector and the hash of the document
+func (ec *EntangleClient) Digest(args *DigestArgs, reply *Digest) error {
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	*reply = s.digest()
+	return nil
+}
+
+// Ranges returns the hashes of ranges of the document
+func (ec *EntangleClient) Ranges(args *RangesArgs, reply *RangesReply) error {
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	s.docMu.Lock()
+	defer s.docMu.Unlock()
+	reply.Clocks = s.clocks()
+	for i := 0; i+1 < len(args.Bounds); i++ {
+		h, n := s.doc.RangeHash(boundPos(args.Bounds[i]), boundPos(args.Bounds[i+1]))
+		if n < 0 {
+			return errors.New("unknown bound in " + args.DocID)
+		}
+		reply.Hashes = append(reply.Hashes, h)
+		reply.Counts = append(reply.Counts, n)
+	}
+	return nil
+}
+
+// Atoms returns the atoms of a range of the document
+func (ec *EntangleClient) Atoms(args *RangesArgs, reply *AtomsReply) error {
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+	if len(args.Bounds) != 2 {
+		return errors.New("expected a single range")
+	}
+
+	s.docMu.Lock()
+	defer s.docMu.Unlock()
+	reply.Clocks = s.clocks()
+	pairs := s.doc.Range(boundPos(args.Bounds[0]), boundPos(args.Bounds[1]))
+	reply.Patch = crdt.Operations(pairs, true)
+	return nil
+}
+
+// Deleted returns which of the given positions were deleted
+func (ec *EntangleClient) Deleted(args *DeletedArgs, reply *DeletedReply) error {
+	s := ec.host.GetSession(args.DocID)
+	if s == nil {
+		return errors.New("document not shared: " + args.DocID)
+	}
+
+	s.docMu.Lock()
+	defer s.docMu.Unlock()
+	for _, b := range args.Pos {
+		if s.deleted[string(crdt.PosBytes(crdt.NewPos(b)))] {
+			reply.Pos = append(reply.Pos, b)
+		}
+	}
+	return nil
+}
+
+// ListDocs returns the documents shared by this peer
+func (ec *EntangleClient) ListDocs(args *ValReply, reply *ListDocsReply) error {
+	reply.DocIDs = ec.host.SharedDocIDs()
+	return nil
+}
+
+// callPeer calls a method of a peer, giving up after rpcTimeout
+func callPeer(client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select { // select blocks until one of the following cases is able to run
+	case <-call.Done:
+		return call.Error
+	case <-time.After(rpcTimeout): // receive from time.After channel
+		return errors.New("call to " + method + " timed out")
+	}
+}
+
+// Connect dials the peer, sends it a connection request, so that the remote
+// peer dials back, and then runs the pair-wise synchronization protocol.
+// The peers of the peer are connected to as well
+func (s *Session) Connect(addr string) (err error) {
+	client, err := s.host.dial(addr)
+	if err != nil {
+		s.failed(addr, err)
+		return err
+	}
+
+	// the peer authenticates the connection it dials back to us with our
+	// token, and gives us its own for this connection, see auth.go
+	if err = s.host.giveToken(client, addr); err != nil {
+		s.failed(addr, err)
+		client.Close()
+		return err
+	}
+	args := ConnectArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+	}
+	var reply ConnectReply
+	if err = callPeer(client, "EntangleClient.Connect", args, &reply); err != nil {
+		s.failed(addr, err)
+		client.Close()
+		return err
+	}
+	if err = s.host.authenticate(client, addr); err != nil {
+		s.failed(addr, err)
+		client.Close()
+		return err
+	}
+	s.addPeer(addr, client)
+
+	if s.owner == "" { // we are joining
+		s.owner = reply.Owner
+		s.joinRole = reply.JoinRole
+	}
+	if addr == s.owner {
+		// the roles known by the owner are authoritative
+		for peer, r := range reply.Roles {
+			s.setRole(peer, r)
+		}
+	} else {
+		s.mergeRoles(reply.Roles)
+	}
+	s.changed()
+
+	// let's follow the original protocol
+	// initiating pair-wise sync protocol here
+	s.pairWiseSync(addr, client)
+	s.exchangeComments(addr, client)
+	s.exchangeSettings(addr, client)
+	s.exchangeClaims(addr, client)
+	if err := s.host.exchangeFiles(client); err != nil {
+		s.failed(addr, err)
+	}
+
+	// the peers of the peer become our peers too
+	for _, peer := range reply.Peers {
+		if peer == s.host.addr || s.isConnected(peer) {
+			continue
+		}
+		// a peer we cannot reach is reported by NetStats, see failed
+		s.Connect(peer)
+	}
+	return nil
+}
+
+// The pair-wise synchronization protocol here. The peers exchange their
+// views of each other's clocks, then each one sends the operations the
+// other misses from its ops log
+func (s *Session) pairWiseSync(peer string, client *rpc.Client) {
+	// what we have of the peer is stored before telling it so
+	s.saveSeqVector()
+	s.flush()
+
+	// requester sending <local clock, peer clock>
+	args := SyncArgs{
+		DocID:         s.DocID,
+		Clientid:      s.host.addr,
+		SenderClock:   s.clock(s.host.addr),
+		ReceiverClock: s.clock(peer),
+		StoredClock:   s.storedClock(peer),
+		Sites:         s.knownSites(),
+	}
+	s.traceSync(peer, args)
+	var reply SyncReply
+	if err := callPeer(client, "EntangleClient.Sync", args, &reply); err != nil {
+		s.failed(peer, err)
+		return
+	}
+
+	s.ack(peer, reply.StoredClock)
+	if err := s.checkSites(reply.Sites); err != nil {
+		s.failed(peer, err)
+		return
+	}
+	s.learnSites(reply.Sites)
+	// using RequesterClock to determine the operations to be sent over
+	s.startOutbox(peer, reply.RequesterClock)
+	s.awaitSync(peer, reply.Digest.Clocks[peer])
+
+	// nothing is missing on either side, the documents must be the same
+	s.checkDigest(peer, client, reply.Digest)
+}
+
+// Insert a patch to the local document and storage. Insertions which are
+// not ready yet, see Sequence.Ready, are deferred until they are
+// Pre: the document is locked
+func (s *Session) insertPatch(patch []crdt.Operation) {
+	s.insertOps(patch)
+	for n := -1; len(s.deferred) > 0 && len(s.deferred) != n; {
+		// the patch may have brought in what deferred insertions wait for
+		n = len(s.deferred)
+		patch, s.deferred = s.deferred, nil
+		s.insertOps(patch)
+	}
+}
+
+// insertOps applies the operations of a patch to the local document and storage
+// Pre: the document is locked
+func (s *Session) insertOps(patch []crdt.Operation) {
+	for _, op := range patch {
+		if op.OpType == true { // insert operation
+			s.insertRun(op)
+		} else { // delete operation
+			s.deleteRun(op)
+		}
+	}
+}
+
+// insertRun inserts the runes of an insertion, but the ones we have and the
+// ones deleted already. Runes which go to the same place are inserted together
+// Pre: the document is locked
+func (s *Session) insertRun(op crdt.Operation) {
+	pos, runes := crdt.NewPos(op.Pos), []rune(op.Atom)
+	for k := 0; k < len(runes); {
+		p := crdt.RunPos(pos, k)
+		if !s.doc.Ready(p) {
+			// the rest waits for the atoms its position refers to
+			op.Atom, op.Pos = string(runes[k:]), crdt.PosBytes(p)
+			s.deferred = append(s.deferred, op)
+			return
+		}
+		// the CRDTIndex is the index for the atom to be inserted in the document
+		CRDTIndex, exists := s.doc.Index(p)
+		if exists == true { // if exists, don't insert
+			k++
+			continue
+		}
+		if key := string(crdt.PosBytes(p)); s.early[key] { // deleted already, see below
+			delete(s.early, key)
+			if s.doc.KeepsDeleted() {
+				// other atoms may go after it, keep it deleted
+				s.doc.InsertPos(p, "", 0)
+			}
+			k++
+			continue
+		}
+
+		n := 1
+		for ; k+n < len(runes); n++ {
+			q := crdt.RunPos(pos, k+n)
+			if i, exists := s.doc.Index(q); exists || i != CRDTIndex || s.early[string(crdt.PosBytes(q))] {
+				break
+			}
+		}
+		text := string(runes[k : k+n])
+		k += n
+		// now insert to document, the document stores it
+		if !s.doc.InsertPos(p, text, 0) {
+			continue
+		}
+		// then let the consumer insert to its own copy, e.g. the lineArray
+		if s.cb.RemoteInsert != nil {
+			s.cb.RemoteInsert(CRDTIndex-1, text) // off by 1
+		}
+	}
+}
+
+// deleteRun deletes the runes of a deletion. Runes which are next to each
+// other are deleted together
+// Pre: the document is locked
+func (s *Session) deleteRun(op crdt.Operation) {
+	pos, runes := crdt.NewPos(op.Pos), []rune(op.Atom)
+	for k := 0; k < len(runes); {
+		p := crdt.RunPos(pos, k)
+		// the CRDTIndex is the index for the atom to be deleted in the document
+		CRDTIndex, exists := s.doc.Index(p)
+		s.deleted[string(crdt.PosBytes(p))] = true
+		if exists == false { // don't delete something not exited
+			// the deletion may come from a peer before the insertion
+			// does, remember it so that the atom is never inserted
+			s.early[string(crdt.PosBytes(p))] = true
+			k++
+			continue
+		}
+
+		n := 1
+		for ; k+n < len(runes); n++ {
+			q := crdt.RunPos(pos, k+n)
+			if i, exists := s.doc.Index(q); !exists || i != CRDTIndex+n {
+				break
+			}
+			s.deleted[string(crdt.PosBytes(q))] = true
+		}
+		k += n
+		s.doc.DeleteMultiple(CRDTIndex, CRDTIndex+n)
+		if s.cb.RemoteDelete != nil {
+			for i := 0; i < n; i++ {
+				s.cb.RemoteDelete(CRDTIndex - 1) // CRDT_index is one index higher
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+// DiscoveryGroup is the UDP multicast address hosts answer discovery
+// queries on, unless told otherwise
+const DiscoveryGroup = "239.255.77.77:7777"
+
+// discoveryQuery is the datagram Discover sends to the group
+const discoveryQuery = "entangle?"
+
+// Announcement tells which documents a host shares, and where to reach it
+type Announcement struct {
+	Addr   string   // ip:port of the host
+	DocIDs []string // documents it shares, in alphabetical order
+}
+
+// Announce makes the host answer the discovery queries sent to the multicast
+// group with the documents it shares, until it is closed. Hosts which share
+// nothing stay quiet. The host must be listening already
+func (h *Host) Announce(group string) error {
+	if h.listener == nil {
+		return errors.New("not listening for peers")
+	}
+	if h.announcer != nil {
+		return nil
+	}
+
+	gaddr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, gaddr)
+	if err != nil {
+		return errors.New("discovery error: " + err.Error())
+	}
+	h.announcer = conn
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return // closed
+			}
+			if string(buf[:n]) != discoveryQuery {
+				continue
+			}
+
+			docIDs := h.SharedDocIDs()
+			if len(docIDs) == 0 {
+				continue
+			}
+			data, err := json.Marshal(Announcement{h.announcedAddr(from), docIDs})
+			if err != nil {
+				continue
+			}
+			// the answer goes straight back to the querier
+			conn.WriteToUDP(data, from)
+		}
+	}()
+	return nil
+}
+
+// announcedAddr returns the address the querier at to reaches the host at.
+// A host listening on every interface is announced with the address of the
+// interface facing the querier
+func (h *Host) announcedAddr(to *net.UDPAddr) string {
+	host, port, err := net.SplitHostPort(h.addr)
+	if err != nil {
+		return h.addr
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return h.addr
+	}
+
+	// no datagram is sent, this only picks the route to the querier
+	conn, err := net.DialUDP("udp4", nil, to)
+	if err != nil {
+		return h.addr
+	}
+	defer conn.Close()
+	return net.JoinHostPort(conn.LocalAddr().(*net.UDPAddr).IP.String(), port)
+}
+
+// StopAnnouncing stops answering the discovery queries. It does nothing if
+// the host is not announcing
+func (h *Host) StopAnnouncing() {
+	if h.announcer != nil {
+		h.announcer.Close()
+		h.announcer = nil
+	}
+}
+
+// Discover asks the hosts of the multicast group which documents they share,
+// and collects the answers arriving within wait, ordered by address
+func Discover(group string, wait time.Duration) ([]Announcement, error) {
+	gaddr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteToUDP([]byte(discoveryQuery), gaddr); err != nil {
+		return nil, errors.New("discovery error: " + err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+
+	found := make(map[string]Announcement)
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // the deadline passed
+		}
+		var a Announcement
+		if err := json.Unmarshal(buf[:n], &a); err != nil || a.Addr == "" {
+			continue
+		}
+		found[a.Addr] = a
+	}
+
+	all := make([]Announcement, 0, len(found))
+	for _, a := range found {
+		all = append(all, a)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Addr < all[j].Addr })
+	return all, nil
+}
@@ -0,0 +1,64 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+func TestDiscover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a group of its own, so that other instances do not answer
+	const group = "239.255.77.77:7791"
+	var hosts []*Host
+	for i, docID := range []string{"a.txt", "b.txt", ""} {
+		h := NewHost(TCP, dir)
+		h.SetStore("memory")
+		if err := h.Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		if err := h.Announce(group); err != nil {
+			t.Skip("multicast is not available: ", err)
+		}
+		if docID != "" {
+			s, _, err := h.Share(docID, crdt.NewDocument(uint8(i), "discovered\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Serve(Callbacks{})
+		}
+		hosts = append(hosts, h)
+	}
+
+	found, err := Discover(group, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the host sharing nothing stays quiet
+	if len(found) != 2 {
+		t.Fatalf("expected 2 hosts, found %v", found)
+	}
+	for _, a := range found {
+		var h *Host
+		for _, c := range hosts[:2] {
+			if c.Addr() == a.Addr {
+				h = c
+			}
+		}
+		if h == nil {
+			t.Fatalf("unexpected host %s", a.Addr)
+		}
+		if ids := h.SharedDocIDs(); len(a.DocIDs) != 1 || a.DocIDs[0] != ids[0] {
+			t.Fatalf("%s announced %v, expected %v", a.Addr, a.DocIDs, ids)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Package session shares CRDT documents between peers: it keeps track of the
+// peers and their clocks, runs the synchronization protocol and stores the
+// documents and their operations. Editors, bots or tests embed it and are
+// told about the remote changes through callbacks.
+package session
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// Transport opens the connections between peers. Hosts normally use TCP,
+// the simulation tests connect peers in memory
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// TCP connects peers over TCP
+var TCP Transport = tcpTransport{}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, rpcTimeout)
+}
+
+// Host is a peer: it listens for the other peers and holds the sessions
+// of the documents it shares
+type Host struct {
+	// addr is the ip:port the other peers reach this host at
+	addr     string
+	clientID string
+
+	transport Transport
+	listener  net.Listener
+	// announcer answers the discovery queries, nil unless announcing
+	announcer *net.UDPConn
+	// tracer records the events of the sessions, if asked to
+	tracer *tracer
+
+	// dir is where the storage of the sessions is kept
+	dir string
+	// store is the kind of storage of the sessions shared from now on
+	store string
+
+	// the shared documents, indexed by document ID
+	sessions map[string]*Session
+	// protects sessions
+	mu sync.Mutex
+
+	// the files of the workspace, indexed by document ID
+	files map[string]File
+	// filesChanged is called when a peer changed the workspace
+	filesChanged func(old, f File)
+	// protects files and filesChanged
+	filesMu sync.Mutex
+
+	// the terminals of ours the peers can watch, indexed by name
+	terms map[string]*SharedTerm
+	// the consumers of the frames of the terminals we watch, indexed by
+	// peer/name
+	watching map[string]func(f TermFrame)
+	// number of the terminals shared so far, which makes their names unique
+	termSeq int
+	// protects terms, watching and termSeq
+	termsMu sync.Mutex
+
+	// the tokens the peers authenticate their connections to us with, and
+	// the ones they gave us, indexed by peer, see auth.go
+	issued map[string]string
+	tokens map[string]string
+	// protects issued and tokens
+	tokensMu sync.Mutex
+}
+
+// NewHost creates a host which is not listening yet. The storage of its
+// sessions is kept in dir
+func NewHost(t Transport, dir string) *Host {
+	return &Host{
+		transport: t,
+		dir:       dir,
+		store:     DefaultStore,
+		tracer:    &tracer{},
+		sessions:  make(map[string]*Session),
+		files:     make(map[string]File),
+		terms:     make(map[string]*SharedTerm),
+		watching:  make(map[string]func(f TermFrame)),
+		issued:    make(map[string]string),
+		tokens:    make(map[string]string),
+	}
+}
+
+// Listen registers the RPC service of the host and accepts the peers on addr.
+// It does nothing if the host is listening already
+func (h *Host) Listen(addr string) error {
+	if h.listener != nil {
+		return nil
+	}
+
+	l, err := h.transport.Listen(addr)
+	if err != nil {
+		return errors.New("listen error: " + err.Error())
+	}
+	// the address is our identity, the peers dial it back
+	if err := CheckAddr(l.Addr().String()); err != nil {
+		l.Close()
+		return errors.New("listen error: " + err.Error())
+	}
+	h.listener = l
+
+	h.addr = l.Addr().String()
+	h.clientID = clientIDOf(h.addr)
+	h.loadFiles()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// each connection is served apart, since it is authenticated
+			// as the peer which dialed it
+			server := rpc.NewServer()
+			server.Register(&EntangleClient{host: h})
+			go server.ServeConn(conn)
+		}
+	}()
+
+	return nil
+}
+
+// SetStore sets the kind of storage used by the documents shared from now
+// on, one of StoreKinds
+func (h *Host) SetStore(kind string) error {
+	if _, ok := stores[kind]; !ok {
+		return unknownStore(kind)
+	}
+	h.store = kind
+	return nil
+}
+
+// Addr returns the ip:port the other peers reach this host at, empty if
+// it is not listening
+func (h *Host) Addr() string {
+	return h.addr
+}
+
+// siteOf returns the site the host at addr asks for in the position
+// identifiers, from 1 to 255 since the initial content of a document is
+// site 0. Different hosts may ask for the same one, see assignSite
+func siteOf(addr string) uint8 {
+	f := fnv.New32a()
+	f.Write([]byte(addr))
+	return uint8(f.Sum32()%255) + 1
+}
+
+// storageDir returns the directory holding the storage of the given
+// document. It is kept per client, so that several peers can run on the
+// same machine, and per kind of sequence since their positions differ
+func (h *Host) storageDir(docID, kind string) string {
+	dir := escapePath(docID)
+	if kind != crdt.Logoot {
+		dir += "@" + kind
+	}
+	return filepath.Join(h.dir, h.clientID, dir)
+}
+
+// dial connects to the RPC service of a peer
+func (h *Host) dial(addr string) (*rpc.Client, error) {
+	conn, err := h.transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// GetSession returns the session of the given document, nil if it is not shared
+func (h *Host) GetSession(docID string) *Session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sessions[docID]
+}
+
+// SharedDocIDs returns the IDs of the shared documents in alphabetical order
+func (h *Host) SharedDocIDs() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ids := make([]string, 0, len(h.sessions))
+	for id := range h.sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Sessions returns the sessions of the host
+func (h *Host) Sessions() []*Session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	all := make([]*Session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		all = append(all, s)
+	}
+	return all
+}
+
+// SaveSessions writes the sequence vectors of the shared documents to storage
+func (h *Host) SaveSessions() {
+	for _, s := range h.Sessions() {
+		s.saveSeqVector()
+	}
+}
+
+// Close stops sharing every document, announcing them and listening
+func (h *Host) Close() {
+	for _, name := range h.SharedTerms() {
+		if t := h.sharedTerm(name); t != nil {
+			t.Close()
+		}
+	}
+	for _, s := range h.Sessions() {
+		s.Unshare()
+	}
+	h.StopAnnouncing()
+	h.tracer.open("")
+	if h.listener != nil {
+		h.listener.Close()
+		h.listener = nil
+	}
+}
+
+// CheckAddr checks that addr is a host:port the peers can reach a host at:
+// the host must be given, and not be a wildcard address
+func CheckAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New(addr + " does not name the host the peers reach")
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return errors.New(addr + " is a wildcard address the peers cannot reach")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return errors.New(addr + " does not have a valid port")
+	}
+	return nil
+}
+
+// clientIDOf returns the ID naming the storage of the host at addr: its
+// host followed by _ and its port, A.B.C.D_E for A.B.C.D:E. The bytes of
+// the host other than ASCII letters, digits, dots and dashes are escaped
+// as %XX, so that no two addresses have the same ID
+// Pre: addr passes CheckAddr
+func clientIDOf(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	var id bytes.Buffer
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' {
+			id.WriteByte(c)
+		} else {
+			fmt.Fprintf(&id, "%%%02X", c)
+		}
+	}
+	return id.String() + "_" + port
+}
+
+// escapePath replaces every path separator in a given path with a %
+func escapePath(path string) string {
+	path = filepath.ToSlash(path)
+	return strings.Replace(path, "/", "%", -1)
+}
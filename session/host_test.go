@@ -0,0 +1,59 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckAddr(t *testing.T) {
+	var tests = []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:7000", true},
+		{"192.168.1.20:7001", true},
+		{"[fe80::1]:7000", true},
+		{"myhost:7000", true},
+		{":7000", false},
+		{"0.0.0.0:7000", false},
+		{"[::]:7000", false},
+		{"127.0.0.1", false},
+		{"127.0.0.1:http", false},
+	}
+	for _, test := range tests {
+		if err := CheckAddr(test.addr); (err == nil) != test.ok {
+			t.Errorf("CheckAddr(%q) = %v", test.addr, err)
+		}
+	}
+
+	if id := clientIDOf("10.0.0.1:7001"); id != "10.0.0.1_7001" {
+		t.Errorf("unexpected client ID %q", id)
+	}
+	if id := clientIDOf("[fe80::1]:7000"); id != "fe80%3A%3A1_7000" {
+		t.Errorf("unexpected client ID %q", id)
+	}
+	if a, b := clientIDOf("1.2.3.4:5"), clientIDOf("1.2.34.5:5"); a == b {
+		t.Errorf("%s and %s have the same client ID %q", "1.2.3.4:5", "1.2.34.5:5", a)
+	}
+}
+
+func TestListenWildcard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := NewHost(TCP, dir)
+	defer h.Close()
+	if err := h.Listen(":0"); err == nil {
+		t.Fatal("listening on a wildcard address gives an address the peers cannot dial")
+	}
+	if err := h.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if h.Addr() == "" || h.clientID == "" {
+		t.Fatalf("no identity for %q", h.Addr())
+	}
+}
@@ -0,0 +1,250 @@
+package session
+
+import (
+	"bytes"
+	"net/rpc"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+const (
+	// maxQueued bounds the operations waiting to be sent to a peer. Past
+	// it, the queue is dropped and the operations are read back from the
+	// ops log once the peer has caught up
+	maxQueued = 4096
+	// maxBatch bounds the operations sent to a peer in a single message
+	maxBatch = 512
+)
+
+// outbox sends our operations to one peer, in clock order, from a single
+// goroutine. The operations queued while a message is in flight are
+// coalesced into the next message, and the runes typed one after the other
+// are sent as runs.
+// Until the pair-wise synchronization tells which clock the peer has, and
+// whenever the queue overflows, the operations are read from the ops log
+// instead of the queue
+type outbox struct {
+	s      *Session
+	peer   string
+	client *rpc.Client
+
+	queue []crdt.Operation
+	// clock of the last operation handed to the outbox
+	offered uint64
+	// clock of the last operation the peer accepted
+	delivered uint64
+	// catchUp is set while the operations after delivered are read from the ops log
+	catchUp bool
+	started bool
+	closed  bool
+
+	// number of operations and messages sent
+	sent     uint64
+	messages uint64
+	// round trip of the last message, until the peer stored it
+	rtt time.Duration
+
+	mu   sync.Mutex
+	wake *sync.Cond
+}
+
+// PeerStats describes the connection to a peer, as shown by netstat
+type PeerStats struct {
+	Peer      string
+	Connected bool
+	Queued    int           // operations waiting to be sent
+	Delivered uint64        // clock of the last operation the peer accepted
+	Acked     uint64        // clock of the last operation the peer stored
+	CatchUp   bool          // whether the operations are read from the ops log
+	Sent      uint64        // operations sent since connected
+	Messages  uint64        // messages sent since connected
+	RTT       time.Duration // round trip of the last message, 0 if none
+	Clock     uint64        // clock of the last operation of the peer we have
+	Received  uint64        // operations applied from the peer
+	LastError string        // last error talking to the peer, if any
+	Repaired  uint64        // atoms deleted by reconciling with the peer
+}
+
+// newOutbox starts the goroutine sending to the peer. Nothing is sent until start
+func newOutbox(s *Session, peer string, client *rpc.Client) *outbox {
+	o := &outbox{
+		s:       s,
+		peer:    peer,
+		client:  client,
+		catchUp: true,
+	}
+	o.wake = sync.NewCond(&o.mu)
+	go o.run()
+	return o
+}
+
+// start sends the operations following delivered, which is the last clock
+// of ours the peer has, and then the ones queued from now on
+func (o *outbox) start(delivered uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.delivered = delivered
+	o.started = true
+	o.catchUp = true
+	o.queue = nil
+	o.wake.Signal()
+}
+
+// enqueue queues operations to be sent. They must come in clock order
+func (o *outbox) enqueue(ops []crdt.Operation) {
+	if len(ops) == 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.offered = ops[len(ops)-1].Clock
+	if o.catchUp {
+		// they will be read from the ops log
+		return
+	}
+
+	if len(o.queue)+len(ops) > maxQueued {
+		// the peer is too slow, do not keep more in memory
+		o.queue = nil
+		o.catchUp = true
+	} else {
+		o.queue = append(o.queue, ops...)
+	}
+	o.wake.Signal()
+}
+
+// close stops the goroutine sending to the peer
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	o.wake.Signal()
+}
+
+func (o *outbox) stats() PeerStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return PeerStats{
+		Peer:      o.peer,
+		Connected: true,
+		Queued:    len(o.queue),
+		Delivered: o.delivered,
+		CatchUp:   o.catchUp,
+		Sent:      o.sent,
+		Messages:  o.messages,
+		RTT:       o.rtt,
+	}
+}
+
+// next waits for operations to send, and returns false once closed
+func (o *outbox) next() ([]crdt.Operation, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for {
+		for !o.closed && (!o.started || (!o.catchUp && len(o.queue) == 0)) {
+			o.wake.Wait()
+		}
+		if o.closed {
+			return nil, false
+		}
+
+		if !o.catchUp {
+			n := len(o.queue)
+			if n > maxBatch {
+				n = maxBatch
+			}
+			return coalesce(o.queue[:n]), true
+		}
+
+		// everything offered so far is in the ops log once flushed
+		from, offered := o.delivered+1, o.offered
+		o.mu.Unlock()
+		o.s.flush()
+		ops := o.s.store.Ops(from, from+maxBatch-1)
+		o.mu.Lock()
+
+		if o.closed || from != o.delivered+1 {
+			continue // restarted meanwhile
+		}
+		if len(ops) > 0 {
+			return coalesce(ops), true
+		}
+		// caught up, unless more was offered while reading
+		o.catchUp = o.offered > offered
+	}
+}
+
+// coalesce returns the operations with the insertions of runes which follow
+// each other in a run, and in clock order, merged into one insertion which
+// has the clock of the last rune. The peers skip the operations up to the
+// clock they have, which always ends a message, so that they never have part
+// of a merged run. Positions of sequences which do not make runs never
+// follow each other this way
+func coalesce(ops []crdt.Operation) []crdt.Operation {
+	merged := make([]crdt.Operation, 0, len(ops))
+	for _, op := range ops {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.OpType && op.OpType && op.Clock == last.Clock+1 && follows(*last, op) {
+				last.Atom += op.Atom
+				last.Clock = op.Clock
+				continue
+			}
+		}
+		merged = append(merged, op)
+	}
+	return merged
+}
+
+// follows returns whether the first rune of op comes right after the runes
+// of the run last
+func follows(last, op crdt.Operation) bool {
+	next := crdt.RunPos(crdt.NewPos(last.Pos), utf8.RuneCountInString(last.Atom))
+	return bytes.Equal(crdt.PosBytes(next), op.Pos)
+}
+
+// run sends the operations until closed. The peer is dropped if it fails
+// to take them, they are sent again from the ops log when it reconnects.
+// The clock the peer acknowledges having stored is recorded as well
+func (o *outbox) run() {
+	for {
+		ops, ok := o.next()
+		if !ok {
+			return
+		}
+
+		args := ApplyArgs{
+			DocID:    o.s.DocID,
+			Clientid: o.s.host.addr,
+			Ops:      ops,
+		}
+		var reply ApplyReply
+		start := time.Now()
+		if err := callPeer(o.client, "EntangleClient.Apply", args, &reply); err != nil {
+			o.close()
+			o.s.dropClient(o.peer, o.client, err)
+			o.s.changed()
+			return
+		}
+
+		o.mu.Lock()
+		if last := ops[len(ops)-1].Clock; last > o.delivered {
+			o.delivered = last
+		}
+		for len(o.queue) > 0 && o.queue[0].Clock <= o.delivered {
+			o.queue = o.queue[1:]
+		}
+		o.sent += uint64(len(ops))
+		o.messages++
+		o.rtt = time.Since(start)
+		o.mu.Unlock()
+
+		o.s.ack(o.peer, reply.Clocks[o.s.host.addr])
+	}
+}
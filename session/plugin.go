@@ -0,0 +1,222 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sort"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// PluginMessage is a message a plugin sends to the same plugin of the peers
+type PluginMessage struct {
+	From   string // ip:port of the sender
+	Plugin string // name of the plugin it is for
+	Data   string
+}
+
+// SendPluginMessage sends data to the given plugin of every connected peer.
+// Plugin messages are not stored, the peers not connected never get them
+func (s *Session) SendPluginMessage(plugin, data string) {
+	args := PluginMessageArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Msg:      PluginMessage{From: s.host.addr, Plugin: plugin, Data: data},
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for peer, client := range s.peers {
+		if client == nil {
+			continue
+		}
+		go func(peer string, client *rpc.Client) {
+			var reply ValReply
+			if err := callPeer(client, "EntangleClient.PluginMessage", args, &reply); err != nil {
+				s.dropClient(peer, client, err)
+			}
+		}(peer, client)
+	}
+}
+
+// Peers returns the addresses of the connected peers, sorted
+func (s *Session) Peers() []string {
+	peers := s.connectedPeers()
+	sort.Strings(peers)
+	return peers
+}
+
+// Author returns the peer who inserted the rune at index (counted from 0),
+// false if there is none or its site is not known. The initial content is
+// the owner's
+// Pre: the document is locked
+func (s *Session) Author(index int) (string, bool) {
+	if index < 0 || index >= s.doc.Len() {
+		return "", false
+	}
+	site := s.doc.Author(index + 1) // off by 1
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if peer, ok := s.sites[site]; ok {
+		return peer, true
+	}
+	if site == 0 && s.owner != "" {
+		return s.owner, true
+	}
+	return "", false
+}
+
+// knownSites returns the sites of the peers we know of
+func (s *Session) knownSites() map[uint8]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sites := make(map[uint8]string, len(s.sites))
+	for site, peer := range s.sites {
+		sites[site] = peer
+	}
+	return sites
+}
+
+// learnSites adds the sites a peer knows of. A site taken already stays
+// with its peer
+func (s *Session) learnSites(sites map[uint8]string) {
+	learned := make(map[uint8]string)
+	s.mu.Lock()
+	for site, peer := range sites {
+		if _, ok := s.sites[site]; !ok {
+			s.sites[site] = peer
+			learned[site] = peer
+		}
+	}
+	s.mu.Unlock()
+	s.saveSites(learned)
+}
+
+// loadSites adds the stored sites. A site taken already stays with its peer
+func (s *Session) loadSites() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for site, peer := range s.store.LoadSites() {
+		if _, ok := s.sites[site]; !ok {
+			s.sites[site] = peer
+		}
+	}
+}
+
+// saveSites stores the sites learned, so that they are still taken once
+// the session is shared again
+func (s *Session) saveSites(sites map[uint8]string) {
+	if len(sites) == 0 {
+		return
+	}
+	s.persist(func() {
+		s.storageError(s.store.SaveSites(sites))
+	})
+}
+
+// assignSite returns the site of a peer joining the session: the one it had
+// if it joined before, otherwise the one it asks for, see siteOf, or the
+// next one not taken. The site is taken at once so that the peers joining
+// next do not get it
+func (s *Session) assignSite(peer string) (uint8, error) {
+	s.mu.Lock()
+	for site, p := range s.sites {
+		if p == peer {
+			s.mu.Unlock()
+			return site, nil
+		}
+	}
+	site := siteOf(peer)
+	for i := 0; i < 255; i++ {
+		if _, taken := s.sites[site]; !taken {
+			s.sites[site] = peer
+			s.mu.Unlock()
+			s.saveSites(map[uint8]string{site: peer})
+			return site, nil
+		}
+		site = site%255 + 1
+	}
+	s.mu.Unlock()
+	return 0, errors.New("no site left for " + peer)
+}
+
+// checkSites returns an error if a peer knows our site as the one of
+// another peer: our identifiers would then collide with its own
+func (s *Session) checkSites(sites map[uint8]string) error {
+	if peer, ok := sites[s.site]; ok && peer != s.host.addr {
+		return fmt.Errorf("site %d is both %s and %s", s.site, s.host.addr, peer)
+	}
+	return nil
+}
+
+// checkAuthor returns an error unless the atoms a peer inserts in a patch
+// are at positions of its own site, so that it cannot pass them off as the
+// ones of another peer. The site of a peer we do not know the site of yet
+// is learned from its patch
+func (s *Session) checkAuthor(peer string, patch []crdt.Operation) error {
+	learned, err := s.authorSite(peer, patch)
+	if learned != 0 {
+		s.saveSites(map[uint8]string{learned: peer})
+	}
+	return err
+}
+
+// authorSite checks the sites of the atoms a peer inserts, see checkAuthor,
+// and returns the site learned from them, 0 if none
+func (s *Session) authorSite(peer string, patch []crdt.Operation) (uint8, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var own, learned uint8
+	for site, p := range s.sites {
+		if p == peer {
+			own = site
+		}
+	}
+	for _, op := range patch {
+		if !op.OpType {
+			// the atoms of anyone may be deleted
+			continue
+		}
+		site := s.doc.SiteOf(crdt.NewPos(op.Pos))
+		if own == 0 {
+			if p, ok := s.sites[site]; site == 0 || ok && p != peer {
+				return learned, fmt.Errorf("%s inserted atoms of site %d", peer, site)
+			}
+			own, learned = site, site
+			s.sites[site] = peer
+		}
+		if site != own {
+			return learned, fmt.Errorf("%s inserted atoms of site %d, its site is %d", peer, site, own)
+		}
+	}
+	return learned, nil
+}
+
+// awaitSync waits for the operations of the peer up to clock, the ones it
+// had when we synchronized, before telling the consumer we are in sync
+func (s *Session) awaitSync(peer string, clock uint64) {
+	s.mu.Lock()
+	s.syncing[peer] = clock
+	s.mu.Unlock()
+	s.checkSynced(peer)
+}
+
+// checkSynced tells the consumer we are in sync with the peer once its
+// operations awaited by awaitSync have been applied
+func (s *Session) checkSynced(peer string) {
+	s.mu.Lock()
+	clock, ok := s.syncing[peer]
+	var have uint64
+	if e := s.seqVector[peer]; e != nil {
+		have = e.Clock
+	}
+	done := ok && have >= clock
+	if done {
+		delete(s.syncing, peer)
+	}
+	s.mu.Unlock()
+
+	if done && s.cb.Synced != nil {
+		s.cb.Synced(peer)
+	}
+}
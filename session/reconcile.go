@@ -0,0 +1,295 @@
+package session
+
+import (
+	"errors"
+	"net/rpc"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// Two peers which have received the same operations must hold the same
+// document. When their hashes say otherwise, for instance because an
+// operation was lost, the ranges of positions whose hashes differ are split
+// until they are small enough to be compared atom by atom. An atom only one
+// of the peers has was either deleted on the other one, or its insertion
+// never arrived there. The peer which has it deletes it only if the other
+// one remembers deleting it, and sends the deletion to every peer like the
+// ones typed locally. The peer which misses it inserts it, unless it
+// deleted it, and the other peers missing it get it from their own
+// reconciliation.
+
+const (
+	// reconcileFanout is the number of ranges a differing range is split into
+	reconcileFanout = 16
+	// reconcileLeaf is the number of atoms below which a range is compared
+	// atom by atom
+	reconcileLeaf = 32
+)
+
+// errMoved stops a reconciliation when operations arrived meanwhile
+var errMoved = errors.New("the document changed during the reconciliation")
+
+// boundPos returns the position of a range bound, nil for an end of the document
+func boundPos(b []byte) []crdt.Identifier {
+	if len(b) == 0 {
+		return nil
+	}
+	return crdt.NewPos(b)
+}
+
+// sameClocks returns whether two sequence vectors are equal, a missing
+// peer counting as clock 0
+func sameClocks(a, b map[string]uint64) bool {
+	for peer, clock := range a {
+		if b[peer] != clock {
+			return false
+		}
+	}
+	for peer, clock := range b {
+		if a[peer] != clock {
+			return false
+		}
+	}
+	return true
+}
+
+// digest returns the sequence vector and the hash of the document
+func (s *Session) digest() Digest {
+	s.docMu.Lock()
+	defer s.docMu.Unlock()
+	return Digest{s.clocks(), s.doc.Hash()}
+}
+
+// Heartbeat compares the document with the ones of the connected peers,
+// and repairs it if it differs from one which received the same operations
+func (s *Session) Heartbeat() {
+	s.mu.Lock()
+	clients := make(map[string]*rpc.Client)
+	for peer, client := range s.peers {
+		if client != nil {
+			clients[peer] = client
+		}
+	}
+	s.mu.Unlock()
+
+	for peer, client := range clients {
+		args := DigestArgs{
+			DocID:    s.DocID,
+			Clientid: s.host.addr,
+		}
+		var reply Digest
+		if err := callPeer(client, "EntangleClient.Digest", args, &reply); err != nil {
+			// a peer which crashed is gone, with its claims, until it
+			// connects again
+			s.dropClient(peer, client, err)
+			continue
+		}
+		s.checkDigest(peer, client, reply)
+	}
+}
+
+// Heartbeat runs the heartbeat of every shared document, and exchanges the
+// workspace with the connected peers
+func (h *Host) Heartbeat() {
+	for _, s := range h.Sessions() {
+		s.Heartbeat()
+	}
+	for _, client := range h.clients() {
+		h.exchangeFiles(client)
+	}
+}
+
+// checkDigest reconciles the document with the one of the peer if they
+// have received the same operations but differ
+func (s *Session) checkDigest(peer string, client *rpc.Client, theirs Digest) {
+	ours := s.digest()
+	if !sameClocks(ours.Clocks, theirs.Clocks) || ours.Hash == theirs.Hash {
+		return
+	}
+
+	n, err := s.reconcile(client, ours.Clocks)
+	if err == errMoved {
+		return // the next heartbeat will tell
+	}
+	if err != nil {
+		s.failed(peer, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.repaired[peer] += uint64(n)
+	s.mu.Unlock()
+	s.changed()
+}
+
+// span is a range of positions, from lo (included) up to hi (excluded)
+type span struct {
+	lo, hi []byte
+}
+
+// reconcile locates the atoms the document and the one of the peer do not
+// agree on, both at the given sequence vector, and repairs them. It returns
+// the number of atoms deleted or inserted
+func (s *Session) reconcile(client *rpc.Client, clocks map[string]uint64) (int, error) {
+	// the atoms only we have, and the ones only the peer has
+	var extra, missing []crdt.Operation
+	work := []span{{}}
+	for len(work) > 0 {
+		sp := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		s.docMu.Lock()
+		if !sameClocks(s.clocks(), clocks) {
+			s.docMu.Unlock()
+			return 0, errMoved
+		}
+		pairs := s.doc.Range(boundPos(sp.lo), boundPos(sp.hi))
+
+		if len(pairs) <= reconcileLeaf {
+			ours := make(map[string]string, len(pairs))
+			for _, p := range pairs {
+				ours[string(crdt.PosBytes(p.Pos))] = p.Atom
+			}
+			s.docMu.Unlock()
+
+			theirs, err := s.peerAtoms(client, sp, clocks)
+			if err != nil {
+				return 0, err
+			}
+			for pos, atom := range ours {
+				if _, ok := theirs[pos]; !ok {
+					extra = append(extra, crdt.Operation{Atom: atom, OpType: true, Pos: []byte(pos)})
+				}
+			}
+			for pos, atom := range theirs {
+				if _, ok := ours[pos]; !ok {
+					missing = append(missing, crdt.Operation{Atom: atom, OpType: true, Pos: []byte(pos)})
+				}
+			}
+			continue
+		}
+
+		// split at evenly spaced atoms of ours
+		n := len(pairs)
+		bounds := [][]byte{sp.lo}
+		for k := 1; k < reconcileFanout; k++ {
+			bounds = append(bounds, crdt.PosBytes(pairs[k*n/reconcileFanout].Pos))
+		}
+		bounds = append(bounds, sp.hi)
+		hashes := make([]uint64, reconcileFanout)
+		counts := make([]int, reconcileFanout)
+		for k := range hashes {
+			hashes[k], counts[k] = s.doc.RangeHash(boundPos(bounds[k]), boundPos(bounds[k+1]))
+		}
+		s.docMu.Unlock()
+
+		args := RangesArgs{
+			DocID:    s.DocID,
+			Clientid: s.host.addr,
+			Bounds:   bounds,
+		}
+		var reply RangesReply
+		if err := callPeer(client, "EntangleClient.Ranges", args, &reply); err != nil {
+			return 0, err
+		}
+		if !sameClocks(reply.Clocks, clocks) {
+			return 0, errMoved
+		}
+		for k := range hashes {
+			if hashes[k] != reply.Hashes[k] || counts[k] != reply.Counts[k] {
+				work = append(work, span{bounds[k], bounds[k+1]})
+			}
+		}
+	}
+
+	deleted, err := s.peerDeleted(client, extra)
+	if err != nil {
+		return 0, err
+	}
+	return s.repair(deleted, missing, clocks)
+}
+
+// peerDeleted returns the positions of the given atoms which the peer deleted
+func (s *Session) peerDeleted(client *rpc.Client, atoms []crdt.Operation) ([]crdt.Pair, error) {
+	if len(atoms) == 0 {
+		return nil, nil
+	}
+	args := DeletedArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+	}
+	for _, op := range atoms {
+		args.Pos = append(args.Pos, op.Pos)
+	}
+	var reply DeletedReply
+	if err := callPeer(client, "EntangleClient.Deleted", args, &reply); err != nil {
+		return nil, err
+	}
+	var deleted []crdt.Pair
+	for _, pos := range reply.Pos {
+		deleted = append(deleted, crdt.Pair{Pos: crdt.NewPos(pos)})
+	}
+	return deleted, nil
+}
+
+// peerAtoms returns the atoms the peer has in a range, indexed by position
+func (s *Session) peerAtoms(client *rpc.Client, sp span, clocks map[string]uint64) (map[string]string, error) {
+	args := RangesArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Bounds:   [][]byte{sp.lo, sp.hi},
+	}
+	var reply AtomsReply
+	if err := callPeer(client, "EntangleClient.Atoms", args, &reply); err != nil {
+		return nil, err
+	}
+	if !sameClocks(reply.Clocks, clocks) {
+		return nil, errMoved
+	}
+
+	atoms := make(map[string]string, len(reply.Patch))
+	for _, op := range reply.Patch {
+		// the length byte may differ for deep positions, see PosBytes
+		atoms[string(crdt.PosBytes(crdt.NewPos(op.Pos)))] = op.Atom
+	}
+	return atoms, nil
+}
+
+// repair deletes the runes at the positions of the deleted pairs and inserts
+// the missing ones we did not delete, if the document is still at the given
+// sequence vector, and returns how many it changed. The deletions are sent
+// to the peers
+func (s *Session) repair(deleted []crdt.Pair, missing []crdt.Operation, clocks map[string]uint64) (int, error) {
+	if len(deleted) == 0 && len(missing) == 0 {
+		return 0, nil
+	}
+
+	s.docMu.Lock()
+	defer s.docMu.Unlock()
+	if !sameClocks(s.clocks(), clocks) {
+		return 0, errMoved
+	}
+
+	var repaired []crdt.Pair
+	for _, pair := range deleted {
+		i, exists := s.doc.Index(pair.Pos)
+		if !exists {
+			continue
+		}
+		repaired = append(repaired, s.doc.DeleteMultiple(i, i+1)...)
+		if s.cb.RemoteDelete != nil {
+			s.cb.RemoteDelete(i - 1) // off by 1
+		}
+	}
+	s.localOps(repaired, false)
+
+	var inserted []crdt.Operation
+	for _, op := range missing {
+		if !s.deleted[string(op.Pos)] {
+			inserted = append(inserted, op)
+		}
+	}
+	// like the operations of a peer, see insertRun
+	s.insertPatch(inserted)
+	return len(repaired) + len(inserted), nil
+}
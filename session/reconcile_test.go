@@ -0,0 +1,89 @@
+package session
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+func TestReconcile(t *testing.T) {
+	sim := newSimulation(t, 3, 19, strings.Repeat("reconciled\n", 200))
+	defer sim.close()
+
+	for i := 0; i < 3; i++ {
+		sim.round(sim.randomEdit)
+	}
+	sim.assertConverged()
+	first, second, last := sim.peers[0], sim.peers[1], sim.peers[2]
+
+	// the heartbeat finds nothing to repair
+	first.host.Heartbeat()
+	sim.settle()
+	for _, st := range first.session.NetStats() {
+		if st.Repaired != 0 {
+			t.Fatalf("repaired %d atoms with %s in sync", st.Repaired, st.Peer)
+		}
+	}
+
+	// a deletion the peers never heard of, and an insertion which never
+	// arrived
+	second.session.Lock()
+	deletedPos := second.session.doc.Pos(1000)
+	second.session.doc.DeletePos(deletedPos)
+	second.session.deleted[string(crdt.PosBytes(deletedPos))] = true
+	second.session.Unlock()
+
+	last.session.Lock()
+	pos, _ := last.session.doc.(*crdt.Document).GeneratePos(last.session.doc.Pos(10), last.session.doc.Pos(11))
+	last.session.doc.InsertPos(pos, "!", 0)
+	last.session.Unlock()
+
+	// each repair moves the sequence vector on, the next peer is repaired
+	// by the following heartbeat
+	for i := 0; i < 3; i++ {
+		for _, p := range sim.peers {
+			p.host.Heartbeat()
+			sim.settle()
+		}
+	}
+	sim.assertConverged()
+
+	hash := first.session.digest().Hash
+	for _, p := range sim.peers {
+		if h := p.session.digest().Hash; h != hash {
+			t.Fatalf("%s has hash %x, expected %x", p.addr, h, hash)
+		}
+		p.session.Lock()
+		_, deleted := p.session.doc.Index(deletedPos)
+		_, inserted := p.session.doc.Index(pos)
+		p.session.Unlock()
+		if deleted {
+			t.Fatalf("%s still has the deleted atom", p.addr)
+		}
+		if !inserted {
+			t.Fatalf("%s lost the inserted atom", p.addr)
+		}
+	}
+
+	repaired := uint64(0)
+	for _, p := range sim.peers {
+		for _, st := range p.session.NetStats() {
+			repaired += st.Repaired
+		}
+	}
+	if repaired == 0 {
+		t.Fatal("repaired no atoms")
+	}
+
+	// the hash follows the document
+	first.session.Lock()
+	d := crdt.NewDocument(0, "")
+	for _, p := range first.session.doc.Atoms() {
+		d.InsertPos(p.Pos, p.Atom, 0)
+	}
+	if d.Hash() != first.session.doc.Hash() {
+		t.Fatalf("hash %x of the same atoms, expected %x", d.Hash(), first.session.doc.Hash())
+	}
+	first.session.Unlock()
+}
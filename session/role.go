@@ -0,0 +1,162 @@
+package session
+
+import (
+	"errors"
+	"net/rpc"
+	"sort"
+	"strings"
+)
+
+// Role defines what a peer is allowed to do in a session
+type Role int
+
+const (
+	// RoleViewer receives the operations but cannot edit
+	RoleViewer Role = iota
+	// RoleEditor can edit the document
+	RoleEditor
+	// RoleOwner is the peer who shared the document. The owner can edit
+	// and is the only one allowed to change the roles of the other peers
+	RoleOwner
+)
+
+var roleNames = map[Role]string{
+	RoleViewer: "viewer",
+	RoleEditor: "editor",
+	RoleOwner:  "owner",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// CanEdit returns whether a peer with this role may send write operations
+func (r Role) CanEdit() bool {
+	return r >= RoleEditor
+}
+
+// ParseRole returns the role with the given name
+func ParseRole(name string) (Role, error) {
+	for r, n := range roleNames {
+		if n == name {
+			return r, nil
+		}
+	}
+	return RoleViewer, errors.New(name + " is not a valid role (owner, editor or viewer)")
+}
+
+// SetJoinRole sets the role given to peers joining a document we own
+func (s *Session) SetJoinRole(r Role) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.joinRole = r
+}
+
+// Role returns the role of the peer in the session, and whether it is known
+func (s *Session) Role(peer string) (Role, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.roles[peer]
+	return r, ok
+}
+
+// CanEdit returns whether the peer has edit rights. Unknown peers have none
+func (s *Session) CanEdit(peer string) bool {
+	r, ok := s.Role(peer)
+	return ok && r.CanEdit()
+}
+
+// setRole changes the role of the peer
+func (s *Session) setRole(peer string, r Role) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles[peer] = r
+}
+
+// assignRole gives the default role to a peer joining the session, unless
+// its role is known already, and returns the role of the peer
+func (s *Session) assignRole(peer string) Role {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.roles[peer]; ok {
+		return r
+	}
+	s.roles[peer] = s.joinRole
+	return s.joinRole
+}
+
+// mergeRoles adds the roles that are not known yet
+func (s *Session) mergeRoles(roles map[string]Role) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for peer, r := range roles {
+		if _, ok := s.roles[peer]; !ok {
+			s.roles[peer] = r
+		}
+	}
+}
+
+// rolesCopy returns a copy of the roles of the session
+func (s *Session) rolesCopy() map[string]Role {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roles := make(map[string]Role, len(s.roles))
+	for peer, r := range s.roles {
+		roles[peer] = r
+	}
+	return roles
+}
+
+// ChangeRole is used by the owner to change the role of a peer. The new role
+// is sent to every connected peer
+func (s *Session) ChangeRole(peer string, r Role) error {
+	if s.owner != s.host.addr {
+		return errors.New("only the owner (" + s.owner + ") can change roles")
+	}
+	if peer == s.host.addr || r == RoleOwner {
+		return errors.New("the owner of a session cannot be changed")
+	}
+	if _, ok := s.Role(peer); !ok {
+		return errors.New(peer + " is not part of the session")
+	}
+
+	s.setRole(peer, r)
+
+	args := SetRoleArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Peer:     peer,
+		Role:     r,
+	}
+	s.mu.Lock()
+	for _, client := range s.peers {
+		if client == nil {
+			continue
+		}
+		go func(client *rpc.Client) {
+			var reply ValReply
+			callPeer(client, "EntangleClient.SetRole", args, &reply)
+		}(client)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// RolesString describes the roles of the session, sorted by peer
+func (s *Session) RolesString() string {
+	roles := s.rolesCopy()
+	peers := make([]string, 0, len(roles))
+	for peer := range roles {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	desc := make([]string, len(peers))
+	for i, peer := range peers {
+		desc[i] = peer + ": " + roles[peer].String()
+		if peer == s.host.addr {
+			desc[i] += " (you)"
+		}
+	}
+	return strings.Join(desc, ", ")
+}
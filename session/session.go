@@ -0,0 +1,974 @@
+package session
+
+import (
+	"errors"
+	"net/rpc"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// seqVector entry declaration
+type seqVEntry struct {
+	Clock uint64
+	Dirty bool // dirty flag indicates whether runtime DS has this entry changed since last writs to table
+}
+
+// Callbacks let the consumer of a session follow what the peers do. They are
+// called from the goroutines serving the peers, and any of them may be nil
+type Callbacks struct {
+	// RemoteInsert is called with the document locked, after a peer inserted
+	// text at index (counted in atoms, starting from 0)
+	RemoteInsert func(index int, text string)
+	// RemoteDelete is called with the document locked, after a peer deleted
+	// the atom at index
+	RemoteDelete func(index int)
+	// Applied is called once operations of a peer have been applied
+	Applied func(peer string, ops []crdt.Operation)
+	// Changed is called when the peers, their roles or their presence changed
+	Changed func()
+	// Presence is called when a peer told where it is, before Changed
+	Presence func(peer string, p Presence)
+	// Chat is called when a peer sent a chat message
+	Chat func(m ChatMessage)
+	// Comment is called when a peer sent a comment we did not have
+	Comment func(c Comment)
+	// PeerConnected is called when a peer connected to us, or we to it
+	PeerConnected func(peer string)
+	// PeerDisconnected is called when a connected peer left or could not
+	// be reached
+	PeerDisconnected func(peer string)
+	// Synced is called once the operations a peer had when we synchronized
+	// with it have been applied
+	Synced func(peer string)
+	// PluginMessage is called when a peer sent a message to a plugin
+	PluginMessage func(m PluginMessage)
+	// Setting is called when a peer changed a setting of the document
+	Setting func(st Setting)
+	// Claim is called when a peer claimed a range or released a claim
+	Claim func(c Claim)
+	// StorageError is called when the document, its operations or its
+	// history could not be written
+	StorageError func(err error)
+}
+
+// Session is a document shared with other peers. Every shared document has its
+// own document ID, sequence vector, peer table and storage, so that several files
+// can be collaborated on at the same time.
+type Session struct {
+	// DocID identifies the document among the peers
+	DocID string
+
+	host  *Host
+	doc   crdt.Sequence
+	store Store
+	cb    Callbacks
+
+	// docMu protects the document, and whatever the consumer keeps in
+	// sync with it (the text of a buffer for instance)
+	docMu sync.Mutex
+	// early holds the positions deleted by a peer before we received
+	// their insertion, protected by docMu
+	early map[string]bool
+	// deleted holds the positions deleted, by us or by the peers, so that
+	// a reconciliation only deletes what one of the peers did, protected
+	// by docMu
+	deleted map[string]bool
+	// deferred holds the insertions of peers which refer to atoms we have
+	// not received yet, see Sequence.Ready, protected by docMu
+	deferred []crdt.Operation
+
+	// seqVector keeps the last clock received from each peer, including ourselves
+	seqVector map[string]*seqVEntry
+	// stored keeps the clocks of the sequence vector written to storage,
+	// which the peers are acknowledged with
+	stored map[string]uint64
+	// acks keeps the last clock of ours each peer has stored
+	acks map[string]uint64
+	// protects stored and acks, which the storage writer updates
+	storedMu sync.Mutex
+
+	// peers holds the RPC clients of the connected peers, nil if disconnected
+	peers map[string]*rpc.Client
+	// outboxes send our operations to the connected peers
+	outboxes map[string]*outbox
+	// received counts the operations applied from each peer
+	received map[string]uint64
+	// lastErr keeps the last error talking to each peer
+	lastErr map[string]string
+	// repaired counts the atoms deleted by reconciling with each peer
+	repaired map[string]uint64
+
+	// roles of the peers, including ourselves
+	roles map[string]Role
+	// owner is the peer who shared the document
+	owner string
+	// joinRole is the role given to peers joining the session
+	joinRole Role
+
+	// presence of the peers, protected by mu
+	presence map[string]Presence
+	// comments of the document indexed by ID, protected by mu
+	comments map[string]Comment
+	// settings of the document indexed by name, protected by mu
+	settings map[string]Setting
+	// claims of the peers indexed by ID, released ones included,
+	// protected by mu
+	claims map[string]Claim
+	// last presence sent to the peers
+	lastSent Presence
+	// site of the identifiers we generate, unique among the peers
+	site uint8
+	// sites of the peers, which tell who inserted an atom, protected by mu
+	sites map[uint8]string
+	// clocks of the peers we wait for to be in sync, see awaitSync,
+	// protected by mu
+	syncing map[string]uint64
+
+	// protects seqVector, peers, outboxes, received, lastErr, repaired and roles
+	mu sync.Mutex
+
+	// storage writes are executed in order by a single goroutine
+	writes chan func()
+	done   chan bool
+	closed bool // protected by mu
+}
+
+// newSession opens the storage of the document, a sequence of the given
+// kind, and starts the storage writer
+func (h *Host) newSession(docID, kind string) (*Session, error) {
+	store, err := openStore(h.store, h.storageDir(docID, kind))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		DocID:     docID,
+		host:      h,
+		store:     store,
+		early:     make(map[string]bool),
+		deleted:   make(map[string]bool),
+		seqVector: make(map[string]*seqVEntry),
+		stored:    make(map[string]uint64),
+		acks:      make(map[string]uint64),
+		peers:     make(map[string]*rpc.Client),
+		outboxes:  make(map[string]*outbox),
+		received:  make(map[string]uint64),
+		lastErr:   make(map[string]string),
+		repaired:  make(map[string]uint64),
+		roles:     make(map[string]Role),
+		joinRole:  RoleEditor,
+		presence:  make(map[string]Presence),
+		comments:  make(map[string]Comment),
+		settings:  make(map[string]Setting),
+		claims:    make(map[string]Claim),
+		lastSent:  Presence{Line: -1},
+		sites:     make(map[uint8]string),
+		syncing:   make(map[string]uint64),
+		writes:    make(chan func(), 1024),
+		done:      make(chan bool),
+	}
+
+	s.loadComments()
+
+	go func() {
+		for f := range s.writes {
+			f()
+		}
+		s.done <- true
+	}()
+
+	return s, nil
+}
+
+// Serve sets the callbacks of the session and lets the peers reach it
+func (s *Session) Serve(cb Callbacks) {
+	// the storage writer reads the callbacks once the writes queued so
+	// far are done
+	s.flush()
+	s.cb = cb
+
+	s.docMu.Lock()
+	s.traceStart()
+	s.docMu.Unlock()
+
+	s.host.mu.Lock()
+	s.host.sessions[s.DocID] = s
+	s.host.mu.Unlock()
+}
+
+// Share starts sharing the document under the given document ID. The host
+// must be listening already.
+// If the storage of the document matches its content, the stored document
+// and sequence vector are reused so that peers which already know the
+// document only need to exchange the missing operations. The returned flag
+// tells whether this happened, in which case Document returns the stored one.
+// The peers reach the session once Serve is called
+func (h *Host) Share(docID string, doc crdt.Sequence) (*Session, bool, error) {
+	if h.listener == nil {
+		return nil, false, errors.New("not listening for peers")
+	}
+	if h.GetSession(docID) != nil {
+		return nil, false, errors.New("a document named " + docID + " is already shared")
+	}
+
+	s, err := h.newSession(docID, doc.Kind())
+	if err != nil {
+		return nil, false, err
+	}
+
+	// we start the session, our site is free
+	s.site = siteOf(h.addr)
+	s.sites[s.site] = h.addr
+
+	resumed := false
+	stored, _ := crdt.NewSequence(doc.Kind(), s.site, "")
+	s.store.LoadDocument(stored)
+	if stored.Content() == doc.Content() {
+		s.doc = stored
+		s.loadSeqVector()
+		// the peers which joined before keep their sites
+		s.loadSites()
+		resumed = true
+	} else {
+		// the file has changed since it was last shared, start from scratch
+		doc.SetSite(s.site)
+		s.doc = doc
+		err := s.store.SaveDocument(doc)
+		if err == nil {
+			err = s.store.ResetOps()
+		}
+		if err == nil {
+			err = s.store.ResetClocks()
+		}
+		if err == nil {
+			err = s.store.ResetUndo()
+		}
+		if err != nil {
+			s.close()
+			return nil, false, err
+		}
+		s.seqVector[h.addr] = &seqVEntry{0, true}
+	}
+	s.doc.SetStorage(docStorage{s})
+	s.owner = h.addr
+	s.roles[h.addr] = RoleOwner
+
+	return s, resumed, nil
+}
+
+// Join prepares the document shared by the peer at addr. If docID is empty,
+// the peer must share exactly one document. The host must be listening already.
+// The session is connected to the peer with Connect, after Serve
+func (h *Host) Join(addr, docID string) (*Session, error) {
+	if h.listener == nil {
+		return nil, errors.New("not listening for peers")
+	}
+
+	client, err := h.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	if docID == "" {
+		var reply ListDocsReply
+		if err := callPeer(client, "EntangleClient.ListDocs", ValReply{}, &reply); err != nil {
+			return nil, err
+		}
+		switch len(reply.DocIDs) {
+		case 0:
+			return nil, errors.New(addr + " does not share any document")
+		case 1:
+			docID = reply.DocIDs[0]
+		default:
+			return nil, errors.New(addr + " shares several documents: " + strings.Join(reply.DocIDs, ", "))
+		}
+	}
+
+	if h.GetSession(docID) != nil {
+		return nil, errors.New(docID + " is already shared")
+	}
+
+	// the sequence is the one of the peer, and so is its storage. The peer
+	// gives us a site no other peer it knows of has
+	var kind SequenceReply
+	args := SnapshotArgs{
+		DocID:    docID,
+		Clientid: h.addr,
+	}
+	if err := callPeer(client, "EntangleClient.Sequence", args, &kind); err != nil {
+		return nil, err
+	}
+	if kind.Site == 0 {
+		return nil, errors.New(addr + " gave us no site")
+	}
+	doc, err := crdt.NewSequence(kind.Kind, kind.Site, "")
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := h.newSession(docID, kind.Kind)
+	if err != nil {
+		return nil, err
+	}
+	s.site = kind.Site
+	s.learnSites(kind.Sites)
+
+	s.store.LoadDocument(doc)
+	if len(doc.Atoms()) > 0 {
+		// we have been part of this session before, the pair-wise
+		// synchronization will bring in what we have missed
+		s.loadSeqVector()
+		s.loadSites()
+	} else {
+		var reply SnapshotReply
+		if err := callPeer(client, "EntangleClient.Snapshot", args, &reply); err != nil {
+			s.close()
+			return nil, err
+		}
+
+		for _, op := range reply.Patch {
+			doc.InsertPos(crdt.NewPos(op.Pos), op.Atom, 0)
+		}
+		if err := s.store.SaveDocument(doc); err != nil {
+			s.close()
+			return nil, err
+		}
+
+		for peer, clock := range reply.Clocks {
+			s.seqVector[peer] = &seqVEntry{clock, true}
+		}
+		// our own operations may have been logged before the storage was lost
+		if last := s.store.LastClock(); s.clock(h.addr) < last {
+			s.seqVector[h.addr] = &seqVEntry{last, true}
+		} else if _, ok := s.seqVector[h.addr]; !ok {
+			s.seqVector[h.addr] = &seqVEntry{0, true}
+		}
+	}
+	s.doc = doc
+	s.doc.SetStorage(docStorage{s})
+
+	return s, nil
+}
+
+// Document returns the shared document. It must only be used with the document locked
+func (s *Session) Document() crdt.Sequence {
+	return s.doc
+}
+
+// Lock locks the document, so that the peers cannot change it
+func (s *Session) Lock() {
+	s.docMu.Lock()
+}
+
+// Unlock unlocks the document
+func (s *Session) Unlock() {
+	s.docMu.Unlock()
+}
+
+// LocalAddr returns our own ip:port
+func (s *Session) LocalAddr() string {
+	return s.host.addr
+}
+
+// Unshare disconnects from all peers and stops sharing the buffer
+func (s *Session) Unshare() {
+	s.mu.Lock()
+	clients := make([]*rpc.Client, 0, len(s.peers))
+	for peer, client := range s.peers {
+		if client != nil {
+			clients = append(clients, client)
+		}
+		s.peers[peer] = nil
+	}
+	for peer, o := range s.outboxes {
+		o.close()
+		delete(s.outboxes, peer)
+	}
+	s.mu.Unlock()
+
+	s.host.mu.Lock()
+	delete(s.host.sessions, s.DocID)
+	s.host.mu.Unlock()
+
+	args := DisconnectArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+	}
+	for _, client := range clients {
+		var reply ValReply
+		callPeer(client, "EntangleClient.Disconnect", args, &reply)
+		client.Close()
+	}
+
+	s.saveSeqVector()
+	s.close()
+}
+
+// close waits for the pending storage writes and closes the storage
+func (s *Session) close() {
+	s.mu.Lock()
+	s.closed = true
+	close(s.writes)
+	s.mu.Unlock()
+
+	<-s.done
+	s.store.Close()
+}
+
+// saveSeqVector writes the entries of the sequence vector which changed
+// since the last time to storage. The write is queued after the pending
+// ones, so that a stored clock never gets ahead of the stored operations
+func (s *Session) saveSeqVector() {
+	s.mu.Lock()
+	s.storedMu.Lock()
+	dirty := make(map[string]uint64)
+	for peer, e := range s.seqVector {
+		// entries whose last write failed are written again
+		if e.Dirty || e.Clock > s.stored[peer] { // do not update unchanged entry
+			dirty[peer] = e.Clock
+			e.Dirty = false // clear flag
+		}
+	}
+	s.storedMu.Unlock()
+	s.mu.Unlock()
+	if len(dirty) == 0 {
+		return
+	}
+
+	s.persist(func() {
+		if err := s.store.SaveClocks(dirty); err != nil {
+			s.storageError(err)
+			return
+		}
+		s.storedMu.Lock()
+		defer s.storedMu.Unlock()
+		for peer, clock := range dirty {
+			if clock > s.stored[peer] {
+				s.stored[peer] = clock
+			}
+		}
+	})
+}
+
+// storedClocks returns a copy of the sequence vector as written to storage
+func (s *Session) storedClocks() map[string]uint64 {
+	s.storedMu.Lock()
+	defer s.storedMu.Unlock()
+	c := make(map[string]uint64, len(s.stored))
+	for peer, clock := range s.stored {
+		c[peer] = clock
+	}
+	return c
+}
+
+// storedClock returns the clock of the peer written to storage
+func (s *Session) storedClock(peer string) uint64 {
+	s.storedMu.Lock()
+	defer s.storedMu.Unlock()
+	return s.stored[peer]
+}
+
+// ack records that the peer has stored our operations up to clock
+func (s *Session) ack(peer string, clock uint64) {
+	s.storedMu.Lock()
+	if clock <= s.acks[peer] {
+		s.storedMu.Unlock()
+		return
+	}
+	s.acks[peer] = clock
+	s.storedMu.Unlock()
+
+	s.persist(func() {
+		s.storageError(s.store.SaveAcks(map[string]uint64{peer: clock}))
+	})
+}
+
+// acked returns the last clock of ours the peer has stored
+func (s *Session) acked(peer string) uint64 {
+	s.storedMu.Lock()
+	defer s.storedMu.Unlock()
+	return s.acks[peer]
+}
+
+// Compact drops the logged operations every known peer has stored, since
+// they are never sent again: a peer reconnecting asks for the ones after
+// the clock it has stored. The last operation is kept, so that our clock
+// can still be recovered from the ops. It returns the clock up to which
+// operations are dropped, 0 if none are
+func (s *Session) Compact() uint64 {
+	s.mu.Lock()
+	var peers []string
+	for peer := range s.seqVector {
+		if peer != s.host.addr {
+			peers = append(peers, peer)
+		}
+	}
+	s.mu.Unlock()
+	if len(peers) == 0 {
+		return 0
+	}
+
+	safe := s.clock(s.host.addr)
+	if safe > 0 {
+		safe--
+	}
+	for _, peer := range peers {
+		if a := s.acked(peer); a < safe {
+			safe = a
+		}
+	}
+	if safe == 0 {
+		return 0
+	}
+	s.persist(func() {
+		s.storageError(s.store.DropOps(safe))
+	})
+	return safe
+}
+
+// loadSeqVector loads the stored sequence vector and acknowledgements. Our own clock is
+// recovered from the ops if the sequence vector was not saved after the
+// last ones were logged.
+// This is called once when a document starts being shared
+func (s *Session) loadSeqVector() {
+	for peer, clock := range s.store.LoadClocks() {
+		s.seqVector[peer] = &seqVEntry{clock, false}
+		s.stored[peer] = clock
+	}
+	s.acks = s.store.LoadAcks()
+
+	last := s.store.LastClock()
+	if e, ok := s.seqVector[s.host.addr]; !ok || last > e.Clock {
+		s.seqVector[s.host.addr] = &seqVEntry{last, true}
+	}
+}
+
+// persist queues a storage write. Writes are dropped once the session is
+// closed, in which case false is returned
+func (s *Session) persist(f func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.writes <- f
+	return true
+}
+
+// flush waits for the storage writes queued so far
+func (s *Session) flush() {
+	done := make(chan bool, 1)
+	if s.persist(func() { done <- true }) {
+		<-done
+	}
+}
+
+// clock returns the last clock received from the peer
+func (s *Session) clock(peer string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.seqVector[peer]; ok {
+		return e.Clock
+	}
+	return 0
+}
+
+// updateClock records that the operations of the peer up to clock have been applied
+func (s *Session) updateClock(peer string, clock uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.seqVector[peer]
+	if !ok {
+		s.seqVector[peer] = &seqVEntry{clock, true}
+	} else if clock > e.Clock {
+		e.Clock = clock
+		e.Dirty = true
+	}
+}
+
+// clocks returns a copy of the sequence vector
+func (s *Session) clocks() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := make(map[string]uint64, len(s.seqVector))
+	for peer, e := range s.seqVector {
+		c[peer] = e.Clock
+	}
+	return c
+}
+
+// KnowPeer adds the peer to the sequence vector if it is not there yet
+func (s *Session) KnowPeer(peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seqVector[peer]; !ok {
+		s.seqVector[peer] = &seqVEntry{0, true}
+	}
+}
+
+// addPeer sets the RPC client of a connected peer
+func (s *Session) addPeer(peer string, client *rpc.Client) {
+	s.KnowPeer(peer)
+
+	s.mu.Lock()
+	if old := s.peers[peer]; old != nil {
+		old.Close()
+	}
+	s.peers[peer] = client
+	if old := s.outboxes[peer]; old != nil {
+		old.close()
+	}
+	// nothing is sent before the pair-wise synchronization
+	s.outboxes[peer] = newOutbox(s, peer, client)
+	// the new peer does not know where we are yet
+	s.lastSent = Presence{Line: -1}
+	s.mu.Unlock()
+
+	if s.cb.PeerConnected != nil {
+		s.cb.PeerConnected(peer)
+	}
+}
+
+// removePeer marks the peer as disconnected
+func (s *Session) removePeer(peer string) {
+	s.mu.Lock()
+	client := s.peers[peer]
+	if client != nil {
+		client.Close()
+	}
+	s.peers[peer] = nil
+	if o := s.outboxes[peer]; o != nil {
+		o.close()
+		delete(s.outboxes, peer)
+	}
+	delete(s.presence, peer)
+	delete(s.syncing, peer)
+	s.mu.Unlock()
+
+	if client != nil {
+		s.disconnected(peer)
+	}
+}
+
+// dropClient marks the peer as disconnected if client is still its RPC
+// client, after the given error
+func (s *Session) dropClient(peer string, client *rpc.Client, err error) {
+	s.mu.Lock()
+	dropped := s.peers[peer] == client
+	if dropped {
+		s.lastErr[peer] = err.Error()
+		client.Close()
+		s.peers[peer] = nil
+		if o := s.outboxes[peer]; o != nil {
+			o.close()
+			delete(s.outboxes, peer)
+		}
+		delete(s.presence, peer)
+		delete(s.syncing, peer)
+	}
+	s.mu.Unlock()
+
+	if dropped {
+		s.disconnected(peer)
+	}
+}
+
+// disconnected tells the consumer that a connected peer is gone, and drops
+// its claims
+func (s *Session) disconnected(peer string) {
+	s.expireClaims(peer)
+	if s.cb.PeerDisconnected != nil {
+		s.cb.PeerDisconnected(peer)
+	}
+}
+
+// failed records the last error talking to the peer
+func (s *Session) failed(peer string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr[peer] = err.Error()
+}
+
+// connectedPeers returns the addresses of the connected peers
+func (s *Session) connectedPeers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var peers []string
+	for peer, client := range s.peers {
+		if client != nil {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// isConnected returns whether the peer is connected
+func (s *Session) isConnected(peer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peers[peer] != nil
+}
+
+// IsOffline returns true if the session is not connected to any peer
+func (s *Session) IsOffline() bool {
+	return len(s.connectedPeers()) == 0
+}
+
+// applyPatch applies operations received from a peer and advances its clock.
+// Operations from peers without edit rights are rejected
+func (s *Session) applyPatch(peer string, patch []crdt.Operation) error {
+	if len(patch) == 0 {
+		return nil
+	}
+	if !s.CanEdit(peer) {
+		return errors.New(peer + " is not allowed to edit " + s.DocID)
+	}
+	if err := s.checkAuthor(peer, patch); err != nil {
+		return err
+	}
+
+	s.docMu.Lock()
+	// the operations of a peer come in clock order, skip the ones we have
+	// already, e.g. sent again after a reconnection
+	known := s.clock(peer)
+	for len(patch) > 0 && patch[0].Clock <= known {
+		patch = patch[1:]
+	}
+	if len(patch) == 0 {
+		s.docMu.Unlock()
+		return nil
+	}
+	s.insertPatch(patch)
+	// update seqVector based on the last operation from the patch.
+	// assuming patch contains in increasing clock values.
+	// This is done with the document locked so that a snapshot never sees
+	// the operations without the clock that goes with them
+	s.updateClock(peer, patch[len(patch)-1].Clock)
+	s.trace(TraceRemote, peer, patch, nil)
+	s.docMu.Unlock()
+
+	s.mu.Lock()
+	s.received[peer] += uint64(len(patch))
+	s.mu.Unlock()
+
+	if s.cb.Applied != nil {
+		s.cb.Applied(peer, patch)
+	}
+	s.checkSynced(peer)
+	return nil
+}
+
+// changed tells the consumer that the peers, their roles or their presence changed
+func (s *Session) changed() {
+	if s.cb.Changed != nil {
+		s.cb.Changed()
+	}
+}
+
+// Insert inserts text at index (counted in runes, starting from 0), and
+// sends it to the peers. The returned operations refer to the inserted atoms
+// Pre: the document is locked
+func (s *Session) Insert(index int, text string) []crdt.Operation {
+	inserted, _ := s.doc.InsertMultiple(s.doc.Pos(index), text)
+	return s.localOps(inserted, true)
+}
+
+// Delete deletes the runes from start up to end (not including end), and
+// sends the deletions to the peers
+// Pre: the document is locked
+func (s *Session) Delete(start, end int) []crdt.Operation {
+	deleted := s.doc.DeleteMultiple(start+1, end+1) // shift by one for Start
+	return s.localOps(deleted, false)
+}
+
+// localOps logs and broadcasts pairs that have been inserted (or deleted)
+// locally. Every pair gets its own clock value.
+// Pre: the document is locked
+func (s *Session) localOps(pairs []crdt.Pair, insert bool) []crdt.Operation {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	if !insert {
+		for _, p := range pairs {
+			s.deleted[string(crdt.PosBytes(p.Pos))] = true
+		}
+	}
+	ops := crdt.Operations(pairs, insert)
+	s.mu.Lock()
+	// Do not actually need to lock the clock increment because local inserts are serialized
+	entry := s.seqVector[s.host.addr]
+	for i := range ops {
+		entry.Clock++
+		ops[i].Clock = entry.Clock
+	}
+	entry.Dirty = true
+	s.mu.Unlock()
+	s.trace(TraceLocal, s.host.addr, ops, nil)
+
+	// write operations to local storage, the document stores its atoms
+	s.persist(func() {
+		for _, op := range ops {
+			s.storageError(s.store.AppendOp(op))
+		}
+	})
+
+	s.broadcast(ops)
+	return ops
+}
+
+// docStorage writes the changes of the atoms of the document to the
+// storage of the session, through the storage writer
+type docStorage struct {
+	s *Session
+}
+
+func (st docStorage) NextAtomID() uint64 {
+	return st.s.store.NextAtomID()
+}
+
+func (st docStorage) PutAtom(id uint64, atom string, pos []crdt.Identifier) {
+	st.s.persist(func() {
+		st.s.storageError(st.s.store.PutAtom(id, atom, pos))
+	})
+}
+
+func (st docStorage) DeleteAtom(id uint64) {
+	st.s.persist(func() {
+		st.s.storageError(st.s.store.DeleteAtom(id))
+	})
+}
+
+// broadcast queues operations for every connected peer. A peer that fails
+// to take them in time is considered disconnected.
+func (s *Session) broadcast(ops []crdt.Operation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.outboxes {
+		o.enqueue(ops)
+	}
+}
+
+// startOutbox starts sending our operations to the peer, from the ones
+// following acked, the last clock of ours the peer has
+func (s *Session) startOutbox(peer string, acked uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o := s.outboxes[peer]; o != nil {
+		o.start(acked)
+	}
+}
+
+// NetStats describes the connections to the peers of the session, including
+// the known peers which are not connected, ordered by address
+func (s *Session) NetStats() []PeerStats {
+	s.mu.Lock()
+	var stats []PeerStats
+	var outboxes []*outbox
+	for peer := range s.seqVector {
+		if peer == s.host.addr {
+			continue
+		}
+		if o := s.outboxes[peer]; o != nil {
+			outboxes = append(outboxes, o)
+		} else {
+			stats = append(stats, PeerStats{Peer: peer})
+		}
+	}
+	s.mu.Unlock()
+
+	for _, o := range outboxes {
+		stats = append(stats, o.stats())
+	}
+	s.mu.Lock()
+	for i := range stats {
+		peer := stats[i].Peer
+		if e := s.seqVector[peer]; e != nil {
+			stats[i].Clock = e.Clock
+		}
+		stats[i].Received = s.received[peer]
+		stats[i].LastError = s.lastErr[peer]
+		stats[i].Repaired = s.repaired[peer]
+	}
+	s.mu.Unlock()
+	for i := range stats {
+		stats[i].Acked = s.acked(stats[i].Peer)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Peer < stats[j].Peer })
+	return stats
+}
+
+// Version returns the sequence vector the document corresponds to
+// Pre: the document is locked
+func (s *Session) Version() map[string]uint64 {
+	return s.clocks()
+}
+
+// Unsynced returns the known peers whose document may differ from ours: the
+// disconnected ones, and the connected ones which have not accepted all
+// our operations yet. It may be called with the document locked, so that
+// it goes with a snapshot of the document
+func (s *Session) Unsynced() []string {
+	own := s.clock(s.host.addr)
+	var peers []string
+	for _, st := range s.NetStats() {
+		if !st.Connected || st.Delivered < own {
+			peers = append(peers, st.Peer)
+		}
+	}
+	return peers
+}
+
+// Synced returns whether every known peer is connected and has accepted
+// all our operations
+func (s *Session) Synced() bool {
+	return len(s.Unsynced()) == 0
+}
+
+// OperationsByClock returns our logged operations with the given clocks, indexed by clock
+func (s *Session) OperationsByClock(clocks []uint64) map[uint64]crdt.Operation {
+	ops := make(map[uint64]crdt.Operation, len(clocks))
+	if len(clocks) == 0 {
+		return ops
+	}
+
+	min, max := clocks[0], clocks[0]
+	for _, c := range clocks {
+		if c < min {
+			min = c
+		}
+		if c > max {
+			max = c
+		}
+	}
+
+	wanted := make(map[uint64]bool, len(clocks))
+	for _, c := range clocks {
+		wanted[c] = true
+	}
+	for _, op := range s.store.Ops(min, max) {
+		if wanted[op.Clock] {
+			ops[op.Clock] = op
+		}
+	}
+	return ops
+}
+
+// SaveUndo stores the undo history of the document, as encoded by the consumer
+func (s *Session) SaveUndo(data []byte) error {
+	errc := make(chan error, 1)
+	if !s.persist(func() { errc <- s.store.SaveUndo(data) }) {
+		return errors.New("the session is closed")
+	}
+	return <-errc
+}
+
+// LoadUndo returns the stored undo history, nil if there is none
+func (s *Session) LoadUndo() []byte {
+	return s.store.LoadUndo()
+}
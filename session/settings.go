@@ -0,0 +1,141 @@
+package session
+
+import (
+	"net/rpc"
+	"sort"
+	"time"
+)
+
+// Some settings of a document, like the size of tabs, must be the same for
+// every peer or the text would be indented differently depending on who
+// typed it. Each of them is a register where the last change wins. Peers
+// send their changes to the peers they are connected to, and exchange all
+// the registers when they connect. Only editors change them.
+
+// settingSkew is how far ahead of our clock the time of a change may be.
+// A change made later than that would win over every change until then
+const settingSkew = time.Hour
+
+// Setting is the value of a setting of the document, as text
+type Setting struct {
+	Name  string
+	Value string
+	Time  time.Time // of the last change, zero for an initial value
+	From  string    // ip:port of the peer who made the last change
+}
+
+// newer returns whether st is a later change of the setting than o
+func (st Setting) newer(o Setting) bool {
+	if !st.Time.Equal(o.Time) {
+		return st.Time.After(o.Time)
+	}
+	return st.From > o.From
+}
+
+// Settings returns the settings of the document, in the order of their names
+func (s *Session) Settings() []Setting {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]Setting, 0, len(s.settings))
+	for _, st := range s.settings {
+		all = append(all, st)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// InitSetting gives a setting its initial value, which any change made by
+// a peer overrides. It does nothing if the setting has a value already
+func (s *Session) InitSetting(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.settings[name]; !ok {
+		s.settings[name] = Setting{Name: name, Value: value, From: s.host.addr}
+	}
+}
+
+// SetSetting changes a setting of the document and sends it to the peers.
+// Nothing is sent if the setting has the value already, so that applying
+// the change of a peer does not send it back. The change of a viewer is
+// its own, the setting of the document stays as it is
+func (s *Session) SetSetting(name, value string) Setting {
+	editor := s.CanEdit(s.host.addr)
+	s.mu.Lock()
+	old, ok := s.settings[name]
+	if ok && old.Value == value || !editor {
+		s.mu.Unlock()
+		return old
+	}
+	st := Setting{Name: name, Value: value, Time: time.Now(), From: s.host.addr}
+	if ok && !st.newer(old) {
+		// our clock is behind the peer which made the last change
+		st.Time = old.Time.Add(time.Nanosecond)
+	}
+	s.settings[name] = st
+
+	args := SettingsArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Settings: []Setting{st},
+	}
+	for peer, client := range s.peers {
+		if client == nil {
+			continue
+		}
+		go func(peer string, client *rpc.Client) {
+			var reply SettingsReply
+			if err := callPeer(client, "EntangleClient.Settings", args, &reply); err != nil {
+				s.dropClient(peer, client, err)
+			}
+		}(peer, client)
+	}
+	s.mu.Unlock()
+	return st
+}
+
+// receiveSettings keeps the settings of a peer which are newer than ours,
+// and hands them to the consumer. Nothing is taken from a viewer, nor the
+// changes said to come from a peer which is not an editor or to be made
+// too far in the future
+func (s *Session) receiveSettings(peer string, settings []Setting) {
+	if !s.CanEdit(peer) {
+		return
+	}
+	var changed []Setting
+	limit := time.Now().Add(settingSkew)
+	s.mu.Lock()
+	for _, st := range settings {
+		if r, ok := s.roles[st.From]; !ok || !r.CanEdit() || st.Time.After(limit) {
+			continue
+		}
+		if old, ok := s.settings[st.Name]; ok && !st.newer(old) {
+			continue
+		}
+		s.settings[st.Name] = st
+		changed = append(changed, st)
+	}
+	s.mu.Unlock()
+
+	if s.cb.Setting == nil {
+		return
+	}
+	for _, st := range changed {
+		s.cb.Setting(st)
+	}
+}
+
+// exchangeSettings sends the peer our settings and keeps the newer ones it
+// returns, so that the changes made while disconnected are not lost
+func (s *Session) exchangeSettings(peer string, client *rpc.Client) {
+	args := SettingsArgs{
+		DocID:    s.DocID,
+		Clientid: s.host.addr,
+		Settings: s.Settings(),
+	}
+	var reply SettingsReply
+	if err := callPeer(client, "EntangleClient.Settings", args, &reply); err != nil {
+		s.failed(peer, err)
+		return
+	}
+	s.receiveSettings(peer, reply.Settings)
+}
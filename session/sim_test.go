@@ -0,0 +1,1338 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// memNetwork connects the simulated peers in memory. It can be split into
+// partitions, and held so that nothing is delivered until it is released
+type memNetwork struct {
+	mu        sync.Mutex
+	released  *sync.Cond
+	listeners map[string]*memListener
+	group     map[string]int // partition of each address, 0 when healed
+	conns     []*memConn
+	held      bool
+}
+
+func newMemNetwork() *memNetwork {
+	nw := &memNetwork{
+		listeners: make(map[string]*memListener),
+		group:     make(map[string]int),
+	}
+	nw.released = sync.NewCond(&nw.mu)
+	return nw
+}
+
+// transport returns the transport used by the peer at addr
+func (nw *memNetwork) transport(addr string) Transport {
+	return &memTransport{nw, addr}
+}
+
+// reachable returns whether the two peers are in the same partition
+func (nw *memNetwork) reachable(a, b string) bool {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	return nw.group[a] == nw.group[b]
+}
+
+// partition splits the network, every group of addresses only reaching
+// itself. The connections between the groups are closed
+func (nw *memNetwork) partition(groups ...[]string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	for i, g := range groups {
+		for _, addr := range g {
+			nw.group[addr] = i + 1
+		}
+	}
+	open := nw.conns[:0]
+	for _, c := range nw.conns {
+		if nw.group[c.local] != nw.group[c.remote] {
+			c.Conn.Close()
+		} else {
+			open = append(open, c)
+		}
+	}
+	nw.conns = open
+}
+
+// heal lets every peer reach every other peer again
+func (nw *memNetwork) heal() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.group = make(map[string]int)
+}
+
+// hold stops delivering anything until release is called. Writes block,
+// as if the messages were stuck on the wire
+func (nw *memNetwork) hold() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.held = true
+}
+
+func (nw *memNetwork) release() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.held = false
+	nw.released.Broadcast()
+}
+
+type memTransport struct {
+	nw   *memNetwork
+	addr string
+}
+
+func (t *memTransport) Listen(addr string) (net.Listener, error) {
+	t.nw.mu.Lock()
+	defer t.nw.mu.Unlock()
+	if _, ok := t.nw.listeners[addr]; ok {
+		return nil, errors.New(addr + " already in use")
+	}
+	l := &memListener{
+		nw:    t.nw,
+		addr:  memAddr(addr),
+		conns: make(chan net.Conn),
+		done:  make(chan bool),
+	}
+	t.nw.listeners[addr] = l
+	return l, nil
+}
+
+func (t *memTransport) Dial(addr string) (net.Conn, error) {
+	t.nw.mu.Lock()
+	l, ok := t.nw.listeners[addr]
+	if !ok || t.nw.group[t.addr] != t.nw.group[addr] {
+		t.nw.mu.Unlock()
+		return nil, errors.New("dial " + addr + ": unreachable")
+	}
+	client, server := net.Pipe()
+	c := &memConn{client, t.nw, t.addr, addr}
+	sc := &memConn{server, t.nw, addr, t.addr}
+	t.nw.conns = append(t.nw.conns, c, sc)
+	t.nw.mu.Unlock()
+
+	select {
+	case l.conns <- sc:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("dial " + addr + ": connection refused")
+	}
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	nw    *memNetwork
+	addr  memAddr
+	conns chan net.Conn
+	done  chan bool
+	once  sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		l.nw.mu.Lock()
+		delete(l.nw.listeners, string(l.addr))
+		l.nw.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memConn is one end of a connection between two peers
+type memConn struct {
+	net.Conn
+	nw     *memNetwork
+	local  string
+	remote string
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	c.nw.mu.Lock()
+	for c.nw.held {
+		c.nw.released.Wait()
+	}
+	c.nw.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// simPeer is one of the peers of a simulation. Peers are headless: they
+// edit the document of their session directly
+type simPeer struct {
+	addr    string
+	host    *Host
+	session *Session
+}
+
+// insert inserts text at the given atom index
+func (p *simPeer) insert(index int, text string) {
+	p.session.Lock()
+	defer p.session.Unlock()
+	p.session.Insert(index, text)
+}
+
+// delete deletes the atoms from start up to end
+func (p *simPeer) delete(start, end int) {
+	p.session.Lock()
+	defer p.session.Unlock()
+	p.session.Delete(start, end)
+}
+
+// content returns the text of the document
+func (p *simPeer) content() string {
+	p.session.Lock()
+	defer p.session.Unlock()
+	return p.session.Document().Content()
+}
+
+// simulation runs several peers sharing one document in the same process
+type simulation struct {
+	t     *testing.T
+	rand  *rand.Rand
+	nw    *memNetwork
+	peers []*simPeer
+	dir   string
+}
+
+// newSimulation shares a document with the given content from the first of
+// n peers, the others join it. The storage lives in a temporary directory
+func newSimulation(t *testing.T, n int, seed int64, content string) *simulation {
+	return newSimulationOf(t, crdt.Logoot, n, seed, content)
+}
+
+// newSimulationOf is newSimulation with a document of the given kind of sequence
+func newSimulationOf(t *testing.T, kind string, n int, seed int64, content string) *simulation {
+	doc, err := crdt.NewSequence(kind, 0, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "micro-sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim := &simulation{
+		t:    t,
+		rand: rand.New(rand.NewSource(seed)),
+		nw:   newMemNetwork(),
+		dir:  dir,
+	}
+	// the position identifiers are drawn from the global source
+	rand.Seed(seed)
+
+	for i := 0; i < n; i++ {
+		// the peers use the same port, as hosts on a LAN do
+		addr := fmt.Sprintf("10.0.0.%d:7000", i+1)
+		p := &simPeer{addr: addr, host: NewHost(sim.nw.transport(addr), dir)}
+		p.host.SetStore("memory")
+		if err := p.host.Listen(addr); err != nil {
+			t.Fatal(err)
+		}
+		sim.peers = append(sim.peers, p)
+	}
+
+	first := sim.peers[0]
+	if first.session, _, err = first.host.Share("sim.txt", doc); err != nil {
+		t.Fatal(err)
+	}
+	first.session.Serve(Callbacks{})
+	for _, p := range sim.peers[1:] {
+		if p.session, err = p.host.Join(first.addr, "sim.txt"); err != nil {
+			t.Fatal(err)
+		}
+		p.session.Serve(Callbacks{})
+		if err := p.session.Connect(first.addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sim.settle()
+	return sim
+}
+
+// close stops every peer and removes the storage
+func (sim *simulation) close() {
+	for _, p := range sim.peers {
+		p.host.Close()
+	}
+	os.RemoveAll(sim.dir)
+}
+
+// round lets every peer make one edit while the network is held, so that
+// all the edits are concurrent, and waits for them to be delivered
+func (sim *simulation) round(edit func(p *simPeer)) {
+	sim.nw.hold()
+	for _, p := range sim.peers {
+		edit(p)
+	}
+	sim.nw.release()
+	sim.settle()
+}
+
+// randomEdit inserts a few characters, or removes a few, at a random place
+func (sim *simulation) randomEdit(p *simPeer) {
+	p.session.Lock()
+	n := p.session.Document().Len()
+	p.session.Unlock()
+	if n > 0 && sim.rand.Intn(3) == 0 {
+		start := sim.rand.Intn(n)
+		end := start + 1 + sim.rand.Intn(n-start)
+		if end > start+3 {
+			end = start + 3
+		}
+		p.delete(start, end)
+		return
+	}
+
+	alphabet := []rune("abcé \n")
+	text := make([]rune, 1+sim.rand.Intn(4))
+	for i := range text {
+		text[i] = alphabet[sim.rand.Intn(len(alphabet))]
+	}
+	p.insert(sim.rand.Intn(n+1), string(text))
+}
+
+// partition splits the peers into the given groups of indices
+func (sim *simulation) partition(groups ...[]int) {
+	addrs := make([][]string, len(groups))
+	for i, g := range groups {
+		for _, j := range g {
+			addrs[i] = append(addrs[i], sim.peers[j].addr)
+		}
+	}
+	sim.nw.partition(addrs...)
+}
+
+// heal reconnects the peers which could not reach each other, which runs
+// the pair-wise synchronization between them
+func (sim *simulation) heal() {
+	var split [][2]*simPeer
+	for i, p := range sim.peers {
+		for _, q := range sim.peers[i+1:] {
+			if !sim.nw.reachable(p.addr, q.addr) {
+				split = append(split, [2]*simPeer{p, q})
+			}
+		}
+	}
+	sim.nw.heal()
+	for _, pq := range split {
+		if err := pq[0].session.Connect(pq[1].addr); err != nil {
+			sim.t.Fatal(err)
+		}
+	}
+	sim.settle()
+}
+
+// settle waits until every peer has applied the operations of the peers
+// it can reach, and until the storage has caught up
+func (sim *simulation) settle() {
+	deadline := time.Now().Add(10 * time.Second)
+	for !sim.delivered() {
+		if time.Now().After(deadline) {
+			sim.t.Fatal("the operations were not delivered in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, p := range sim.peers {
+		p.session.flush()
+	}
+}
+
+func (sim *simulation) delivered() bool {
+	for _, p := range sim.peers {
+		for _, q := range sim.peers {
+			if p == q || !sim.nw.reachable(p.addr, q.addr) {
+				continue
+			}
+			if p.session.clock(q.addr) != q.session.clock(q.addr) {
+				return false
+			}
+			// and acknowledged having stored them
+			if q.session.acked(p.addr) != q.session.clock(q.addr) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// assertConverged checks that every peer has the same document, and that
+// the doc tables hold it
+func (sim *simulation) assertConverged() {
+	want := sim.peers[0].session.Document()
+	for _, p := range sim.peers {
+		d := p.session.Document()
+		if !sameDocument(want, d) {
+			sim.t.Fatalf("%s diverged: %q != %q", p.addr, d.Content(), want.Content())
+		}
+		stored, _ := crdt.NewSequence(d.Kind(), p.session.site, "")
+		p.session.store.LoadDocument(stored)
+		if !sameDocument(d, stored) {
+			sim.t.Fatalf("%s stored %q, document is %q", p.addr, stored.Content(), d.Content())
+		}
+	}
+}
+
+// sameDocument returns whether the documents have the same atoms at the
+// same positions, deleted ones included for the sequences which keep them
+func sameDocument(a, b crdt.Sequence) bool {
+	pa, pb := runes(a), runes(b)
+	if len(pa) != len(pb) {
+		return false
+	}
+	for i := range pa {
+		if pa[i].Atom != pb[i].Atom || a.Compare(pa[i].Pos, pb[i].Pos) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// runes returns the runes of the sequence, one pair each, since the peers may
+// split the same text in different runs
+func runes(d crdt.Sequence) []crdt.Pair {
+	var pairs []crdt.Pair
+	for _, p := range d.Atoms() {
+		pairs = append(pairs, p.Runes()...)
+	}
+	return pairs
+}
+
+func TestSimulationConcurrentInserts(t *testing.T) {
+	for _, kind := range crdt.SequenceKinds() {
+		t.Run(kind, func(t *testing.T) { testConcurrentInserts(t, kind) })
+	}
+}
+
+func testConcurrentInserts(t *testing.T, kind string) {
+	sim := newSimulationOf(t, kind, 3, 1, "hello world")
+	defer sim.close()
+
+	// everyone types at the same place
+	sim.round(func(p *simPeer) {
+		p.insert(5, p.addr[7:8])
+	})
+	sim.assertConverged()
+	if n := len(sim.peers[0].content()); n != len("hello world")+3 {
+		t.Fatalf("expected %d characters, got %d", len("hello world")+3, n)
+	}
+
+	// and removes the same word
+	sim.round(func(p *simPeer) {
+		p.delete(0, 5)
+	})
+	sim.assertConverged()
+}
+
+func TestSimulationRandomEdits(t *testing.T) {
+	for _, kind := range crdt.SequenceKinds() {
+		t.Run(kind, func(t *testing.T) {
+			for seed := int64(1); seed <= 3; seed++ {
+				sim := newSimulationOf(t, kind, 4, seed, "the quick brown fox\njumps over\nthe lazy dog\n")
+				for i := 0; i < 30; i++ {
+					sim.round(sim.randomEdit)
+				}
+				sim.assertConverged()
+				sim.close()
+			}
+		})
+	}
+}
+
+func TestSimulationInterleaving(t *testing.T) {
+	sim := newSimulationOf(t, crdt.RGA, 2, 3, "[]")
+	defer sim.close()
+
+	// both peers type a word at the same place, one character at a time,
+	// before hearing of each other
+	sim.nw.hold()
+	for i, p := range sim.peers {
+		for j, r := range []string{"left", "right"}[i] {
+			p.insert(1+j, string(r))
+		}
+	}
+	sim.nw.release()
+	sim.settle()
+	sim.assertConverged()
+
+	if got := sim.peers[0].content(); got != "[leftright]" && got != "[rightleft]" {
+		t.Fatalf("the words were interleaved: %q", got)
+	}
+}
+
+func TestSimulationRuns(t *testing.T) {
+	sim := newSimulation(t, 3, 5, "\n")
+	defer sim.close()
+
+	// a large paste goes as a few runs
+	paste := strings.Repeat("pasted text, ", 10000)
+	sim.peers[0].insert(0, paste)
+	sim.settle()
+	sim.assertConverged()
+	if n := len(sim.peers[1].session.Document().Atoms()); n > 10 {
+		t.Fatalf("the paste took %d atoms", n)
+	}
+
+	// the peers type and delete inside the runs before hearing of each other
+	sim.nw.hold()
+	sim.peers[0].insert(5, "Ü")
+	sim.peers[1].delete(3, 9)
+	sim.peers[2].insert(len(paste)-1, "tail")
+	sim.peers[2].delete(70000, 70010)
+	sim.nw.release()
+	sim.settle()
+	sim.assertConverged()
+
+	want := paste[:3] + "Ü" + paste[9:70000] + paste[70010:len(paste)-1] + "tail" + paste[len(paste)-1:] + "\n"
+	if got := sim.peers[0].content(); got != want {
+		t.Fatalf("expected %d bytes, got %d", len(want), len(got))
+	}
+}
+
+func TestSimulationSites(t *testing.T) {
+	testSites(t, crdt.Logoot)
+	testSites(t, crdt.RGA)
+}
+
+func testSites(t *testing.T, kind string) {
+	sim := newSimulationOf(t, kind, 4, 47, "sites\n")
+	defer sim.close()
+
+	// a host asking for the site of the first one gets another
+	first := sim.peers[0]
+	var addr string
+	for i := 5; addr == ""; i++ {
+		a := fmt.Sprintf("10.0.%d.%d:7000", i/250, i%250+1)
+		if siteOf(a) == first.session.site {
+			addr = a
+		}
+	}
+	host := NewHost(sim.nw.transport(addr), sim.dir)
+	host.SetStore("memory")
+	if err := host.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	s, err := host.Join(first.addr, "sim.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve(Callbacks{})
+	sim.peers = append(sim.peers, &simPeer{addr: addr, host: host, session: s})
+	if err := s.Connect(first.addr); err != nil {
+		t.Fatal(err)
+	}
+	sim.settle()
+
+	sites := make(map[uint8]string)
+	for _, p := range sim.peers {
+		if other, ok := sites[p.session.site]; ok {
+			t.Fatalf("%s and %s both have site %d", p.addr, other, p.session.site)
+		}
+		sites[p.session.site] = p.addr
+	}
+
+	// so that the identifiers they draw do not collide
+	for i := 0; i < 20; i++ {
+		sim.round(func(p *simPeer) { p.insert(0, p.addr[:8]) })
+	}
+	sim.assertConverged()
+}
+
+func TestSitesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-sites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nw := newMemNetwork()
+
+	// share restarts the owner, the storage of the document is kept
+	share := func() (*Host, *Session) {
+		h := NewHost(nw.transport("10.0.0.1:7000"), dir)
+		h.SetStore("log")
+		if err := h.Listen("10.0.0.1:7000"); err != nil {
+			t.Fatal(err)
+		}
+		s, _, err := h.Share("sites.txt", crdt.NewDocument(0, "sites\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Serve(Callbacks{})
+		return h, s
+	}
+
+	h, s := share()
+	site, err := s.assignSite("10.0.0.2:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	h, s = share()
+	defer h.Close()
+	// a new peer asking for the same site gets another one
+	var addr string
+	for i := 3; addr == ""; i++ {
+		a := fmt.Sprintf("10.0.%d.%d:7000", i/250, i%250+1)
+		if siteOf(a) == site {
+			addr = a
+		}
+	}
+	other, err := s.assignSite(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == site {
+		t.Fatalf("%s got site %d of 10.0.0.2:7000 after a restart", addr, site)
+	}
+	if again, _ := s.assignSite("10.0.0.2:7000"); again != site {
+		t.Fatalf("10.0.0.2:7000 got site %d after a restart, expected %d", again, site)
+	}
+}
+
+func TestSimulationPartition(t *testing.T) {
+	for _, kind := range crdt.SequenceKinds() {
+		t.Run(kind, func(t *testing.T) { testPartition(t, kind) })
+	}
+}
+
+func testPartition(t *testing.T, kind string) {
+	sim := newSimulationOf(t, kind, 4, 7, "partitioned\nnetwork\n")
+	defer sim.close()
+
+	for i := 0; i < 5; i++ {
+		sim.round(sim.randomEdit)
+	}
+	sim.assertConverged()
+
+	sim.partition([]int{0, 1}, []int{2, 3})
+	for i := 0; i < 10; i++ {
+		sim.round(sim.randomEdit)
+	}
+	if !sameDocument(sim.peers[0].session.Document(), sim.peers[1].session.Document()) ||
+		!sameDocument(sim.peers[2].session.Document(), sim.peers[3].session.Document()) {
+		t.Fatal("the peers of a partition diverged")
+	}
+
+	sim.heal()
+	sim.assertConverged()
+
+	// the peers keep converging once healed
+	for i := 0; i < 5; i++ {
+		sim.round(sim.randomEdit)
+	}
+	sim.assertConverged()
+}
+
+func TestSimulationBackpressure(t *testing.T) {
+	sim := newSimulation(t, 3, 11, "queue\n")
+	defer sim.close()
+
+	// more than the queue can hold is typed all over the document while
+	// the network is stuck
+	sim.round(func(p *simPeer) {
+		if p != sim.peers[0] {
+			return
+		}
+		for i := 0; i <= maxQueued/4; i++ {
+			p.session.Lock()
+			n := p.session.Document().Len()
+			p.session.Unlock()
+			p.insert(sim.rand.Intn(n+1), "abcd")
+		}
+	})
+	sim.assertConverged()
+
+	first := sim.peers[0]
+	for _, st := range first.session.NetStats() {
+		if !st.Connected || st.Queued != 0 || st.CatchUp {
+			t.Fatalf("%s is not idle: %+v", st.Peer, st)
+		}
+		if st.Acked != first.session.clock(first.addr) {
+			t.Fatalf("%s acked %d, expected %d", st.Peer, st.Acked, first.session.clock(first.addr))
+		}
+		// the operations were coalesced
+		if st.Messages >= st.Sent {
+			t.Fatalf("%s got %d operations in %d messages", st.Peer, st.Sent, st.Messages)
+		}
+	}
+}
+
+func TestSimulationTyping(t *testing.T) {
+	sim := newSimulation(t, 3, 53, "\n")
+	defer sim.close()
+
+	// the runes typed one by one while the network is stuck go as runs
+	first := sim.peers[0]
+	sim.round(func(p *simPeer) {
+		if p != first {
+			return
+		}
+		for i := 0; i < 100; i++ {
+			p.insert(i, string(rune('a'+i%26)))
+		}
+	})
+	sim.assertConverged()
+
+	for _, st := range first.session.NetStats() {
+		if st.Sent > 2 || st.Messages > 2 {
+			t.Fatalf("%s got %d operations in %d messages", st.Peer, st.Sent, st.Messages)
+		}
+		if st.Acked != 100 {
+			t.Fatalf("%s acked %d, expected 100", st.Peer, st.Acked)
+		}
+	}
+}
+
+func TestSimulationAcks(t *testing.T) {
+	sim := newSimulation(t, 3, 5, "acknowledged\n")
+	defer sim.close()
+
+	for i := 0; i < 5; i++ {
+		sim.round(sim.randomEdit)
+	}
+	sim.assertConverged()
+
+	// the acknowledgements are stored
+	for _, p := range sim.peers {
+		p.session.flush()
+		acks := p.session.store.LoadAcks()
+		for _, q := range sim.peers {
+			if p != q && acks[q.addr] != p.session.clock(p.addr) {
+				t.Fatalf("%s stored ack %d from %s, expected %d", p.addr, acks[q.addr], q.addr, p.session.clock(p.addr))
+			}
+		}
+	}
+
+	// what the peer cut off has not stored must survive compaction
+	first, last := sim.peers[0], sim.peers[2]
+	sim.partition([]int{0, 1}, []int{2})
+	for i := 0; i < 5; i++ {
+		sim.round(sim.randomEdit)
+	}
+	if safe := first.session.Compact(); safe > first.session.acked(last.addr) {
+		t.Fatalf("compacted up to %d, %s only stored %d", safe, last.addr, first.session.acked(last.addr))
+	}
+	sim.heal()
+	sim.assertConverged()
+
+	// once everyone has stored everything, only the last operation is kept
+	clock := first.session.clock(first.addr)
+	if safe := first.session.Compact(); safe != clock-1 {
+		t.Fatalf("compacted up to %d, expected %d", safe, clock-1)
+	}
+	first.session.flush()
+	if ops := first.session.store.Ops(1, clock); len(ops) != 1 || ops[0].Clock != clock {
+		t.Fatalf("unexpected ops after compaction: %v", ops)
+	}
+}
+
+func TestSimulationUnsynced(t *testing.T) {
+	sim := newSimulation(t, 3, 13, "saved\n")
+	defer sim.close()
+
+	sim.round(sim.randomEdit)
+	for _, p := range sim.peers {
+		if u := p.session.Unsynced(); len(u) != 0 {
+			t.Fatalf("%s is not in sync with %v", p.addr, u)
+		}
+	}
+
+	// the peer cut off misses what is typed meanwhile
+	first, last := sim.peers[0], sim.peers[2]
+	sim.partition([]int{0, 1}, []int{2})
+	sim.round(func(p *simPeer) {
+		if p == first {
+			p.insert(0, "x")
+		}
+	})
+	if u := first.session.Unsynced(); len(u) != 1 || u[0] != last.addr {
+		t.Fatalf("expected only %s out of sync, got %v", last.addr, u)
+	}
+	if first.session.Synced() {
+		t.Fatalf("%s is synced while partitioned", first.addr)
+	}
+	first.session.Lock()
+	version := first.session.Version()
+	first.session.Unlock()
+	if version[first.addr] != first.session.clock(first.addr) || version[last.addr] != last.session.clock(last.addr) {
+		t.Fatalf("unexpected version %v", version)
+	}
+
+	sim.heal()
+	if u := first.session.Unsynced(); len(u) != 0 {
+		t.Fatalf("%s is still not in sync with %v", first.addr, u)
+	}
+
+	// the statistics follow what was exchanged
+	for _, st := range first.session.NetStats() {
+		var q *simPeer
+		for _, p := range sim.peers {
+			if p.addr == st.Peer {
+				q = p
+			}
+		}
+		if st.Clock != q.session.clock(q.addr) || st.Received != st.Clock {
+			t.Fatalf("%s has clock %d and %d received operations, expected %d", st.Peer, st.Clock, st.Received, q.session.clock(q.addr))
+		}
+		if st.RTT <= 0 {
+			t.Fatalf("no round trip measured to %s", st.Peer)
+		}
+		if (st.Peer == last.addr) != (st.LastError != "") {
+			t.Fatalf("unexpected last error for %s: %q", st.Peer, st.LastError)
+		}
+	}
+}
+
+func TestSimulationPresence(t *testing.T) {
+	sim := newSimulation(t, 2, 23, "one\ntwo\nthree\nfour\n")
+	defer sim.close()
+
+	first, last := sim.peers[0], sim.peers[1]
+	want := Presence{Line: 3, Topline: 1, LeftCol: 2, Active: true}
+	first.session.UpdatePresence(want)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p, ok := last.session.PresenceOf(first.addr)
+		p.Time = time.Time{}
+		if ok && p == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s sees %s at %+v, expected %+v", last.addr, first.addr, p, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSimulationChat(t *testing.T) {
+	sim := newSimulation(t, 3, 31, "")
+	defer sim.close()
+
+	// the messages are stored by the storage writer of each peer, while the
+	// peers say and receive them at the same time
+	var wg sync.WaitGroup
+	for _, p := range sim.peers {
+		wg.Add(1)
+		go func(p *simPeer) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				p.session.Say(fmt.Sprintf("%s %d", p.addr, i))
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// our messages are in the history as soon as they are said
+	if n := len(sim.peers[0].session.ChatHistory()); n < 10 {
+		t.Fatalf("%d messages in the history, expected at least 10", n)
+	}
+	for _, p := range sim.peers {
+		p := p
+		waitFor(t, func() bool { return len(p.session.ChatHistory()) == 30 })
+	}
+}
+
+func TestSimulationComments(t *testing.T) {
+	sim := newSimulation(t, 3, 29, "comment this word\n")
+	defer sim.close()
+
+	first, second, last := sim.peers[0], sim.peers[1], sim.peers[2]
+	first.session.Lock()
+	c := first.session.AddComment(13, 17, "which word?")
+	first.session.Unlock()
+
+	// the peer cut off gets the thread when it reconnects
+	sim.partition([]int{0, 1}, []int{2})
+	reply := second.session.Reply(c, "this one")
+	waitFor(t, func() bool { return len(first.session.Comments()) == 2 })
+	sim.heal()
+	waitFor(t, func() bool { return len(last.session.Comments()) == 2 })
+	if got := last.session.Comments()[1]; got.ReplyTo != c.ID || got.ID != reply.ID {
+		t.Fatalf("unexpected reply %+v", got)
+	}
+
+	// the range follows the text around it
+	sim.round(func(p *simPeer) {
+		if p == first {
+			p.insert(0, "please ")
+		}
+		if p == last {
+			p.delete(0, 8) // "comment "
+		}
+	})
+	sim.assertConverged()
+	for _, p := range sim.peers {
+		p.session.Lock()
+		start, end, ok := p.session.CommentSpan(c)
+		text := p.session.Document().Content()
+		p.session.Unlock()
+		if !ok || text[start:end] != "word" {
+			t.Fatalf("%s anchors the comment at %d-%d of %q", p.addr, start, end, text)
+		}
+	}
+
+	// and disappears with it
+	first.delete(12, 16)
+	sim.settle()
+	last.session.Lock()
+	_, _, ok := last.session.CommentSpan(c)
+	last.session.Unlock()
+	if ok {
+		t.Fatal("the comment is still anchored to deleted text")
+	}
+}
+
+func TestSimulationPluginHooks(t *testing.T) {
+	sim := newSimulation(t, 2, 31, "written by the owner\n")
+	defer sim.close()
+
+	first, second := sim.peers[0], sim.peers[1]
+	second.insert(0, "second: ")
+	sim.settle()
+
+	// a peer joining late hears of both peers
+	var mu sync.Mutex
+	var events []string
+	event := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	happened := func(e string) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, got := range events {
+				if got == e {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	addr := "10.0.0.3:7000"
+	host := NewHost(sim.nw.transport(addr), sim.dir)
+	host.SetStore("memory")
+	if err := host.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	s, err := host.Join(first.addr, "sim.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve(Callbacks{
+		PeerConnected:    func(peer string) { event("connected " + peer) },
+		PeerDisconnected: func(peer string) { event("disconnected " + peer) },
+		Synced:           func(peer string) { event("synced " + peer) },
+		PluginMessage:    func(m PluginMessage) { event(m.Plugin + " " + m.From + " " + m.Data) },
+	})
+	last := &simPeer{addr: addr, host: host, session: s}
+	sim.peers = append(sim.peers, last)
+	if err := s.Connect(first.addr); err != nil {
+		t.Fatal(err)
+	}
+	sim.settle()
+	for _, peer := range []string{first.addr, second.addr} {
+		waitFor(t, happened("connected "+peer))
+		waitFor(t, happened("synced "+peer))
+	}
+
+	// and knows who wrote what, the site of second told by first
+	s.Lock()
+	author, ok := s.Author(0)
+	owner, _ := s.Author(10)
+	s.Unlock()
+	if !ok || author != second.addr || owner != first.addr {
+		t.Fatalf("unexpected authors %q and %q", author, owner)
+	}
+
+	first.session.SendPluginMessage("linter", "2 warnings")
+	waitFor(t, happened("linter "+first.addr+" 2 warnings"))
+
+	second.session.Unshare()
+	waitFor(t, happened("disconnected "+second.addr))
+}
+
+func TestSimulationSettings(t *testing.T) {
+	sim := newSimulation(t, 3, 41, "\tindented\n")
+	defer sim.close()
+
+	first, second, last := sim.peers[0], sim.peers[1], sim.peers[2]
+	setting := func(p *simPeer, name string) string {
+		for _, st := range p.session.Settings() {
+			if st.Name == name {
+				return st.Value
+			}
+		}
+		return ""
+	}
+	first.session.InitSetting("tabsize", "4")
+	first.session.SetSetting("tabsize", "8")
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return setting(p, "tabsize") == "8" })
+	}
+
+	// an initial value does not override a change
+	second.session.InitSetting("tabsize", "2")
+	if got := setting(second, "tabsize"); got != "8" {
+		t.Fatalf("tabsize is %q", got)
+	}
+
+	// the last change made while cut off wins once healed
+	sim.partition([]int{0, 1}, []int{2})
+	first.session.SetSetting("tabstospaces", "true")
+	time.Sleep(time.Millisecond)
+	last.session.SetSetting("tabstospaces", "false")
+	sim.heal()
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return setting(p, "tabstospaces") == "false" })
+	}
+}
+
+func TestSimulationSettingRights(t *testing.T) {
+	sim := newSimulation(t, 3, 67, "\tindented\n")
+	defer sim.close()
+
+	owner, editor, viewer := sim.peers[0], sim.peers[1], sim.peers[2]
+	if err := owner.session.ChangeRole(viewer.addr, RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return !p.session.CanEdit(viewer.addr) })
+	}
+	tabsize := func(p *simPeer) Setting {
+		for _, st := range p.session.Settings() {
+			if st.Name == "tabsize" {
+				return st
+			}
+		}
+		return Setting{}
+	}
+	owner.session.SetSetting("tabsize", "8")
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return tabsize(p).Value == "8" })
+	}
+
+	// a viewer does not change the settings, neither do spoofed changes
+	viewer.session.SetSetting("tabsize", "2")
+	future := Setting{Name: "tabsize", Value: "3", Time: time.Now().Add(24 * time.Hour), From: editor.addr}
+	relayed := Setting{Name: "tabsize", Value: "5", Time: time.Now(), From: viewer.addr}
+	var reply SettingsReply
+	for _, st := range []Setting{future, relayed} {
+		args := SettingsArgs{DocID: owner.session.DocID, Clientid: editor.addr, Settings: []Setting{st}}
+		if err := callPeer(clientOf(editor, owner), "EntangleClient.Settings", args, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := SettingsArgs{DocID: owner.session.DocID, Clientid: viewer.addr, Settings: []Setting{future}}
+	if err := callPeer(clientOf(editor, owner), "EntangleClient.Settings", args, &reply); err == nil {
+		t.Fatal("an editor sent settings as the viewer")
+	}
+	viewed := Setting{Name: "tabsize", Value: "6", Time: time.Now(), From: viewer.addr}
+	args = SettingsArgs{DocID: owner.session.DocID, Clientid: viewer.addr, Settings: []Setting{viewed}}
+	if err := callPeer(clientOf(viewer, owner), "EntangleClient.Settings", args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	sim.settle()
+	for _, p := range sim.peers {
+		if st := tabsize(p); st.Value != "8" || st.From != owner.addr {
+			t.Fatalf("%s has tabsize %+v", p.addr, st)
+		}
+	}
+
+	// the changes of an editor are taken
+	editor.session.SetSetting("tabsize", "4")
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return tabsize(p).Value == "4" })
+	}
+}
+
+func TestSimulationClaims(t *testing.T) {
+	sim := newSimulation(t, 3, 43, "generated: do not edit\nmigrate up\n")
+	defer sim.close()
+
+	first, second, last := sim.peers[0], sim.peers[1], sim.peers[2]
+	first.session.Lock()
+	c := first.session.ClaimRange(23, 33) // "migrate up"
+	first.session.Unlock()
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return len(p.session.Claims()) == 1 })
+	}
+
+	claimed := func(p *simPeer, start, end int) bool {
+		p.session.Lock()
+		defer p.session.Unlock()
+		got, ok := p.session.ClaimedByPeer(start, end)
+		return ok && got.ID == c.ID
+	}
+	if !claimed(second, 25, 26) || !claimed(last, 23, 23) || !claimed(last, 32, 32) {
+		t.Fatal("the edits of the claimed range are not caught")
+	}
+	if claimed(second, 0, 9) || claimed(first, 25, 26) || claimed(last, 33, 33) {
+		t.Fatal("edits outside the claim, or by its author, are caught")
+	}
+
+	// a line claimed with its newline does not take the start of the next
+	// line
+	second.session.Lock()
+	line := second.session.ClaimRange(0, 23)
+	second.session.Unlock()
+	waitFor(t, func() bool { return len(first.session.Claims()) == 2 })
+	first.session.Lock()
+	got, inLine := first.session.ClaimedByPeer(22, 22)
+	_, nextLine := first.session.ClaimedByPeer(23, 23)
+	first.session.Unlock()
+	if !inLine || got.ID != line.ID || nextLine {
+		t.Fatal("the end of a claimed line is not caught, or the next line is")
+	}
+	second.session.Release()
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return len(p.session.Claims()) == 1 })
+	}
+
+	// the range follows the text, and the peer cut off hears of the release
+	second.insert(0, "# ")
+	sim.settle()
+	if !claimed(last, 27, 28) || claimed(last, 24, 24) {
+		t.Fatal("the claim did not follow the text")
+	}
+	sim.partition([]int{0, 1}, []int{2})
+	if n := first.session.Release(); n != 1 {
+		t.Fatalf("released %d claims", n)
+	}
+	waitFor(t, func() bool { return len(second.session.Claims()) == 0 })
+	sim.heal()
+	waitFor(t, func() bool { return len(last.session.Claims()) == 0 })
+
+	last.session.ClaimAll()
+	waitFor(t, func() bool {
+		first.session.Lock()
+		defer first.session.Unlock()
+		_, ok := first.session.ClaimedByPeer(0, 0)
+		return ok
+	})
+}
+
+func TestSimulationRevertClaimed(t *testing.T) {
+	sim := newSimulation(t, 2, 47, "keep\nclaimed\n")
+	defer sim.close()
+
+	first, last := sim.peers[0], sim.peers[1]
+	last.session.Lock()
+	inserted := last.session.Insert(9, "!") // "clai!med"
+	deleted := last.session.Delete(5, 6)    // "c"
+	outside := last.session.Insert(0, ">")
+	last.session.Unlock()
+	sim.settle()
+
+	first.session.Lock()
+	c := first.session.ClaimRange(6, 14) // "lai!med\n"
+	first.session.Unlock()
+	waitFor(t, func() bool { return len(last.session.Claims()) == 1 })
+
+	reverts := func(ops []crdt.Operation) bool {
+		last.session.Lock()
+		defer last.session.Unlock()
+		got, ok := last.session.RevertClaimedByPeer(ops)
+		return ok && got.ID == c.ID
+	}
+	if !reverts(inserted) || !reverts(deleted) {
+		t.Fatal("undoing an edit of the claimed range is not caught")
+	}
+	if reverts(outside) {
+		t.Fatal("undoing an edit outside the claim is caught")
+	}
+}
+
+func TestSimulationClaimRights(t *testing.T) {
+	sim := newSimulation(t, 3, 61, "claimed\n")
+	defer sim.close()
+
+	owner, editor, viewer := sim.peers[0], sim.peers[1], sim.peers[2]
+	if err := owner.session.ChangeRole(viewer.addr, RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return !p.session.CanEdit(viewer.addr) })
+	}
+	c := owner.session.ClaimAll()
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return len(p.session.Claims()) == 1 })
+	}
+
+	// a viewer cannot claim, and no one but its author releases a claim
+	viewer.session.ClaimAll()
+	released := c
+	released.Released = true
+	released.Time = time.Now()
+	stolen := released
+	stolen.From = editor.addr
+	var reply ClaimsReply
+	for _, cs := range [][]Claim{{released}, {stolen}} {
+		args := ClaimsArgs{DocID: owner.session.DocID, Clientid: editor.addr, Claims: cs}
+		if err := callPeer(clientOf(editor, viewer), "EntangleClient.Claims", args, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := ClaimsArgs{DocID: owner.session.DocID, Clientid: owner.addr, Claims: []Claim{released}}
+	if err := callPeer(clientOf(editor, viewer), "EntangleClient.Claims", args, &reply); err == nil {
+		t.Fatal("an editor released a claim as its author")
+	}
+	sim.settle()
+	for _, p := range []*simPeer{owner, editor} {
+		if cs := p.session.Claims(); len(cs) != 1 || cs[0].ID != c.ID {
+			t.Fatalf("unexpected claims %+v", cs)
+		}
+	}
+	if cs := viewer.session.Claims(); len(cs) != 2 {
+		t.Fatalf("unexpected claims of the viewer %+v", cs)
+	}
+
+	// the claims of a peer which is gone are dropped
+	owner.session.Release()
+	editor.session.Lock()
+	editor.session.ClaimRange(0, 7)
+	editor.session.Unlock()
+	waitFor(t, func() bool { return len(owner.session.Claims()) == 1 })
+	// the owner finds out on the heartbeat of a peer which crashed, and
+	// the others when it leaves
+	sim.partition([]int{0}, []int{1, 2})
+	owner.session.Heartbeat()
+	waitFor(t, func() bool { return len(owner.session.Claims()) == 0 })
+	editor.session.Unshare()
+	waitFor(t, func() bool {
+		for _, c := range viewer.session.Claims() {
+			if c.From == editor.addr {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestSimulationRoles(t *testing.T) {
+	sim := newSimulation(t, 3, 59, "owned\n")
+	defer sim.close()
+
+	owner, editor, viewer := sim.peers[0], sim.peers[1], sim.peers[2]
+	if err := owner.session.ChangeRole(viewer.addr, RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return !p.session.CanEdit(viewer.addr) })
+	}
+
+	owner.session.Lock()
+	doc := owner.session.Document()
+	pos, _ := crdt.GeneratePos(doc.Pos(0), doc.Pos(1), viewer.session.site)
+	owner.session.Unlock()
+	apply := func(client *rpc.Client, from string, pos []crdt.Identifier) error {
+		args := ApplyArgs{
+			DocID:    owner.session.DocID,
+			Clientid: from,
+			Ops:      []crdt.Operation{{Atom: "x", OpType: true, Pos: crdt.PosBytes(pos), Clock: 1000}},
+		}
+		var reply ApplyReply
+		return callPeer(client, "EntangleClient.Apply", args, &reply)
+	}
+	setRole := func(client *rpc.Client, from string) error {
+		args := SetRoleArgs{
+			DocID:    owner.session.DocID,
+			Clientid: from,
+			Peer:     viewer.addr,
+			Role:     RoleEditor,
+		}
+		var reply ValReply
+		return callPeer(client, "EntangleClient.SetRole", args, &reply)
+	}
+
+	// a viewer can neither edit nor change roles
+	if err := apply(clientOf(viewer, owner), viewer.addr, pos); err == nil {
+		t.Fatal("the edit of a viewer is accepted")
+	}
+	if err := setRole(clientOf(viewer, editor), viewer.addr); err == nil {
+		t.Fatal("a viewer changed its role")
+	}
+	// nor pass itself off as the owner or an editor
+	if err := setRole(clientOf(viewer, editor), owner.addr); err == nil {
+		t.Fatal("a viewer changed its role as the owner")
+	}
+	if err := apply(clientOf(viewer, owner), editor.addr, pos); err == nil {
+		t.Fatal("a viewer edited as an editor")
+	}
+	// and neither can anyone reaching the port
+	conn, err := sim.nw.transport("10.0.0.9:7000").Dial(owner.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsider := rpc.NewClient(conn)
+	defer outsider.Close()
+	if err := apply(outsider, editor.addr, pos); err == nil {
+		t.Fatal("an outsider edited as an editor")
+	}
+	var reply ValReply
+	guess := TokenArgs{Clientid: editor.addr, Token: "0123456789abcdef0123456789abcdef"}
+	if err := callPeer(outsider, "EntangleClient.Authenticate", guess, &reply); err == nil {
+		t.Fatal("an outsider authenticated as an editor")
+	}
+	// an editor only inserts atoms of its own site
+	if err := apply(clientOf(editor, owner), editor.addr, pos); err == nil {
+		t.Fatal("an editor inserted atoms of another site")
+	}
+
+	sim.settle()
+	for _, p := range sim.peers {
+		if p.session.CanEdit(viewer.addr) || p.content() != "owned\n" {
+			t.Fatalf("%s has %q, %s can edit: %v", p.addr, p.content(), viewer.addr, p.session.CanEdit(viewer.addr))
+		}
+	}
+}
+
+// clientOf returns the RPC client the peer p calls the peer to with
+func clientOf(p, to *simPeer) *rpc.Client {
+	p.session.mu.Lock()
+	defer p.session.mu.Unlock()
+	return p.session.peers[to.addr]
+}
+
+// waitFor waits until cond holds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,149 @@
+package session
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// Store holds the storage of a single shared document: the log of our own
+// operations keyed by logical clock, the atoms of the current CRDT document,
+// the sequence vector with the acknowledgements of the peers, the sites of
+// the peers, the chat, the comments and the undo history.
+// Writes are issued by the single storage writer of the session, queued
+// with persist, so that they happen in order; reads may come from any
+// goroutine
+type Store interface {
+	// AppendOp logs one of our own operations
+	AppendOp(op crdt.Operation) error
+	// Ops returns the logged operations with clocks from from to to
+	// (both included), ordered by clock
+	Ops(from, to uint64) []crdt.Operation
+	// LastClock returns the clock of the last logged operation, 0 if none
+	LastClock() uint64
+	// ResetOps drops every logged operation
+	ResetOps() error
+	// DropOps drops the logged operations with clocks up to to (included)
+	DropOps(to uint64) error
+
+	// PutAtom inserts the atom with the given ID in the document, or
+	// replaces it if it exists already
+	PutAtom(id uint64, atom string, pos []crdt.Identifier) error
+	// DeleteAtom removes the atom with the given ID from the document
+	DeleteAtom(id uint64) error
+	// NextAtomID hands out the ID of the next inserted atom
+	NextAtomID() uint64
+	// SaveDocument replaces the stored document, assigning atom IDs to
+	// the atoms of d on the way
+	SaveDocument(d crdt.Sequence) error
+	// LoadDocument inserts the stored atoms into d, an empty sequence of
+	// the kind they were stored from
+	LoadDocument(d crdt.Sequence)
+
+	// SaveClocks stores the given entries of the sequence vector, leaving
+	// the other entries as they are
+	SaveClocks(clocks map[string]uint64) error
+	// LoadClocks returns the stored sequence vector
+	LoadClocks() map[string]uint64
+	// SaveAcks stores the given clocks of ours acknowledged by the peers,
+	// leaving the other entries as they are
+	SaveAcks(acks map[string]uint64) error
+	// LoadAcks returns the stored acknowledgements
+	LoadAcks() map[string]uint64
+	// ResetClocks clears the stored sequence vector and acknowledgements
+	ResetClocks() error
+
+	// SaveSites stores the given sites of the peers, leaving the other
+	// sites as they are
+	SaveSites(sites map[uint8]string) error
+	// LoadSites returns the stored sites of the peers
+	LoadSites() map[uint8]string
+
+	// AppendChat stores a chat message
+	AppendChat(m ChatMessage) error
+	// LoadChat returns the stored chat messages, oldest first
+	LoadChat() []ChatMessage
+
+	// AppendComment stores a comment
+	AppendComment(c Comment) error
+	// LoadComments returns the stored comments, oldest first
+	LoadComments() []Comment
+
+	// SaveUndo stores the undo history, as encoded by the consumer
+	SaveUndo(data []byte) error
+	// LoadUndo returns the stored undo history, nil if there is none
+	LoadUndo() []byte
+	// ResetUndo removes the undo history, which refers to the logged operations
+	ResetUndo() error
+
+	// Close releases the resources of the store
+	Close() error
+}
+
+// stores maps the name of every storage backend to the function opening
+// a store in a directory. The sqlite backend is only there with cgo
+var stores = map[string]func(dir string) (Store, error){
+	"log":    openLogStore,
+	"memory": openMemStore,
+}
+
+// DefaultStore is the name of the storage backend used unless told otherwise.
+// It is sqlite when it is available
+var DefaultStore = "log"
+
+// StoreKinds returns the names of the available storage backends
+func StoreKinds() []string {
+	kinds := make([]string, 0, len(stores))
+	for kind := range stores {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// openStore opens a store of the given kind in dir
+func openStore(kind, dir string) (Store, error) {
+	open, ok := stores[kind]
+	if !ok {
+		return nil, unknownStore(kind)
+	}
+	return open(dir)
+}
+
+func unknownStore(kind string) error {
+	return errors.New("unknown storage " + kind + ", expected one of " + strings.Join(StoreKinds(), ", "))
+}
+
+// atomIDs hands out the IDs of the atoms stored in a document. ID 0 and 1
+// are used by Start and End
+type atomIDs struct {
+	last uint64
+	mu   sync.Mutex
+}
+
+// next returns the next available ID and advances the last inserted ID
+func (a *atomIDs) next() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.last++
+	return a.last
+}
+
+// reset sets the last inserted ID
+func (a *atomIDs) reset(last uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.last = last
+}
+
+// storageError hands a storage error to the consumer of the session without
+// halting, used by the write-behind goroutines. The consumer is called from
+// a goroutine of its own, so that the writer never waits for it
+func (s *Session) storageError(err error) {
+	if err != nil && s.cb.StorageError != nil {
+		go s.cb.StorageError(err)
+	}
+}
@@ -0,0 +1,302 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// logRecord is one line of the log of a logStore
+type logRecord struct {
+	Type    string            // op, put, del, clocks, acks, sites, chat or comment
+	Op      *crdt.Operation   `json:",omitempty"`
+	ID      uint64            `json:",omitempty"`
+	Atom    string            `json:",omitempty"`
+	Pos     []byte            `json:",omitempty"`
+	Clocks  map[string]uint64 `json:",omitempty"`
+	Sites   map[uint8]string  `json:",omitempty"`
+	Chat    *ChatMessage      `json:",omitempty"`
+	Comment *Comment          `json:",omitempty"`
+}
+
+// logStore keeps the storage of a document in an append-only log of JSON
+// records, replayed in memory when the store is opened. It is written in
+// pure Go, so it does not need cgo. The log is rewritten from scratch
+// whenever the document or the ops are reset, and when ops are dropped
+// The directory contains:
+// log, the records
+// undo, the undo history
+type logStore struct {
+	*memStore
+
+	dir  string
+	file *os.File
+	// serializes the writes, so that the log matches the memory
+	mu sync.Mutex
+}
+
+func openLogStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	s := &logStore{memStore: newMemStore(), dir: dir}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(s.path(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+func (s *logStore) path() string {
+	return filepath.Join(s.dir, "log")
+}
+
+// replay applies the records of the log to the memory
+func (s *logStore) replay() error {
+	f, err := os.Open(s.path())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	lastID := uint64(1)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a line without its newline was cut short by a crash
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var rec logRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		switch rec.Type {
+		case "op":
+			s.memStore.AppendOp(*rec.Op)
+		case "put":
+			s.memStore.atoms[rec.ID] = storedAtom{rec.Atom, rec.Pos}
+			if rec.ID > lastID {
+				lastID = rec.ID
+			}
+		case "del":
+			s.memStore.DeleteAtom(rec.ID)
+		case "clocks":
+			s.memStore.SaveClocks(rec.Clocks)
+		case "acks":
+			s.memStore.SaveAcks(rec.Clocks)
+		case "sites":
+			s.memStore.SaveSites(rec.Sites)
+		case "chat":
+			s.memStore.AppendChat(*rec.Chat)
+		case "comment":
+			s.memStore.AppendComment(*rec.Comment)
+		}
+	}
+	s.ids.reset(lastID)
+	return nil
+}
+
+// write applies a change to the memory and appends its records to the log
+func (s *logStore) write(apply func(), recs ...logRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	apply()
+
+	w := bufio.NewWriter(s.file)
+	enc := json.NewEncoder(w) // one record per line
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// reset applies a change to the memory and rewrites the log from scratch
+func (s *logStore) reset(apply func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	apply()
+
+	tmp := s.path() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range s.snapshot() {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	s.file.Close()
+	if err := os.Rename(tmp, s.path()); err != nil {
+		return err
+	}
+	s.file, err = os.OpenFile(s.path(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	return err
+}
+
+// snapshot returns the records recreating what is in memory
+func (s *logStore) snapshot() []logRecord {
+	m := s.memStore
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var recs []logRecord
+	logged := make([]uint64, 0, len(m.ops))
+	for c := range m.ops {
+		logged = append(logged, c)
+	}
+	sort.Slice(logged, func(i, j int) bool { return logged[i] < logged[j] })
+	for _, c := range logged {
+		op := m.ops[c]
+		recs = append(recs, logRecord{Type: "op", Op: &op})
+	}
+	for id, a := range m.atoms {
+		recs = append(recs, logRecord{Type: "put", ID: id, Atom: a.Atom, Pos: a.Pos})
+	}
+	if len(m.clocks) > 0 {
+		clocks := make(map[string]uint64, len(m.clocks))
+		for peer, clock := range m.clocks {
+			clocks[peer] = clock
+		}
+		recs = append(recs, logRecord{Type: "clocks", Clocks: clocks})
+	}
+	if len(m.acks) > 0 {
+		acks := make(map[string]uint64, len(m.acks))
+		for peer, clock := range m.acks {
+			acks[peer] = clock
+		}
+		recs = append(recs, logRecord{Type: "acks", Clocks: acks})
+	}
+	if len(m.sites) > 0 {
+		sites := make(map[uint8]string, len(m.sites))
+		for site, peer := range m.sites {
+			sites[site] = peer
+		}
+		recs = append(recs, logRecord{Type: "sites", Sites: sites})
+	}
+	for _, msg := range m.chat {
+		msg := msg
+		recs = append(recs, logRecord{Type: "chat", Chat: &msg})
+	}
+	for _, c := range m.comments {
+		c := c
+		recs = append(recs, logRecord{Type: "comment", Comment: &c})
+	}
+	return recs
+}
+
+func (s *logStore) AppendOp(op crdt.Operation) error {
+	return s.write(func() { s.memStore.AppendOp(op) }, logRecord{Type: "op", Op: &op})
+}
+
+func (s *logStore) ResetOps() error {
+	return s.reset(func() { s.memStore.ResetOps() })
+}
+
+func (s *logStore) DropOps(to uint64) error {
+	return s.reset(func() { s.memStore.DropOps(to) })
+}
+
+func (s *logStore) PutAtom(id uint64, atom string, pos []crdt.Identifier) error {
+	return s.write(func() { s.memStore.PutAtom(id, atom, pos) },
+		logRecord{Type: "put", ID: id, Atom: atom, Pos: crdt.PosBytes(pos)})
+}
+
+func (s *logStore) DeleteAtom(id uint64) error {
+	return s.write(func() { s.memStore.DeleteAtom(id) }, logRecord{Type: "del", ID: id})
+}
+
+func (s *logStore) SaveDocument(d crdt.Sequence) error {
+	return s.reset(func() { s.memStore.SaveDocument(d) })
+}
+
+func (s *logStore) SaveClocks(clocks map[string]uint64) error {
+	if len(clocks) == 0 {
+		return nil
+	}
+	return s.write(func() { s.memStore.SaveClocks(clocks) }, logRecord{Type: "clocks", Clocks: clocks})
+}
+
+func (s *logStore) SaveAcks(acks map[string]uint64) error {
+	if len(acks) == 0 {
+		return nil
+	}
+	return s.write(func() { s.memStore.SaveAcks(acks) }, logRecord{Type: "acks", Clocks: acks})
+}
+
+func (s *logStore) ResetClocks() error {
+	return s.reset(func() { s.memStore.ResetClocks() })
+}
+
+func (s *logStore) SaveSites(sites map[uint8]string) error {
+	if len(sites) == 0 {
+		return nil
+	}
+	return s.write(func() { s.memStore.SaveSites(sites) }, logRecord{Type: "sites", Sites: sites})
+}
+
+func (s *logStore) AppendChat(m ChatMessage) error {
+	return s.write(func() { s.memStore.AppendChat(m) }, logRecord{Type: "chat", Chat: &m})
+}
+
+func (s *logStore) AppendComment(c Comment) error {
+	return s.write(func() { s.memStore.AppendComment(c) }, logRecord{Type: "comment", Comment: &c})
+}
+
+func (s *logStore) SaveUndo(data []byte) error {
+	return ioutil.WriteFile(filepath.Join(s.dir, "undo"), data, 0644)
+}
+
+func (s *logStore) LoadUndo() []byte {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "undo"))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func (s *logStore) ResetUndo() error {
+	err := os.Remove(filepath.Join(s.dir, "undo"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *logStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,268 @@
+package session
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// storedAtom is an atom of the stored document
+type storedAtom struct {
+	Atom string
+	Pos  []byte
+}
+
+// memStore keeps the storage of a document in memory only. It is lost when
+// the session stops, which is what tests want
+type memStore struct {
+	ops       map[uint64]crdt.Operation
+	lastClock uint64
+
+	atoms map[uint64]storedAtom
+	ids   atomIDs
+
+	clocks   map[string]uint64
+	acks     map[string]uint64
+	sites    map[uint8]string
+	chat     []ChatMessage
+	comments []Comment
+	undo     []byte
+
+	// protects everything but ids
+	mu sync.Mutex
+}
+
+func newMemStore() *memStore {
+	s := &memStore{
+		ops:    make(map[uint64]crdt.Operation),
+		atoms:  make(map[uint64]storedAtom),
+		clocks: make(map[string]uint64),
+		acks:   make(map[string]uint64),
+		sites:  make(map[uint8]string),
+	}
+	s.ids.reset(1)
+	return s
+}
+
+func openMemStore(dir string) (Store, error) {
+	return newMemStore(), nil
+}
+
+func (s *memStore) AppendOp(op crdt.Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops[op.Clock] = op
+	if op.Clock > s.lastClock {
+		s.lastClock = op.Clock
+	}
+	return nil
+}
+
+func (s *memStore) Ops(from, to uint64) []crdt.Operation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if to > s.lastClock {
+		to = s.lastClock
+	}
+
+	if from == 0 { // clocks start from 1
+		from = 1
+	}
+	var ops []crdt.Operation
+	for c := from; c <= to; c++ {
+		if op, ok := s.ops[c]; ok {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+func (s *memStore) LastClock() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastClock
+}
+
+func (s *memStore) ResetOps() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = make(map[uint64]crdt.Operation)
+	s.lastClock = 0
+	return nil
+}
+
+func (s *memStore) DropOps(to uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.ops {
+		if c <= to {
+			delete(s.ops, c)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) PutAtom(id uint64, atom string, pos []crdt.Identifier) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.atoms[id] = storedAtom{atom, crdt.PosBytes(pos)}
+	return nil
+}
+
+func (s *memStore) DeleteAtom(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.atoms, id)
+	return nil
+}
+
+func (s *memStore) NextAtomID() uint64 {
+	return s.ids.next()
+}
+
+func (s *memStore) SaveDocument(d crdt.Sequence) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.atoms = make(map[uint64]storedAtom)
+	s.ids.reset(1)
+
+	atoms := d.Atoms()
+	for i := range atoms {
+		atoms[i].ID = s.ids.next()
+		s.atoms[atoms[i].ID] = storedAtom{atoms[i].Atom, crdt.PosBytes(atoms[i].Pos)}
+	}
+	return nil
+}
+
+func (s *memStore) LoadDocument(d crdt.Sequence) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// inserting by increasing ID keeps the result independent of the map order
+	ids := make([]uint64, 0, len(s.atoms))
+	for id := range s.atoms {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		a := s.atoms[id]
+		d.InsertPos(crdt.NewPos(a.Pos), a.Atom, id)
+	}
+}
+
+func (s *memStore) SaveClocks(clocks map[string]uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for peer, clock := range clocks {
+		s.clocks[peer] = clock
+	}
+	return nil
+}
+
+func (s *memStore) LoadClocks() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clocks := make(map[string]uint64, len(s.clocks))
+	for peer, clock := range s.clocks {
+		clocks[peer] = clock
+	}
+	return clocks
+}
+
+func (s *memStore) SaveAcks(acks map[string]uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for peer, clock := range acks {
+		s.acks[peer] = clock
+	}
+	return nil
+}
+
+func (s *memStore) LoadAcks() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acks := make(map[string]uint64, len(s.acks))
+	for peer, clock := range s.acks {
+		acks[peer] = clock
+	}
+	return acks
+}
+
+func (s *memStore) ResetClocks() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clocks = make(map[string]uint64)
+	s.acks = make(map[string]uint64)
+	return nil
+}
+
+func (s *memStore) SaveSites(sites map[uint8]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for site, peer := range sites {
+		s.sites[site] = peer
+	}
+	return nil
+}
+
+func (s *memStore) LoadSites() map[uint8]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sites := make(map[uint8]string, len(s.sites))
+	for site, peer := range s.sites {
+		sites[site] = peer
+	}
+	return sites
+}
+
+func (s *memStore) AppendChat(m ChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chat = append(s.chat, m)
+	return nil
+}
+
+func (s *memStore) LoadChat() []ChatMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ChatMessage(nil), s.chat...)
+}
+
+func (s *memStore) AppendComment(c Comment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.comments = append(s.comments, c)
+	return nil
+}
+
+func (s *memStore) LoadComments() []Comment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Comment(nil), s.comments...)
+}
+
+func (s *memStore) SaveUndo(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.undo = data
+	return nil
+}
+
+func (s *memStore) LoadUndo() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.undo
+}
+
+func (s *memStore) ResetUndo() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.undo = nil
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
@@ -0,0 +1,715 @@
+//go:build cgo
+// +build cgo
+
+package session
+
+import (
+	sql "database/sql"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+func init() {
+	stores["sqlite"] = openSqliteStore
+	DefaultStore = "sqlite"
+}
+
+// sqliteStore keeps the storage of a document in sqlite databases, which
+// needs cgo. The directory contains three databases:
+// ops.db, the log of local operations, keyed by logical clock
+// doc.db, the current CRDT document
+// seqV.db, the sequence vector, the acknowledgements and the sites of the peers
+type sqliteStore struct {
+	dir string
+
+	// operations database handle. Long lived handle
+	opsdb *sql.DB // from "database/sql"
+
+	// document database handle. Long lived
+	docdb *sql.DB
+
+	// long-lived Statement for local operations insert
+	opsInsertStmt *sql.Stmt
+
+	// writer's lock of opsInsertStmt
+	opsStmtLock sync.Mutex
+
+	// char insert statement
+	docInsertStmt *sql.Stmt
+
+	// char delete statement
+	docDeleteStmt *sql.Stmt
+
+	// doc writer lock
+	docStmtLock sync.Mutex
+
+	ids atomIDs
+}
+
+// openSqliteStore opens (and creates if necessary) the storage located in dir
+func openSqliteStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	s := &sqliteStore{dir: dir}
+	s.createOpsStorage()
+	s.createDocStorage()
+	s.createSeqVStorage()
+	s.createChatStorage()
+	s.createCommentStorage()
+	return s, nil
+}
+
+// Close releases the database handles
+func (s *sqliteStore) Close() error {
+	s.opsInsertStmt.Close()
+	s.docInsertStmt.Close()
+	s.docDeleteStmt.Close()
+	s.opsdb.Close()
+	return s.docdb.Close()
+}
+
+// This function creates operations storage and prepares a statement for (insert/delete)
+// Each operation in the table is a tuple <Atom, operation, clock, Pos>
+// clock is the primary key
+// Only local operations are logged, so the ops of a document belong to a single client.
+// Note that opsdb will remain open
+func (s *sqliteStore) createOpsStorage() {
+	//Open is used to create a database handle
+	path := filepath.Join(s.dir, "ops.db")
+	var err error
+	// createFlag indicates whether to create a ops table
+	createFlag := true
+
+	// need to check whether the local Ops exists, set createFlag to false if so
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		// they may be situation that file exists but not table, we suppose this is unlikely
+		createFlag = false
+	}
+
+	s.opsdb, err = sql.Open("sqlite3", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//It is rare to Close a DB, as the DB handle is meant to be long-lived and shared between many goroutines.
+
+	if createFlag == true {
+		sqlStmt := `
+		create table ops (
+			 clock integer not null primary key,
+			 atom text,
+			 operation integer,
+			 posIdentifier blob
+			 );
+		delete from ops;
+		`
+		_, err = s.opsdb.Exec(sqlStmt)
+		if err != nil {
+			log.Printf("%q: %s\n", err, sqlStmt)
+			return
+		}
+	}
+
+	s.opsInsertStmt, err = s.opsdb.Prepare("insert into ops(clock, atom, operation, posIdentifier) values(?, ?, ?, ?)")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// do not close the Stmt yet, as it will be used over and over again
+}
+
+// This function creates Doc storage representing the underlying document.
+func (s *sqliteStore) createDocStorage() {
+	//Open is used to create a database handle
+	path := filepath.Join(s.dir, "doc.db")
+	var err error
+	// createFlag indicates whether to create a doc table
+	createFlag := true
+
+	// need to check whether the doc exists, set createFlag to false if so
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		// they may be situation that file exists but not table, we suppose this is unlikely
+		createFlag = false
+	}
+
+	s.docdb, err = sql.Open("sqlite3", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if createFlag == true {
+		sqlStmt := `
+		create table doc (
+			 id integer not null primary key,
+			 atom text,
+			 posIdentifier blob
+			 );
+		delete from doc;
+		`
+		_, err = s.docdb.Exec(sqlStmt)
+		if err != nil {
+			log.Printf("%q: %s\n", err, sqlStmt)
+			return
+		}
+	}
+
+	s.docInsertStmt, err = s.docdb.Prepare("insert or replace into doc(id, atom, posIdentifier) values(?, ?, ?)")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s.docDeleteStmt, err = s.docdb.Prepare("delete from doc where id = ?")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if createFlag == false {
+		// load the last atom ID as well, thread-safe at this point
+		s.loadLastDocID(&s.ids.last)
+	} else {
+		s.resetDoc()
+	}
+
+	// do not close the Stmt yet, as it will be used over and over again
+}
+
+// resetDoc empties the doc table and inserts Start and End
+func (s *sqliteStore) resetDoc() {
+	s.docStmtLock.Lock()
+	defer s.docStmtLock.Unlock()
+
+	if _, err := s.docdb.Exec("delete from doc"); err != nil {
+		log.Fatal(err)
+	}
+	s.docInsertStmt.Exec(0, "", crdt.PosBytes(crdt.Start)) // Start
+	s.docInsertStmt.Exec(1, "", crdt.PosBytes(crdt.End))   // End
+
+	s.ids.reset(1)
+}
+
+// load the id of the very last inserted char
+// assumming id is incrementing, the last id is the max id
+// Pre: docDB hanble must be open
+func (s *sqliteStore) loadLastDocID(id *uint64) {
+	// LastID may need to be changed
+	rows, err := s.docdb.Query("select MAX(id) as LastID from doc")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() { // only iterate once
+		err = rows.Scan(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+}
+
+// Insert (or replace) a char in the docDB
+func (s *sqliteStore) PutAtom(id uint64, atom string, posIdentifier []crdt.Identifier) error {
+	// convert pos to bytes array
+	posBytes := crdt.PosBytes(posIdentifier)
+	s.docStmtLock.Lock()
+	_, err := s.docInsertStmt.Exec(id, atom, posBytes)
+	s.docStmtLock.Unlock()
+	if err != nil {
+		log.Fatal(err)
+		return errors.New("unable to write to char to docDB")
+	}
+
+	return nil
+
+}
+
+// Delete a char from the docDB
+func (s *sqliteStore) DeleteAtom(id uint64) error {
+	s.docStmtLock.Lock()
+	_, err := s.docDeleteStmt.Exec(id)
+	s.docStmtLock.Unlock()
+	if err != nil {
+		log.Fatal(err)
+		return errors.New("unable to delete a char from docDB")
+	}
+
+	return nil
+
+}
+
+// SaveDocument replaces the content of the doc table with the given document.
+// This is used when a buffer starts being shared. docdb IDs are assigned to
+// the pairs of the document on the way.
+func (s *sqliteStore) SaveDocument(d crdt.Sequence) error {
+	s.resetDoc()
+
+	s.docStmtLock.Lock()
+	defer s.docStmtLock.Unlock()
+
+	tx, err := s.docdb.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	stmt := tx.Stmt(s.docInsertStmt)
+	atoms := d.Atoms()
+	for i := range atoms {
+		atoms[i].ID = s.NextAtomID()
+		if _, err := stmt.Exec(atoms[i].ID, atoms[i].Atom, crdt.PosBytes(atoms[i].Pos)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return tx.Commit()
+}
+
+// NextAtomID returns the next available char ID and advance the last inserted id
+func (s *sqliteStore) NextAtomID() uint64 {
+	return s.ids.next()
+}
+
+// LoadDocument loads from docdb and insert all chars into CRDT document
+func (s *sqliteStore) LoadDocument(d crdt.Sequence) {
+	// select all from docdb database and insert using binary search
+	rows, err := s.docdb.Query("select id, atom, posIdentifier from doc")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() { // should be sorted by id already
+		var ID uint64
+		var atom string
+		var posIdentifier []byte
+		err = rows.Scan(&ID, &atom, &posIdentifier)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		d.InsertPos(crdt.NewPos(posIdentifier), atom, ID)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// AppendOp writes a local operation to the ops table
+func (s *sqliteStore) AppendOp(op crdt.Operation) error {
+	s.opsStmtLock.Lock()
+	_, err := s.opsInsertStmt.Exec(op.Clock, op.Atom, op.OpType, op.Pos)
+	s.opsStmtLock.Unlock()
+	if err != nil {
+		log.Fatal(err)
+		return errors.New("unable to write to ops table")
+	}
+
+	return nil
+}
+
+// ResetOps drops every logged operation. This is used when a buffer is shared
+// with a content that does not match the stored document anymore.
+func (s *sqliteStore) ResetOps() error {
+	s.opsStmtLock.Lock()
+	defer s.opsStmtLock.Unlock()
+	_, err := s.opsdb.Exec("delete from ops")
+	return err
+}
+
+// DropOps drops the logged operations up to the given clock. This is used
+// to compact the ops table once the peers have stored them
+func (s *sqliteStore) DropOps(to uint64) error {
+	s.opsStmtLock.Lock()
+	defer s.opsStmtLock.Unlock()
+	_, err := s.opsdb.Exec("delete from ops where clock <= ?", to)
+	return err
+}
+
+// This function creates the seqV storage in the document directory
+// if it does not exist yet, and the acks and sites tables if they are missing
+func (s *sqliteStore) createSeqVStorage() {
+	path := filepath.Join(s.dir, "seqV.db")
+	// need to check whether the file exists, create the seqV table if not
+	_, err := os.Stat(path)
+	createFlag := os.IsNotExist(err)
+
+	db, err := sql.Open("sqlite3", path) // a potential issues is corruption with the database
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if createFlag {
+		// The file does not exist, this is a new file
+		// create a seqVector table associated with the file
+		sqlStmt := `
+		create table seqV (
+			 clientID text not null primary key,
+			 clock integer
+			 );
+		delete from seqV;
+		`
+		if _, err = db.Exec(sqlStmt); err != nil {
+			log.Printf("%q: %s\n", err, sqlStmt)
+			return
+		}
+	}
+
+	// storages created before acknowledgements and sites existed lack
+	// their tables
+	sqlStmt := `
+	create table if not exists acks (
+		 clientID text not null primary key,
+		 clock integer
+		 );
+	create table if not exists sites (
+		 site integer not null primary key,
+		 clientID text
+		 );
+	`
+	if _, err = db.Exec(sqlStmt); err != nil {
+		log.Printf("%q: %s\n", err, sqlStmt)
+	}
+}
+
+// SaveClocks saves entries of the sequence vector back to storage.
+// Entries of peers that are not in the table yet are created, the others
+// are updated
+func (s *sqliteStore) SaveClocks(clocks map[string]uint64) error {
+	return s.saveVector("seqV", clocks)
+}
+
+// SaveAcks saves the clocks of ours acknowledged by the peers, in the same
+// way as SaveClocks
+func (s *sqliteStore) SaveAcks(acks map[string]uint64) error {
+	return s.saveVector("acks", acks)
+}
+
+// saveVector inserts or replaces the clocks of the peers in a table of seqV.db
+func (s *sqliteStore) saveVector(table string, clocks map[string]uint64) error {
+	path := filepath.Join(s.dir, "seqV.db")
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin() // transaction
+	if err != nil {
+		return err
+	}
+
+	statement, err := tx.Prepare("insert or replace into " + table + "(clientID, clock) values(?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer statement.Close()
+
+	// iterating over the map
+	for clientK, clock := range clocks {
+		if _, err = statement.Exec(clientK, clock); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ResetClocks clears the stored sequence vector and acknowledgements
+func (s *sqliteStore) ResetClocks() error {
+	db, err := sql.Open("sqlite3", filepath.Join(s.dir, "seqV.db"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("delete from seqV; delete from acks")
+	return err
+}
+
+// LoadClocks loads the sequence vector from storage.
+// This should be called once when a document starts being shared
+func (s *sqliteStore) LoadClocks() map[string]uint64 {
+	return s.loadVector("seqV")
+}
+
+// LoadAcks loads the clocks of ours acknowledged by the peers
+func (s *sqliteStore) LoadAcks() map[string]uint64 {
+	return s.loadVector("acks")
+}
+
+// loadVector reads the clocks of the peers from a table of seqV.db
+func (s *sqliteStore) loadVector(table string) map[string]uint64 {
+	db, err := sql.Open("sqlite3", filepath.Join(s.dir, "seqV.db"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// query
+	rows, err := db.Query("select clientID, clock from " + table)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	clocks := make(map[string]uint64)
+	for rows.Next() {
+		var clientID string
+		var clock uint64
+		err = rows.Scan(&clientID, &clock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clocks[clientID] = clock // assignment
+	}
+	return clocks
+}
+
+// SaveSites inserts or replaces the sites of the peers
+func (s *sqliteStore) SaveSites(sites map[uint8]string) error {
+	db, err := sql.Open("sqlite3", filepath.Join(s.dir, "seqV.db"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	statement, err := tx.Prepare("insert or replace into sites(site, clientID) values(?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer statement.Close()
+
+	for site, peer := range sites {
+		if _, err = statement.Exec(site, peer); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadSites loads the sites of the peers
+func (s *sqliteStore) LoadSites() map[uint8]string {
+	db, err := sql.Open("sqlite3", filepath.Join(s.dir, "seqV.db"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("select site, clientID from sites")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	sites := make(map[uint8]string)
+	for rows.Next() {
+		var site uint8
+		var peer string
+		if err := rows.Scan(&site, &peer); err != nil {
+			log.Fatal(err)
+		}
+		sites[site] = peer
+	}
+	return sites
+}
+
+// LastClock returns the clock of the last logged operation
+func (s *sqliteStore) LastClock() uint64 {
+	rows, err := s.opsdb.Query("select MAX(clock) as Lastclock from ops")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	var lastClock sql.NullInt64
+	for rows.Next() { // only iterate once
+		err = rows.Scan(&lastClock)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return uint64(lastClock.Int64)
+}
+
+// This function select operations between receiverClock and localClock
+// In this minimum where they are equal, the return value contains one operation
+func (s *sqliteStore) Ops(ReceiverClock, localClock uint64) (patch []crdt.Operation) {
+	if ReceiverClock > localClock {
+		return nil
+	}
+	// query on opsdb directly
+	rows, err := s.opsdb.Query("select clock, atom, operation, posIdentifier from ops where clock between ? and ? order by clock", ReceiverClock, localClock) // select by range
+	if err != nil {
+		log.Fatal(err)
+	} // as long as there’s an open result set (represented by rows), the underlying connection is busy and can’t be used for any other query.
+	defer rows.Close() //We defer rows.Close(). This is very important.
+
+	patch = make([]crdt.Operation, 0, localClock-ReceiverClock+1)
+
+	for rows.Next() {
+		var op crdt.Operation
+		err = rows.Scan(&op.Clock,
+			&op.Atom,
+			&op.OpType,
+			&op.Pos) // this obtains data
+		if err != nil { // If there’s an error during the loop, you need to know about it.
+			log.Fatal(err)
+		}
+		patch = append(patch, op)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return patch
+}
+
+// createChatStorage creates the table of chat messages in the ops database
+func (s *sqliteStore) createChatStorage() {
+	sqlStmt := `
+	create table if not exists chat (
+		 time integer,
+		 sender text,
+		 text text
+		 );
+	`
+	if _, err := s.opsdb.Exec(sqlStmt); err != nil {
+		log.Printf("%q: %s\n", err, sqlStmt)
+	}
+}
+
+// AppendChat stores a chat message
+func (s *sqliteStore) AppendChat(m ChatMessage) error {
+	s.opsStmtLock.Lock()
+	defer s.opsStmtLock.Unlock()
+	_, err := s.opsdb.Exec("insert into chat(time, sender, text) values(?, ?, ?)", m.Time.UnixNano(), m.From, m.Text)
+	if err != nil {
+		return errors.New("unable to write to chat table")
+	}
+	return nil
+}
+
+// LoadChat returns the stored chat messages, oldest first
+func (s *sqliteStore) LoadChat() []ChatMessage {
+	rows, err := s.opsdb.Query("select time, sender, text from chat order by time")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	var msgs []ChatMessage
+	for rows.Next() {
+		var m ChatMessage
+		var t int64
+		if err := rows.Scan(&t, &m.From, &m.Text); err != nil {
+			log.Fatal(err)
+		}
+		m.Time = time.Unix(0, t)
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// createCommentStorage creates the table of comments in the ops database
+func (s *sqliteStore) createCommentStorage() {
+	sqlStmt := `
+	create table if not exists comments (
+		 id text primary key,
+		 reply_to text,
+		 sender text,
+		 start blob,
+		 end blob,
+		 text text,
+		 time integer
+		 );
+	`
+	if _, err := s.opsdb.Exec(sqlStmt); err != nil {
+		log.Printf("%q: %s\n", err, sqlStmt)
+	}
+}
+
+// AppendComment stores a comment
+func (s *sqliteStore) AppendComment(c Comment) error {
+	s.opsStmtLock.Lock()
+	defer s.opsStmtLock.Unlock()
+	_, err := s.opsdb.Exec("insert or ignore into comments(id, reply_to, sender, start, end, text, time) values(?, ?, ?, ?, ?, ?, ?)",
+		c.ID, c.ReplyTo, c.From, c.Start, c.End, c.Text, c.Time.UnixNano())
+	if err != nil {
+		return errors.New("unable to write to comments table")
+	}
+	return nil
+}
+
+// LoadComments returns the stored comments, oldest first
+func (s *sqliteStore) LoadComments() []Comment {
+	rows, err := s.opsdb.Query("select id, reply_to, sender, start, end, text, time from comments order by time")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var c Comment
+		var t int64
+		if err := rows.Scan(&c.ID, &c.ReplyTo, &c.From, &c.Start, &c.End, &c.Text, &t); err != nil {
+			log.Fatal(err)
+		}
+		c.Time = time.Unix(0, t)
+		comments = append(comments, c)
+	}
+	return comments
+}
+
+// SaveUndo writes the undo history of the document
+func (s *sqliteStore) SaveUndo(data []byte) error {
+	return ioutil.WriteFile(filepath.Join(s.dir, "undo"), data, 0644)
+}
+
+// LoadUndo reads the undo history of the document, nil if there is none
+func (s *sqliteStore) LoadUndo() []byte {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "undo"))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// ResetUndo removes the undo history, which refers to the operations of the ops table
+func (s *sqliteStore) ResetUndo() error {
+	err := os.Remove(filepath.Join(s.dir, "undo"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package session
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// testStores runs f on a new store of every available kind
+func testStores(t *testing.T, f func(t *testing.T, kind, dir string, s Store)) {
+	for _, kind := range StoreKinds() {
+		t.Run(kind, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "micro-store")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s, err := openStore(kind, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f(t, kind, dir, s)
+		})
+	}
+}
+
+func TestStoreOps(t *testing.T) {
+	testStores(t, func(t *testing.T, kind, dir string, s Store) {
+		defer s.Close()
+
+		if s.LastClock() != 0 {
+			t.Fatalf("expected no ops, last clock is %d", s.LastClock())
+		}
+		for c := uint64(1); c <= 5; c++ {
+			op := crdt.Operation{Atom: "a", OpType: c%2 == 1, Pos: crdt.PosBytes(crdt.End), Clock: c}
+			if err := s.AppendOp(op); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ops := s.Ops(2, 4)
+		if len(ops) != 3 || ops[0].Clock != 2 || ops[2].Clock != 4 {
+			t.Fatalf("unexpected ops %v", ops)
+		}
+		if ops[0].OpType || !ops[1].OpType {
+			t.Fatalf("operation types were not kept: %v", ops)
+		}
+		if s.LastClock() != 5 {
+			t.Fatalf("expected last clock 5, got %d", s.LastClock())
+		}
+
+		if err := s.DropOps(2); err != nil {
+			t.Fatal(err)
+		}
+		if ops := s.Ops(1, 5); len(ops) != 3 || ops[0].Clock != 3 {
+			t.Fatalf("unexpected ops after dropping: %v", ops)
+		}
+		if s.LastClock() != 5 {
+			t.Fatalf("dropping ops changed the last clock to %d", s.LastClock())
+		}
+
+		if err := s.ResetOps(); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Ops(1, 5)) != 0 || s.LastClock() != 0 {
+			t.Fatal("ops were not reset")
+		}
+	})
+}
+
+func TestStoreDocument(t *testing.T) {
+	testStores(t, func(t *testing.T, kind, dir string, s Store) {
+		d := crdt.NewDocument(3, "hello")
+		if err := s.SaveDocument(d); err != nil {
+			t.Fatal(err)
+		}
+
+		// append an atom after "hello", a single run, and delete the "h"
+		run := d.Atoms()[0]
+		p, _ := crdt.GeneratePos(crdt.RunPos(run.Pos, 4), crdt.End, 3)
+		id := s.NextAtomID()
+		if err := s.PutAtom(id, "!", p); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutAtom(run.ID, "ello", crdt.RunPos(run.Pos, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := storedContent(s); got != "ello!" {
+			t.Fatalf("expected %q, got %q", "ello!", got)
+		}
+
+		if err := s.SaveClocks(map[string]uint64{"10.0.0.1:7001": 4, "10.0.0.2:7002": 2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveClocks(map[string]uint64{"10.0.0.2:7002": 3}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveAcks(map[string]uint64{"10.0.0.1:7001": 6}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveSites(map[uint8]string{1: "10.0.0.1:7001", 2: "10.0.0.2:7002"}); err != nil {
+			t.Fatal(err)
+		}
+		msg := ChatMessage{From: "10.0.0.1:7001", Text: "hi", Time: time.Unix(1, 0)}
+		if err := s.AppendChat(msg); err != nil {
+			t.Fatal(err)
+		}
+		comment := Comment{ID: "10.0.0.1:7001/1", From: "10.0.0.1:7001", Start: []byte{1, 0, 1, 0}, End: []byte{1, 0, 2, 0}, Text: "why?", Time: time.Unix(2, 0)}
+		if err := s.AppendComment(comment); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveUndo([]byte("undo")); err != nil {
+			t.Fatal(err)
+		}
+
+		if kind != "memory" {
+			// everything must survive reopening the store
+			s.Close()
+			var err error
+			if s, err = openStore(kind, dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		defer s.Close()
+
+		if got := storedContent(s); got != "ello!" {
+			t.Fatalf("expected %q, got %q", "ello!", got)
+		}
+		if next := s.NextAtomID(); next <= id {
+			t.Fatalf("atom ID %d handed out again", next)
+		}
+		clocks := s.LoadClocks()
+		if len(clocks) != 2 || clocks["10.0.0.1:7001"] != 4 || clocks["10.0.0.2:7002"] != 3 {
+			t.Fatalf("unexpected clocks %v", clocks)
+		}
+		if acks := s.LoadAcks(); len(acks) != 1 || acks["10.0.0.1:7001"] != 6 {
+			t.Fatalf("unexpected acks %v", acks)
+		}
+		if sites := s.LoadSites(); len(sites) != 2 || sites[1] != "10.0.0.1:7001" || sites[2] != "10.0.0.2:7002" {
+			t.Fatalf("unexpected sites %v", sites)
+		}
+		chat := s.LoadChat()
+		if len(chat) != 1 || chat[0].Text != "hi" || !chat[0].Time.Equal(msg.Time) {
+			t.Fatalf("unexpected chat %v", chat)
+		}
+		comments := s.LoadComments()
+		if len(comments) != 1 || comments[0].Text != "why?" || string(comments[0].End) != string(comment.End) || !comments[0].Time.Equal(comment.Time) {
+			t.Fatalf("unexpected comments %v", comments)
+		}
+		if string(s.LoadUndo()) != "undo" {
+			t.Fatal("the undo history was not kept")
+		}
+
+		if err := s.ResetClocks(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.ResetUndo(); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.LoadClocks()) != 0 || len(s.LoadAcks()) != 0 || s.LoadUndo() != nil {
+			t.Fatal("clocks, acks or undo history were not reset")
+		}
+		if got := storedContent(s); got != "ello!" {
+			t.Fatalf("resetting the clocks changed the document to %q", got)
+		}
+	})
+}
+
+// storedContent returns the text of the document stored as a Logoot sequence
+func storedContent(s Store) string {
+	d := crdt.NewDocument(3, "")
+	s.LoadDocument(d)
+	return d.Content()
+}
+
+// failingStore is a store which cannot write chat messages
+type failingStore struct {
+	Store
+}
+
+func (failingStore) AppendChat(m ChatMessage) error {
+	return errors.New("disk full")
+}
+
+func TestStorageError(t *testing.T) {
+	sim := newSimulation(t, 1, 43, "stored\n")
+	defer sim.close()
+
+	s := sim.peers[0].session
+	errs := make(chan error, 1)
+	s.Serve(Callbacks{StorageError: func(err error) { errs <- err }})
+	s.store = failingStore{s.store}
+	s.Say("lost")
+	select {
+	case err := <-errs:
+		if err.Error() != "disk full" {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the storage error is not reported")
+	}
+}
@@ -0,0 +1,405 @@
+package session
+
+import (
+	"errors"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Terminals are shared by a host with the peers it is connected to in any
+// session. The sharing host keeps the screen it last sent, and sends the
+// lines which changed since as a frame, in order, to every peer watching.
+// A peer starting to watch, or falling behind, gets a full frame. Watchers
+// only see the screen unless they are given input rights, then what they
+// type is written to the terminal.
+
+// TermCell is a character of a terminal screen and its colors, as numbers
+// of the 256 color palette or -1 for the default
+type TermCell struct {
+	Ch     rune
+	Fg, Bg int
+}
+
+// TermFrame is a change of the screen of a shared terminal
+type TermFrame struct {
+	Term          string // name of the terminal on the sharing host
+	From          string // ip:port of the sharing host
+	Seq           uint64 // frames of a terminal are numbered from 1, in order
+	Width, Height int
+	// Lines holds the lines which changed, indexed by row, or all of them
+	// in a full frame
+	Lines   map[int][]TermCell
+	Full    bool
+	CursorX int
+	CursorY int
+	Cursor  bool // whether the cursor is shown
+	Input   bool // whether the watcher may type in the terminal
+	Closed  bool // the terminal is gone, no frames follow
+}
+
+// termQueue is the number of frames queued for a watcher, past which it
+// gets a full frame once it caught up
+const termQueue = 64
+
+// SharedTerm is a terminal of ours the peers can watch
+type SharedTerm struct {
+	h    *Host
+	name string
+	// input is called with what a peer with input rights typed
+	input func(peer, data string)
+
+	// protects the fields below
+	mu       sync.Mutex
+	frame    TermFrame // last full frame
+	watchers map[string]*termWatcher
+	closed   bool
+}
+
+// termWatcher is a peer watching a shared terminal
+type termWatcher struct {
+	client *rpc.Client
+	input  bool
+	frames chan TermFrame
+	// stale is set when frames were dropped, the next one sent is full
+	stale bool
+}
+
+// ShareTerm lets the peers watch a terminal with the given title. It is
+// shared under the title followed by a number, unique for as long as we
+// run, so that terminals with the same title do not collide and a watcher
+// of a closed terminal never gets the frames of a later one. input is
+// called, from the goroutines serving the peers, with what the peers given
+// input rights type
+func (h *Host) ShareTerm(title string, input func(peer, data string)) *SharedTerm {
+	h.termsMu.Lock()
+	defer h.termsMu.Unlock()
+	h.termSeq++
+	name := title + "#" + strconv.Itoa(h.termSeq)
+	t := &SharedTerm{
+		h:        h,
+		name:     name,
+		input:    input,
+		frame:    TermFrame{Term: name, From: h.addr, Full: true, Lines: map[int][]TermCell{}},
+		watchers: make(map[string]*termWatcher),
+	}
+	h.terms[name] = t
+	return t
+}
+
+// sharedTerm returns the terminal of ours shared under the given name, nil if none
+func (h *Host) sharedTerm(name string) *SharedTerm {
+	h.termsMu.Lock()
+	defer h.termsMu.Unlock()
+	return h.terms[name]
+}
+
+// SharedTerms returns the names of the terminals of ours the peers can
+// watch, in alphabetical order
+func (h *Host) SharedTerms() []string {
+	h.termsMu.Lock()
+	defer h.termsMu.Unlock()
+	names := make([]string, 0, len(h.terms))
+	for name := range h.terms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Name returns the name the terminal is shared under
+func (t *SharedTerm) Name() string {
+	return t.name
+}
+
+// Publish sends the peers watching the lines of the screen which changed
+// since the last call, together with the cursor. screen holds the lines
+// of the terminal from the top
+func (t *SharedTerm) Publish(screen [][]TermCell, cursorX, cursorY int, cursor bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+
+	height, width := len(screen), 0
+	if height > 0 {
+		width = len(screen[0])
+	}
+	f := TermFrame{
+		Term:    t.name,
+		From:    t.h.addr,
+		Width:   width,
+		Height:  height,
+		Lines:   make(map[int][]TermCell),
+		CursorX: cursorX,
+		CursorY: cursorY,
+		Cursor:  cursor,
+	}
+	resized := width != t.frame.Width || height != t.frame.Height
+	for y, line := range screen {
+		if resized || !sameCells(line, t.frame.Lines[y]) {
+			f.Lines[y] = append([]TermCell(nil), line...)
+		}
+	}
+	f.Full = resized
+	if len(f.Lines) == 0 && !resized && cursorX == t.frame.CursorX && cursorY == t.frame.CursorY && cursor == t.frame.Cursor {
+		return
+	}
+
+	// the last full frame follows the screen
+	for y, line := range f.Lines {
+		t.frame.Lines[y] = line
+	}
+	for y := range t.frame.Lines {
+		if y >= height {
+			delete(t.frame.Lines, y)
+		}
+	}
+	t.frame.Seq++
+	t.frame.Width, t.frame.Height = width, height
+	t.frame.CursorX, t.frame.CursorY, t.frame.Cursor = cursorX, cursorY, cursor
+	f.Seq = t.frame.Seq
+
+	for _, w := range t.watchers {
+		t.queue(w, f)
+	}
+}
+
+// sameCells returns whether two lines of a screen are the same
+func sameCells(a, b []TermCell) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// full returns a full frame of the screen
+// Pre: t.mu is locked
+func (t *SharedTerm) full() TermFrame {
+	f := t.frame
+	f.Full = true
+	f.Lines = make(map[int][]TermCell, len(t.frame.Lines))
+	for y, line := range t.frame.Lines {
+		f.Lines[y] = line
+	}
+	return f
+}
+
+// queue queues a frame for a watcher, or marks it stale if it is behind
+// Pre: t.mu is locked
+func (t *SharedTerm) queue(w *termWatcher, f TermFrame) {
+	if w.stale {
+		return
+	}
+	f.Input = w.input
+	select {
+	case w.frames <- f:
+	default:
+		w.stale = true
+	}
+}
+
+// send sends the frames queued for a watcher until it stops watching
+func (t *SharedTerm) send(peer string, w *termWatcher) {
+	for f := range w.frames {
+		var reply ValReply
+		if err := callPeer(w.client, "EntangleClient.TermFrame", f, &reply); err != nil {
+			t.unwatch(peer, w)
+			return
+		}
+
+		// a watcher which fell behind gets the whole screen
+		t.mu.Lock()
+		if w.stale && len(w.frames) == 0 && t.watchers[peer] == w {
+			w.stale = false
+			t.queue(w, t.full())
+		}
+		t.mu.Unlock()
+	}
+}
+
+// watch adds a peer to the watchers, the first frame it is sent is full
+func (t *SharedTerm) watch(peer string, client *rpc.Client) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return errors.New(t.name + " is not shared anymore")
+	}
+	input := false
+	if old := t.watchers[peer]; old != nil {
+		input = old.input
+		close(old.frames)
+	}
+	w := &termWatcher{client: client, input: input, frames: make(chan TermFrame, termQueue)}
+	t.watchers[peer] = w
+	t.queue(w, t.full())
+	go t.send(peer, w)
+	return nil
+}
+
+// unwatch removes a peer from the watchers, if w is the watcher it is, or nil
+func (t *SharedTerm) unwatch(peer string, w *termWatcher) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old := t.watchers[peer]; old != nil && (w == nil || old == w) {
+		close(old.frames)
+		delete(t.watchers, peer)
+	}
+}
+
+// Watchers returns the peers watching the terminal, in alphabetical order,
+// and whether each of them has input rights
+func (t *SharedTerm) Watchers() ([]string, map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var peers []string
+	input := make(map[string]bool, len(t.watchers))
+	for peer, w := range t.watchers {
+		peers = append(peers, peer)
+		input[peer] = w.input
+	}
+	sort.Strings(peers)
+	return peers, input
+}
+
+// Grant gives a peer watching the terminal input rights, or takes them
+// back. The peer is told with the next frame, which is sent right away
+func (t *SharedTerm) Grant(peer string, input bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w := t.watchers[peer]
+	if w == nil {
+		return errors.New(peer + " is not watching " + t.name)
+	}
+	w.input = input
+	t.queue(w, t.full())
+	return nil
+}
+
+// typed writes what a peer typed to the terminal, if it has input rights
+func (t *SharedTerm) typed(peer, data string) error {
+	t.mu.Lock()
+	w := t.watchers[peer]
+	allowed := w != nil && w.input && !t.closed
+	t.mu.Unlock()
+	if !allowed {
+		return errors.New(peer + " cannot type in " + t.name)
+	}
+	if t.input != nil {
+		t.input(peer, data)
+	}
+	return nil
+}
+
+// Close stops sharing the terminal. The watchers get a last frame telling
+// them it is gone
+func (t *SharedTerm) Close() {
+	t.h.termsMu.Lock()
+	if t.h.terms[t.name] == t {
+		delete(t.h.terms, t.name)
+	}
+	t.h.termsMu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	for peer, w := range t.watchers {
+		f := t.full()
+		f.Closed = true
+		// the last frame is sent even to a watcher behind, in place of
+		// a queued one since it is full
+		select {
+		case <-w.frames:
+		default:
+		}
+		w.stale = false
+		t.queue(w, f)
+		close(w.frames)
+		delete(t.watchers, peer)
+	}
+}
+
+// WatchTerm starts watching a terminal a peer shares. The frames, the first
+// one full, are handed to frame in order from the goroutines serving the
+// peers. It fails if we are not connected to the peer in any session
+func (h *Host) WatchTerm(peer, name string, frame func(f TermFrame)) error {
+	client := h.clients()[peer]
+	if client == nil {
+		return errors.New("not connected to " + peer)
+	}
+
+	key := peer + "/" + name
+	h.termsMu.Lock()
+	h.watching[key] = frame
+	h.termsMu.Unlock()
+
+	args := TermArgs{Clientid: h.addr, Term: name}
+	var reply ValReply
+	if err := callPeer(client, "EntangleClient.WatchTerm", args, &reply); err != nil {
+		h.termsMu.Lock()
+		delete(h.watching, key)
+		h.termsMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// UnwatchTerm stops watching a terminal of a peer
+func (h *Host) UnwatchTerm(peer, name string) {
+	h.termsMu.Lock()
+	delete(h.watching, peer+"/"+name)
+	h.termsMu.Unlock()
+
+	if client := h.clients()[peer]; client != nil {
+		var reply ValReply
+		callPeer(client, "EntangleClient.UnwatchTerm", TermArgs{Clientid: h.addr, Term: name}, &reply)
+	}
+}
+
+// PeerTerms returns the names of the terminals a peer shares
+func (h *Host) PeerTerms(peer string) ([]string, error) {
+	client := h.clients()[peer]
+	if client == nil {
+		return nil, errors.New("not connected to " + peer)
+	}
+	var reply TermsReply
+	if err := callPeer(client, "EntangleClient.Terms", TermArgs{Clientid: h.addr}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Terms, nil
+}
+
+// TermInput types data in a terminal of a peer, which must have given us
+// input rights
+func (h *Host) TermInput(peer, name, data string) error {
+	client := h.clients()[peer]
+	if client == nil {
+		return errors.New("not connected to " + peer)
+	}
+	var reply ValReply
+	return callPeer(client, "EntangleClient.TermInput", TermArgs{Clientid: h.addr, Term: name, Data: data}, &reply)
+}
+
+// receiveFrame hands a frame of a terminal we watch to its consumer
+func (h *Host) receiveFrame(f TermFrame) {
+	key := f.From + "/" + f.Term
+	h.termsMu.Lock()
+	frame := h.watching[key]
+	if f.Closed {
+		delete(h.watching, key)
+	}
+	h.termsMu.Unlock()
+	if frame != nil {
+		frame(f)
+	}
+}
@@ -0,0 +1,133 @@
+package session
+
+import (
+	"net/rpc"
+	"sync"
+	"testing"
+)
+
+// screenOf returns a screen showing the given lines
+func screenOf(lines ...string) [][]TermCell {
+	screen := make([][]TermCell, len(lines))
+	for y, l := range lines {
+		for _, r := range l {
+			screen[y] = append(screen[y], TermCell{r, -1, -1})
+		}
+	}
+	return screen
+}
+
+// watchedTerm rebuilds the screen of a terminal from its frames
+type watchedTerm struct {
+	mu     sync.Mutex
+	lines  map[int][]TermCell
+	input  bool
+	closed bool
+}
+
+func (w *watchedTerm) frame(f TermFrame) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if f.Full {
+		w.lines = make(map[int][]TermCell)
+	}
+	for y, l := range f.Lines {
+		w.lines[y] = l
+	}
+	w.input, w.closed = f.Input, f.Closed
+}
+
+func (w *watchedTerm) line(y int) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var s []rune
+	for _, c := range w.lines[y] {
+		s = append(s, c.Ch)
+	}
+	return string(s)
+}
+
+func TestSharedTerm(t *testing.T) {
+	sim := newSimulation(t, 3, 37, "terminal\n")
+	defer sim.close()
+
+	first, other, last := sim.peers[0], sim.peers[1], sim.peers[2]
+	typed := make(chan string, 4)
+	term := first.host.ShareTerm("sh:1", func(peer, data string) { typed <- peer + " " + data })
+	term.Publish(screenOf("$ make test", "    "), 4, 1, true)
+	// terminals with the same title are shared under different names
+	same := first.host.ShareTerm("sh:1", nil)
+	if same.Name() == term.Name() {
+		t.Fatalf("two terminals shared as %s", term.Name())
+	}
+	same.Close()
+
+	names, err := last.host.PeerTerms(first.addr)
+	if err != nil || len(names) != 1 || names[0] != term.Name() {
+		t.Fatalf("unexpected terminals %v, %v", names, err)
+	}
+	w := &watchedTerm{}
+	if err := last.host.WatchTerm(first.addr, term.Name(), w.frame); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return w.line(0) == "$ make test" })
+
+	// only the changed lines are sent
+	term.Publish(screenOf("$ make test", "ok  "), 4, 1, true)
+	waitFor(t, func() bool { return w.line(1) == "ok  " })
+	if w.line(0) != "$ make test" {
+		t.Fatalf("unexpected first line %q", w.line(0))
+	}
+
+	// the watcher may only type once granted input rights
+	if err := last.host.TermInput(first.addr, term.Name(), "q"); err == nil {
+		t.Fatal("a read-only watcher typed in the terminal")
+	}
+	if err := term.Grant(last.addr, true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.input
+	})
+	if err := last.host.TermInput(first.addr, term.Name(), "q"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-typed; got != last.addr+" q" {
+		t.Fatalf("unexpected input %q", got)
+	}
+	// the input rights are those of the caller, not of the peer it names
+	var reply ValReply
+	spoofed := TermArgs{Clientid: last.addr, Term: term.Name(), Data: "rm -rf ~"}
+	if err := other.host.TermInput(first.addr, term.Name(), "ls"); err == nil {
+		t.Fatal("a peer not watching typed in the terminal")
+	}
+	if err := callPeer(other.host.clients()[first.addr], "EntangleClient.TermInput", spoofed, &reply); err == nil {
+		t.Fatal("a peer typed as the granted watcher")
+	}
+	conn, err := sim.nw.transport("10.0.0.9:7000").Dial(first.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsider := rpc.NewClient(conn)
+	defer outsider.Close()
+	if err := callPeer(outsider, "EntangleClient.TermInput", spoofed, &reply); err == nil {
+		t.Fatal("an outsider typed as the granted watcher")
+	}
+	select {
+	case got := <-typed:
+		t.Fatalf("ungranted input %q reached the terminal", got)
+	default:
+	}
+
+	term.Close()
+	waitFor(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.closed
+	})
+	if len(first.host.SharedTerms()) != 0 {
+		t.Fatal("the terminal is still shared")
+	}
+}
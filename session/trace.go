@@ -0,0 +1,281 @@
+package session
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
+
+// The kinds of trace events
+const (
+	// TraceStart holds the whole document, when tracing starts or when
+	// the document is shared
+	TraceStart = "start"
+	// TraceLocal holds operations typed locally
+	TraceLocal = "local"
+	// TraceRemote holds operations applied from a peer
+	TraceRemote = "remote"
+	// TraceSync holds a synchronization message sent to or received from a peer
+	TraceSync = "sync"
+)
+
+// TraceEvent is a line of a trace. Hash is the content hash of the document
+// once the event took place
+type TraceEvent struct {
+	Time   time.Time
+	DocID  string
+	Kind   string
+	Peer   string            `json:",omitempty"` // peer the event comes from or goes to
+	Ops    []crdt.Operation  `json:",omitempty"`
+	Sync   *SyncArgs         `json:",omitempty"`
+	Clocks map[string]uint64 `json:",omitempty"` // sequence vector, for start events
+	// Sequence is the kind of sequence of the document, for start events.
+	// Traces which do not have it are of Logoot documents
+	Sequence string `json:",omitempty"`
+	Hash     string
+}
+
+// tracer writes the trace events of a host to a JSONL file, nothing if no
+// file is open
+type tracer struct {
+	path string
+	file *os.File
+	enc  *json.Encoder
+	// err is the error which stopped the recording, nil if none
+	err error
+	mu  sync.Mutex
+}
+
+// enabled returns whether events are recorded
+func (t *tracer) enabled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.file != nil
+}
+
+// record writes an event to the trace. A trace missing an event cannot be
+// replayed, so the recording stops at the first error, see Host.TraceError
+func (t *tracer) record(ev TraceEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return
+	}
+	ev.Time = time.Now()
+	if err := t.enc.Encode(ev); err != nil {
+		t.err = errors.New("trace error: " + err.Error())
+		t.file.Close()
+		t.path, t.file, t.enc = "", nil, nil
+	}
+}
+
+// open appends the events from now on to the file at path, or stops
+// recording if path is empty. It returns whether a new file was opened
+func (t *tracer) open(path string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if path == t.path {
+		return false, nil
+	}
+	if t.file != nil {
+		t.file.Close()
+		t.file, t.enc = nil, nil
+	}
+	t.path, t.err = "", nil
+	if path == "" {
+		return false, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return false, errors.New("trace error: " + err.Error())
+	}
+	t.path, t.file, t.enc = path, f, json.NewEncoder(f)
+	return true, nil
+}
+
+// Trace records every operation and synchronization message of the shared
+// documents, with the resulting content hash, to the JSONL file at path.
+// Recording stops if path is empty
+func (h *Host) Trace(path string) error {
+	opened, err := h.tracer.open(path)
+	if err != nil {
+		return err
+	}
+	if opened {
+		// the replay starts from the current documents
+		for _, s := range h.Sessions() {
+			s.docMu.Lock()
+			s.traceStart()
+			s.docMu.Unlock()
+		}
+	}
+	return nil
+}
+
+// TraceError returns the error which stopped recording the trace, nil if
+// it is recorded or was not asked for
+func (h *Host) TraceError() error {
+	h.tracer.mu.Lock()
+	defer h.tracer.mu.Unlock()
+	return h.tracer.err
+}
+
+// traceStart records the whole document
+// Pre: the document is locked
+func (s *Session) traceStart() {
+	if !s.host.tracer.enabled() {
+		return
+	}
+	s.host.tracer.record(TraceEvent{
+		DocID:    s.DocID,
+		Kind:     TraceStart,
+		Ops:      crdt.Operations(s.doc.Atoms(), true),
+		Clocks:   s.clocks(),
+		Sequence: s.doc.Kind(),
+		Hash:     contentHash(s.doc),
+	})
+}
+
+// trace records operations, or a synchronization message, exchanged with the peer
+// Pre: the document is locked
+func (s *Session) trace(kind, peer string, ops []crdt.Operation, sync *SyncArgs) {
+	if !s.host.tracer.enabled() {
+		return
+	}
+	s.host.tracer.record(TraceEvent{
+		DocID: s.DocID,
+		Kind:  kind,
+		Peer:  peer,
+		Ops:   ops,
+		Sync:  sync,
+		Hash:  contentHash(s.doc),
+	})
+}
+
+// traceSync records a synchronization message
+func (s *Session) traceSync(peer string, args SyncArgs) {
+	if !s.host.tracer.enabled() {
+		return
+	}
+	s.docMu.Lock()
+	defer s.docMu.Unlock()
+	s.trace(TraceSync, peer, nil, &args)
+}
+
+// contentHash returns the hash of the content of a document
+func contentHash(doc crdt.Sequence) string {
+	sum := sha256.Sum256([]byte(doc.Content()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Divergence is the error returned by Replay when the content of a
+// replayed document differs from the trace
+type Divergence struct {
+	Step  int // line of the trace, starting from 1
+	Event TraceEvent
+	Hash  string // hash of the replayed document
+}
+
+func (d *Divergence) Error() string {
+	ev := d.Event
+	where := ev.Kind
+	if ev.Peer != "" {
+		where += " with " + ev.Peer
+	}
+	return fmt.Sprintf("%s diverges at step %d (%s at %s): hash %.12s, traced %.12s",
+		ev.DocID, d.Step, where, ev.Time.Format(time.RFC3339Nano), d.Hash, ev.Hash)
+}
+
+// Replay re-executes a trace against fresh documents and returns the number
+// of steps replayed. The error is a *Divergence at the first step where the
+// content of the document differs from the trace
+func Replay(r io.Reader) (int, error) {
+	docs := make(map[string]*replayed)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+
+	step := 0
+	for scanner.Scan() {
+		step++
+		var ev TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return step - 1, errors.New("step " + strconv.Itoa(step) + ": " + err.Error())
+		}
+
+		d := docs[ev.DocID]
+		if ev.Kind == TraceStart {
+			kind := ev.Sequence
+			if kind == "" {
+				kind = crdt.Logoot
+			}
+			doc, err := crdt.NewSequence(kind, 0, "")
+			if err != nil {
+				return step - 1, errors.New("step " + strconv.Itoa(step) + ": " + err.Error())
+			}
+			d = &replayed{doc, make(map[string]bool)}
+			docs[ev.DocID] = d
+		} else if d == nil {
+			return step - 1, errors.New("step " + strconv.Itoa(step) + ": " + ev.DocID + " was not started")
+		}
+		d.apply(ev.Ops)
+
+		if hash := contentHash(d.doc); hash != ev.Hash {
+			return step - 1, &Divergence{step, ev, hash}
+		}
+	}
+	return step, scanner.Err()
+}
+
+// replayed is a document being replayed
+type replayed struct {
+	doc crdt.Sequence
+	// positions deleted before being inserted, as in a session
+	early map[string]bool
+}
+
+// apply applies operations to the document the way a session does, rune by
+// rune
+func (r *replayed) apply(ops []crdt.Operation) {
+	for _, op := range ops {
+		pos := crdt.NewPos(op.Pos)
+		if op.OpType && op.Atom == "" { // deleted in a snapshot
+			r.doc.InsertPos(pos, "", 0)
+			continue
+		}
+		k := 0
+		for _, c := range op.Atom {
+			p := crdt.RunPos(pos, k)
+			k++
+			key := string(crdt.PosBytes(p))
+			_, exists := r.doc.Index(p)
+			if op.OpType {
+				if exists {
+					continue
+				}
+				if r.early[key] {
+					delete(r.early, key)
+					if r.doc.KeepsDeleted() {
+						r.doc.InsertPos(p, "", 0)
+					}
+					continue
+				}
+				r.doc.InsertPos(p, string(c), 0)
+			} else if exists {
+				r.doc.DeletePos(p)
+			} else {
+				r.early[key] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestTraceReplay(t *testing.T) {
+	sim := newSimulation(t, 3, 17, "traced\n")
+	defer sim.close()
+
+	path := filepath.Join(sim.dir, "trace.jsonl")
+	traced := sim.peers[1]
+	if err := traced.host.Trace(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		sim.round(sim.randomEdit)
+	}
+	sim.partition([]int{0}, []int{1, 2})
+	sim.round(sim.randomEdit)
+	sim.heal()
+	sim.assertConverged()
+	if err := traced.host.Trace(""); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	steps, err := Replay(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if steps != len(lines) {
+		t.Fatalf("replayed %d steps out of %d", steps, len(lines))
+	}
+
+	// every kind of event was recorded
+	kinds := make(map[string]bool)
+	remote := -1
+	for i, line := range lines {
+		var ev TraceEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			t.Fatal(err)
+		}
+		kinds[ev.Kind] = true
+		if ev.Kind == TraceRemote && ev.Ops[0].OpType && remote < 0 {
+			remote = i
+		}
+	}
+	for _, kind := range []string{TraceStart, TraceLocal, TraceRemote, TraceSync} {
+		if !kinds[kind] {
+			t.Fatalf("no %s event in the trace", kind)
+		}
+	}
+	if remote < 0 {
+		t.Fatal("no remote insertion in the trace")
+	}
+
+	// an insertion altered on the way is found
+	var ev TraceEvent
+	json.Unmarshal(lines[remote], &ev)
+	ev.Ops[0].Atom = "?"
+	if lines[remote], err = json.Marshal(ev); err != nil {
+		t.Fatal(err)
+	}
+	altered := append(bytes.Join(lines, []byte("\n")), '\n')
+	steps, err = Replay(bytes.NewReader(altered))
+	d, ok := err.(*Divergence)
+	if !ok {
+		t.Fatalf("expected a divergence, got %v", err)
+	}
+	if d.Step != remote+1 || steps != remote {
+		t.Fatalf("diverged at step %d after %d steps, expected step %d", d.Step, steps, remote+1)
+	}
+}
+
+func TestTraceError(t *testing.T) {
+	sim := newSimulation(t, 2, 19, "traced\n")
+	defer sim.close()
+
+	path := filepath.Join(sim.dir, "trace.jsonl")
+	traced := sim.peers[0]
+	if err := traced.host.Trace(path); err != nil {
+		t.Fatal(err)
+	}
+	// the file goes away under the tracer
+	traced.host.tracer.file.Close()
+	traced.insert(0, "not ")
+	if traced.host.TraceError() == nil {
+		t.Fatal("the failed write is not reported")
+	}
+	if traced.host.tracer.enabled() {
+		t.Fatal("the recording goes on after a failed write")
+	}
+
+	// tracing again starts afresh
+	if err := traced.host.Trace(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := traced.host.TraceError(); err != nil {
+		t.Fatal(err)
+	}
+}
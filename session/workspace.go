@@ -0,0 +1,304 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The workspace is the tree of the files shared between the peers. It is a
+// map from document IDs to files, where the last change of a file wins:
+// adding, renaming and removing a file replace its entry with a newer one.
+// Removed files are kept as tombstones, so that an older entry cannot bring
+// them back. Peers send their changes to the peers they are connected to,
+// and exchange the whole tree when they connect and on every heartbeat.
+// Only the editors of a session we share with them may change the tree, and
+// only inside it: a path going out of it is dropped.
+
+// File is an entry of the workspace: a shared document and where it goes
+type File struct {
+	DocID   string // document the file is shared as, it does not change
+	Path    string // path of the file, relative to the workspace
+	Owner   string // ip:port of the peer who added the file, to join it from
+	Removed bool
+	Time    time.Time // of the last change
+	From    string    // ip:port of the peer who made the last change
+}
+
+// newer returns whether f is a later change of the file than g
+func (f File) newer(g File) bool {
+	if !f.Time.Equal(g.Time) {
+		return f.Time.After(g.Time)
+	}
+	return f.From > g.From
+}
+
+// ValidPath returns whether a path of the workspace stays inside it: it must
+// be relative, with slashes, and never go up with ..
+func ValidPath(p string) bool {
+	if p == "" || path.IsAbs(p) || strings.Contains(p, "\\") {
+		return false
+	}
+	if local := filepath.FromSlash(p); filepath.IsAbs(local) || filepath.VolumeName(local) != "" {
+		return false
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// WatchFiles sets the function called when a peer changed the workspace,
+// with the previous entry of the file, empty if it is new, and the new one.
+// It is called from the goroutines serving the peers
+func (h *Host) WatchFiles(changed func(old, f File)) {
+	h.filesMu.Lock()
+	defer h.filesMu.Unlock()
+	h.filesChanged = changed
+}
+
+// workspacePath returns the file the workspace is kept in
+func (h *Host) workspacePath() string {
+	return filepath.Join(h.dir, h.clientID+".workspace")
+}
+
+// loadFiles reads the workspace kept by a previous run
+func (h *Host) loadFiles() {
+	data, err := ioutil.ReadFile(h.workspacePath())
+	if err != nil {
+		return
+	}
+	var files []File
+	if err := json.Unmarshal(data, &files); err != nil {
+		return
+	}
+	h.filesMu.Lock()
+	defer h.filesMu.Unlock()
+	for _, f := range files {
+		h.files[f.DocID] = f
+	}
+}
+
+// saveFiles writes the workspace
+// Pre: filesMu is locked
+func (h *Host) saveFiles() error {
+	files := make([]File, 0, len(h.files))
+	for _, f := range h.files {
+		files = append(files, f)
+	}
+	data, err := json.Marshal(files)
+	if err == nil {
+		err = os.MkdirAll(h.dir, os.ModePerm)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(h.workspacePath(), data, 0644)
+	}
+	return err
+}
+
+// Files returns the files of the workspace, removed ones excepted, in the
+// order of their paths
+func (h *Host) Files() []File {
+	h.filesMu.Lock()
+	defer h.filesMu.Unlock()
+	files := make([]File, 0, len(h.files))
+	for _, f := range h.files {
+		if !f.Removed {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Path != files[j].Path {
+			return files[i].Path < files[j].Path
+		}
+		return files[i].DocID < files[j].DocID
+	})
+	return files
+}
+
+// FileAt returns the file of the workspace at the given path. Should peers
+// have added different documents at the same path, the first document ID wins
+func (h *Host) FileAt(path string) (File, bool) {
+	for _, f := range h.Files() {
+		if f.Path == path {
+			return f, true
+		}
+	}
+	return File{}, false
+}
+
+// File returns the file of the workspace holding the given document
+func (h *Host) File(docID string) (File, bool) {
+	h.filesMu.Lock()
+	defer h.filesMu.Unlock()
+	f, ok := h.files[docID]
+	return f, ok && !f.Removed
+}
+
+// AddFile adds a shared document to the workspace at the given path, and
+// sends it to the peers. A file removed earlier comes back
+func (h *Host) AddFile(docID, path string) (File, error) {
+	if !ValidPath(path) {
+		return File{}, errors.New(path + " is outside the workspace")
+	}
+	return h.changeFile(File{DocID: docID, Path: path, Owner: h.addr})
+}
+
+// RenameFile moves a file of the workspace to the given path
+func (h *Host) RenameFile(docID, path string) (File, error) {
+	if !ValidPath(path) {
+		return File{}, errors.New(path + " is outside the workspace")
+	}
+	f, ok := h.File(docID)
+	if !ok {
+		return File{}, errors.New(docID + " is not in the workspace")
+	}
+	f.Path = path
+	return h.changeFile(f)
+}
+
+// RemoveFile removes a file from the workspace. Its document stays shared
+// with the peers which have it open
+func (h *Host) RemoveFile(docID string) (File, error) {
+	f, ok := h.File(docID)
+	if !ok {
+		return File{}, errors.New(docID + " is not in the workspace")
+	}
+	f.Removed = true
+	return h.changeFile(f)
+}
+
+// changeFile makes a change of ours to a file and sends it to the peers. The
+// error tells the workspace could not be written, the change is made anyway
+func (h *Host) changeFile(f File) (File, error) {
+	f.From = h.addr
+	f.Time = time.Now()
+	h.filesMu.Lock()
+	if old, ok := h.files[f.DocID]; ok && !f.newer(old) {
+		// our clock is behind the peer which made the last change
+		f.Time = old.Time.Add(time.Nanosecond)
+	}
+	h.files[f.DocID] = f
+	err := h.saveFiles()
+	h.filesMu.Unlock()
+
+	args := FilesArgs{
+		Clientid: h.addr,
+		Files:    []File{f},
+	}
+	for _, client := range h.clients() {
+		go func(client *rpc.Client) {
+			var reply FilesReply
+			// a lost change is caught up on by the next exchange
+			callPeer(client, "EntangleClient.Files", args, &reply)
+		}(client)
+	}
+	return f, err
+}
+
+// mergeFiles keeps the entries which are newer than ours, and tells the
+// consumer about them. Entries outside the workspace are dropped. The error
+// tells the workspace could not be written
+func (h *Host) mergeFiles(files []File) error {
+	var changed, previous []File
+	h.filesMu.Lock()
+	for _, f := range files {
+		if !ValidPath(f.Path) {
+			continue
+		}
+		old, ok := h.files[f.DocID]
+		if ok && !f.newer(old) {
+			continue
+		}
+		h.files[f.DocID] = f
+		changed = append(changed, f)
+		previous = append(previous, old)
+	}
+	var err error
+	if len(changed) > 0 {
+		err = h.saveFiles()
+	}
+	cb := h.filesChanged
+	h.filesMu.Unlock()
+
+	if cb != nil {
+		for i, f := range changed {
+			cb(previous[i], f)
+		}
+	}
+	return err
+}
+
+// allFiles returns every entry of the workspace, tombstones included
+func (h *Host) allFiles() []File {
+	h.filesMu.Lock()
+	defer h.filesMu.Unlock()
+	files := make([]File, 0, len(h.files))
+	for _, f := range h.files {
+		files = append(files, f)
+	}
+	return files
+}
+
+// clients returns the RPC clients of the peers connected in any session
+func (h *Host) clients() map[string]*rpc.Client {
+	clients := make(map[string]*rpc.Client)
+	for _, s := range h.Sessions() {
+		s.mu.Lock()
+		for peer, client := range s.peers {
+			if client != nil {
+				clients[peer] = client
+			}
+		}
+		s.mu.Unlock()
+	}
+	return clients
+}
+
+// isEditor returns whether the peer is connected to us in a session in which
+// it may edit
+func (h *Host) isEditor(peer string) bool {
+	for _, s := range h.Sessions() {
+		s.mu.Lock()
+		connected := s.peers[peer] != nil
+		r, ok := s.roles[peer]
+		s.mu.Unlock()
+		if connected && ok && r.CanEdit() {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectedPeers returns the peers connected in any session, in
+// alphabetical order
+func (h *Host) ConnectedPeers() []string {
+	var peers []string
+	for peer := range h.clients() {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// exchangeFiles sends the peer our workspace and merges the one it returns
+func (h *Host) exchangeFiles(client *rpc.Client) error {
+	args := FilesArgs{
+		Clientid: h.addr,
+		Files:    h.allFiles(),
+	}
+	var reply FilesReply
+	if err := callPeer(client, "EntangleClient.ExchangeFiles", args, &reply); err != nil {
+		return err
+	}
+	return h.mergeFiles(reply.Files)
+}
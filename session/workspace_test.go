@@ -0,0 +1,140 @@
+package session
+
+import (
+	"net/rpc"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWorkspace(t *testing.T) {
+	sim := newSimulation(t, 3, 31, "workspace\n")
+	defer sim.close()
+
+	first, second, last := sim.peers[0], sim.peers[1], sim.peers[2]
+	changed := make(chan File, 16)
+	last.host.WatchFiles(func(old, f File) { changed <- f })
+
+	first.host.AddFile("sim.txt", "sim.txt")
+	f := <-changed
+	if f.DocID != "sim.txt" || f.Path != "sim.txt" || f.Owner != first.addr {
+		t.Fatalf("unexpected file %+v", f)
+	}
+	waitFor(t, func() bool { return len(second.host.Files()) == 1 })
+
+	// concurrent renames, the last one wins everywhere
+	sim.partition([]int{0, 1}, []int{2})
+	if _, err := second.host.RenameFile("sim.txt", "docs/sim.txt"); err != nil {
+		t.Fatal(err)
+	}
+	last.host.AddFile("new.txt", "new.txt")
+	renamed, err := last.host.RenameFile("sim.txt", "old/sim.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		f, _ := first.host.File("sim.txt")
+		return f.Path == "docs/sim.txt"
+	})
+	sim.heal()
+
+	waitFor(t, func() bool {
+		for _, p := range sim.peers {
+			files := p.host.Files()
+			if len(files) != 2 || files[0].Path != "new.txt" || files[1].Path != renamed.Path {
+				return false
+			}
+		}
+		return true
+	})
+
+	// a removed file stays removed, and comes back when added again
+	if _, err := first.host.RemoveFile("new.txt"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, ok := last.host.FileAt("new.txt")
+		return !ok
+	})
+	last.host.Heartbeat()
+	if _, ok := second.host.File("new.txt"); ok {
+		t.Fatal("the exchange brought back a removed file")
+	}
+	if _, err := second.host.RenameFile("new.txt", "x.txt"); err == nil {
+		t.Fatal("renamed a removed file")
+	}
+	second.host.AddFile("new.txt", "again.txt")
+	waitFor(t, func() bool {
+		f, ok := first.host.FileAt("again.txt")
+		return ok && f.Owner == second.addr
+	})
+}
+
+func TestWorkspaceRights(t *testing.T) {
+	sim := newSimulation(t, 3, 41, "workspace\n")
+	defer sim.close()
+
+	owner, editor, viewer := sim.peers[0], sim.peers[1], sim.peers[2]
+	if err := owner.session.ChangeRole(viewer.addr, RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range sim.peers {
+		waitFor(t, func() bool { return !p.session.CanEdit(viewer.addr) })
+	}
+
+	// paths going out of the workspace are refused, ours and the peers'
+	bad := []string{"", "/etc/passwd", "../up.txt", "docs/../../up.txt", "..", `docs\..\..\up.txt`}
+	for _, path := range bad {
+		if _, err := owner.host.AddFile("sim.txt", path); err == nil {
+			t.Fatalf("added the file at %q", path)
+		}
+	}
+	send := func(client *rpc.Client, from string, files ...File) error {
+		var reply FilesReply
+		return callPeer(client, "EntangleClient.Files", FilesArgs{Clientid: from, Files: files}, &reply)
+	}
+	var files []File
+	for i, path := range bad {
+		files = append(files, File{DocID: "bad" + strconv.Itoa(i), Path: path, Owner: editor.addr, Time: time.Now(), From: editor.addr})
+	}
+	if err := send(clientOf(editor, owner), editor.addr, files...); err != nil {
+		t.Fatal(err)
+	}
+	if got := owner.host.Files(); len(got) != 0 {
+		t.Fatalf("unexpected files %+v", got)
+	}
+
+	// only the editors change the workspace
+	f := File{DocID: "sim.txt", Path: "viewer.txt", Owner: viewer.addr, Time: time.Now(), From: viewer.addr}
+	if err := send(clientOf(viewer, owner), viewer.addr, f); err == nil {
+		t.Fatal("a viewer changed the workspace")
+	}
+	if err := send(clientOf(viewer, owner), editor.addr, f); err == nil {
+		t.Fatal("a viewer changed the workspace as an editor")
+	}
+	var reply FilesReply
+	if err := callPeer(clientOf(viewer, owner), "EntangleClient.ExchangeFiles", FilesArgs{Clientid: viewer.addr, Files: []File{f}}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := owner.host.File("sim.txt"); ok {
+		t.Fatal("the workspace of a viewer is merged")
+	}
+	conn, err := sim.nw.transport("10.0.0.9:7000").Dial(owner.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsider := rpc.NewClient(conn)
+	defer outsider.Close()
+	if err := send(outsider, editor.addr, f); err == nil {
+		t.Fatal("an outsider changed the workspace")
+	}
+
+	// the viewer still gets the workspace
+	if _, err := editor.host.AddFile("sim.txt", "docs/sim.txt"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		f, ok := viewer.host.File("sim.txt")
+		return ok && f.Path == "docs/sim.txt"
+	})
+}
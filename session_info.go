@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zyedidia/micro/cmd/micro/session"
+)
+
+// infoRefreshTime is how often the session info is refreshed, so that the
+// round trips and queues are followed even when nothing is typed
+const infoRefreshTime = time.Second
+
+// infoBuffer returns the buffer displaying the state of the session of the
+// shared buffer. It is created on first use
+func (b *Buffer) infoBuffer() *Buffer {
+	if b.info == nil {
+		b.info = NewBufferFromString("", "")
+		b.info.name = "Session"
+		b.info.private = true
+		b.info.infoOf = b
+	}
+	return b.info
+}
+
+// sessionInfo describes the session and every known peer
+func sessionInfo(s *session.Session) string {
+	s.Lock()
+	version := s.Version()
+	s.Unlock()
+
+	stats := s.NetStats()
+	connected := 0
+	for _, st := range stats {
+		if st.Connected {
+			connected++
+		}
+	}
+	sync := "synced"
+	if !s.Synced() {
+		sync = "not synced"
+	}
+
+	var lines []string
+	role, _ := s.Role(s.LocalAddr())
+	lines = append(lines, fmt.Sprintf("%s shared from %s as %s", s.DocID, s.LocalAddr(), role))
+	lines = append(lines, fmt.Sprintf("%d of %d peers connected, %s", connected, len(stats), sync))
+	lines = append(lines, "version "+versionString(version))
+	if err := localHost.TraceError(); err != nil {
+		lines = append(lines, err.Error())
+	}
+
+	for _, st := range stats {
+		state := "disconnected"
+		if st.CatchUp && st.Connected {
+			state = "catching up"
+		} else if st.Connected {
+			state = "connected"
+		}
+		role, _ := s.Role(st.Peer)
+		rtt := "-"
+		if st.RTT > 0 {
+			rtt = st.RTT.String()
+		}
+
+		lines = append(lines, "")
+		lines = append(lines, fmt.Sprintf("%s %s, %s", st.Peer, state, role))
+		lines = append(lines, fmt.Sprintf("  clock %d, rtt %s", st.Clock, rtt))
+		lines = append(lines, fmt.Sprintf("  sent %d operations in %d messages, received %d operations", st.Sent, st.Messages, st.Received))
+		lines = append(lines, fmt.Sprintf("  %d queued, delivered up to %d, stored up to %d", st.Queued, st.Delivered, st.Acked))
+		if st.Repaired > 0 {
+			lines = append(lines, fmt.Sprintf("  %d atoms repaired after diverging", st.Repaired))
+		}
+		if st.LastError != "" {
+			lines = append(lines, "  last error: "+st.LastError)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// versionString writes a sequence vector as peer:clock pairs, ordered by peer
+func versionString(version map[string]uint64) string {
+	peers := make([]string, 0, len(version))
+	for peer := range version {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	pairs := make([]string, len(peers))
+	for i, peer := range peers {
+		pairs[i] = fmt.Sprintf("%s:%d", peer, version[peer])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// refreshInfo rewrites the session info of the buffer if it changed
+func (b *Buffer) refreshInfo() {
+	if b.session == nil {
+		return
+	}
+	buffer := b.infoBuffer()
+	text := sessionInfo(b.session)
+	if buffer.String() == text {
+		return
+	}
+	buffer.remove(buffer.Start(), buffer.End())
+	buffer.insert(buffer.Start(), []byte(text))
+	buffer.IsModified = false
+	buffer.Cursor.Loc = buffer.Start()
+}
+
+// UpdateSessionInfo refreshes the session info shown in the current tab
+// This is called by the main loop
+func UpdateSessionInfo() {
+	for _, v := range tabs[curTab].Views {
+		if v.Type == vtInfo && v.Buf.infoOf != nil {
+			v.Buf.infoOf.refreshInfo()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// remoteEdit is a change a peer made to a shared buffer, which the plugins
+// are told about from the main goroutine
+type remoteEdit struct {
+	insert bool
+	loc    Loc
+	text   string
+}
+
+// recordRemoteEdit keeps a change of a peer for the plugins. The characters
+// deleted one after the other at the same place make one deletion
+// Pre: the document is locked
+func (b *Buffer) recordRemoteEdit(insert bool, loc Loc, text string) {
+	if n := len(b.remoteEdits); !insert && n > 0 {
+		if last := &b.remoteEdits[n-1]; !last.insert && last.loc == loc {
+			last.text += text
+			return
+		}
+	}
+	b.remoteEdits = append(b.remoteEdits, remoteEdit{insert, loc, text})
+}
+
+// flushRemoteEdits applies the changes of the peers to the lines, and calls
+// onRemoteInsert and onRemoteDelete of the plugins for the changes recorded
+// so far, made by the given peer
+// This must be called from the main goroutine
+func (b *Buffer) flushRemoteEdits(peer string) {
+	b.lockDoc()
+	edits := b.remoteEdits
+	b.remoteEdits = nil
+	b.unlockDoc()
+	b.remoteEditsEvent(peer, edits)
+}
+
+// remoteEditsEvent calls onRemoteInsert and onRemoteDelete of the plugins for
+// changes made by the given peer, or found reconciling with the peers if it
+// is empty
+// This must be called from the main goroutine
+func (b *Buffer) remoteEditsEvent(peer string, edits []remoteEdit) {
+	for _, e := range edits {
+		if e.insert {
+			GlobalPluginCall("onRemoteInsert", b, peer, e.loc, e.text)
+		} else {
+			GlobalPluginCall("onRemoteDelete", b, peer, e.loc, e.text)
+		}
+	}
+}
+
+// pluginEvent calls the given function of every plugin with the buffer and
+// the peer, from the main goroutine
+func (b *Buffer) pluginEvent(function, peer string) {
+	jobs <- JobFunction{func(string, ...string) {
+		GlobalPluginCall(function, b, peer)
+	}, "", nil}
+}
+
+// receivePluginMessage hands a message of a peer to the plugin it is for,
+// calling its onPluginMessage function
+// This must be called from the main goroutine
+func (b *Buffer) receivePluginMessage(from, plugin, data string) {
+	pl, ok := loadedPlugins[plugin]
+	if !ok {
+		return
+	}
+	_, err := Call(pl+".onPluginMessage", b, from, data)
+	if err != nil && !strings.HasPrefix(err.Error(), "function does not exist") {
+		TermMessage(err)
+	}
+}
+
+// SessionPeers returns the peers connected to the shared buffer, for the
+// plugins. It is empty if the buffer is not shared
+func SessionPeers(b *Buffer) []string {
+	if b.session == nil {
+		return []string{}
+	}
+	return b.session.Peers()
+}
+
+// SendPluginMessage sends data to the given plugin of the peers connected to
+// the shared buffer, which get it in their onPluginMessage function
+func SendPluginMessage(b *Buffer, plugin, data string) error {
+	if b.session == nil {
+		return errors.New(b.GetName() + " is not shared")
+	}
+	b.session.SendPluginMessage(plugin, data)
+	return nil
+}
+
+// Author returns the peer who typed the character at loc in the shared
+// buffer, empty if the buffer is not shared or the peer is not known
+func Author(b *Buffer, loc Loc) string {
+	if b.session == nil {
+		return ""
+	}
+	b.lockDoc()
+	defer b.unlockDoc()
+	peer, _ := b.session.Author(ToCharPos(loc, b))
+	return peer
+}
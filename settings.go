@@ -14,6 +14,8 @@ import (
 
 	"github.com/flynn/json5"
 	"github.com/zyedidia/glob"
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+	"github.com/zyedidia/micro/cmd/micro/session"
 )
 
 type optionValidator func(string, interface{}) error
@@ -31,6 +33,10 @@ var optionValidators = map[string]optionValidator{
 	"colorscheme":  validateColorscheme,
 	"colorcolumn":  validateNonNegativeValue,
 	"fileformat":   validateLineEnding,
+	"joinrole":     validateJoinRole,
+	"storage":      validateStorage,
+	"sequence":     validateSequence,
+	"listenaddr":   validateListenAddr,
 }
 
 // InitGlobalSettings initializes the options map and sets all options to their default values
@@ -208,6 +214,7 @@ func DefaultGlobalSettings() map[string]interface{} {
 		"colorcolumn":    float64(0),
 		"colorscheme":    "default",
 		"cursorline":     true,
+		"discoverable":   false,
 		"eofnewline":     false,
 		"fastdirty":      true,
 		"fileformat":     "unix",
@@ -215,8 +222,10 @@ func DefaultGlobalSettings() map[string]interface{} {
 		"ignorecase":     false,
 		"indentchar":     " ",
 		"infobar":        true,
+		"joinrole":       "editor",
 		"keepautoindent": false,
 		"keymenu":        false,
+		"listenaddr":     "127.0.0.1:7000",
 		"matchbrace":     false,
 		"matchbraceleft": false,
 		"mouse":          true,
@@ -230,23 +239,36 @@ func DefaultGlobalSettings() map[string]interface{} {
 		"scrollbar":      false,
 		"scrollmargin":   float64(3),
 		"scrollspeed":    float64(2),
+		"sequence":       crdt.Logoot,
 		"softwrap":       false,
 		"smartpaste":     true,
 		"splitbottom":    true,
 		"splitright":     true,
 		"statusline":     true,
+		"storage":        session.DefaultStore,
 		"sucmd":          "sudo",
 		"syntax":         true,
 		"tabmovement":    false,
 		"tabsize":        float64(4),
 		"tabstospaces":   false,
 		"termtitle":      false,
+		"trace":          "",
 		"useprimary":     true,
 	}
 }
 
+// sessionSettings are the local settings which are session-scoped: a shared
+// buffer has them the same for every peer, the last one set wins
+var sessionSettings = map[string]bool{
+	"fileformat":   true,
+	"indentchar":   true,
+	"tabsize":      true,
+	"tabstospaces": true,
+}
+
 // DefaultLocalSettings returns the default local settings
-// Note that filetype is a local only option
+// Note that filetype is a local only option, and the session-scoped ones
+// are in sessionSettings
 func DefaultLocalSettings() map[string]interface{} {
 	return map[string]interface{}{
 		"autoindent":     true,
@@ -256,11 +278,11 @@ func DefaultLocalSettings() map[string]interface{} {
 		"cursorline":     true,
 		"eofnewline":     false,
 		"fastdirty":      true,
-		"fileformat":     "unix",
+		"fileformat":     "unix", // session-scoped
 		"filetype":       "Unknown",
 		"hidehelp":       false,
 		"ignorecase":     false,
-		"indentchar":     " ",
+		"indentchar":     " ", // session-scoped
 		"keepautoindent": false,
 		"matchbrace":     false,
 		"matchbraceleft": false,
@@ -276,10 +298,11 @@ func DefaultLocalSettings() map[string]interface{} {
 		"splitbottom":    true,
 		"splitright":     true,
 		"statusline":     true,
+		"storage":        session.DefaultStore,
 		"syntax":         true,
 		"tabmovement":    false,
-		"tabsize":        float64(4),
-		"tabstospaces":   false,
+		"tabsize":        float64(4), // session-scoped
+		"tabstospaces":   false,      // session-scoped
 		"useprimary":     true,
 	}
 }
@@ -340,6 +363,20 @@ func SetOption(option, value string) error {
 		}
 	}
 
+	if option == "discoverable" && localHost.Addr() != "" {
+		if !nativeValue.(bool) {
+			localHost.StopAnnouncing()
+		} else if err := localHost.Announce(session.DiscoveryGroup); err != nil {
+			return err
+		}
+	}
+
+	if option == "trace" && localHost.Addr() != "" {
+		if err := localHost.Trace(nativeValue.(string)); err != nil {
+			return err
+		}
+	}
+
 	if option == "mouse" {
 		if !nativeValue.(bool) {
 			screen.DisableMouse()
@@ -429,6 +466,10 @@ func SetLocalOption(option, value string, view *View) error {
 
 	buf.Settings[option] = nativeValue
 
+	if buf.session != nil && sessionSettings[option] {
+		buf.session.SetSetting(option, value)
+	}
+
 	if option == "statusline" {
 		view.ToggleStatusLine()
 	}
@@ -526,6 +567,66 @@ func validateColorscheme(option string, value interface{}) error {
 	return nil
 }
 
+func validateJoinRole(option string, value interface{}) error {
+	roleName, ok := value.(string)
+
+	if !ok {
+		return errors.New("Expected string type for joinrole")
+	}
+
+	if roleName != "editor" && roleName != "viewer" {
+		return errors.New("joinrole must be either 'editor' or 'viewer'")
+	}
+
+	return nil
+}
+
+func validateStorage(option string, value interface{}) error {
+	kind, ok := value.(string)
+
+	if !ok {
+		return errors.New("Expected string type for storage")
+	}
+
+	for _, k := range session.StoreKinds() {
+		if k == kind {
+			return nil
+		}
+	}
+
+	return errors.New("storage must be one of " + strings.Join(session.StoreKinds(), ", "))
+}
+
+func validateSequence(option string, value interface{}) error {
+	kind, ok := value.(string)
+
+	if !ok {
+		return errors.New("Expected string type for sequence")
+	}
+
+	for _, k := range crdt.SequenceKinds() {
+		if k == kind {
+			return nil
+		}
+	}
+
+	return errors.New("sequence must be one of " + strings.Join(crdt.SequenceKinds(), ", "))
+}
+
+func validateListenAddr(option string, value interface{}) error {
+	addr, ok := value.(string)
+
+	if !ok {
+		return errors.New("Expected string type for listenaddr")
+	}
+
+	if err := session.CheckAddr(addr); err != nil {
+		return errors.New("listenaddr must be a host:port the peers reach: " + err.Error())
+	}
+
+	return nil
+}
+
 func validateLineEnding(option string, value interface{}) error {
 	endingType, ok := value.(string)
 
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+	"github.com/zyedidia/micro/cmd/micro/session"
+)
+
+// the host sharing the buffers of the editor. It listens for peers once
+// something is shared
+var localHost *session.Host
+
+type peerInfo struct {
+	IP_PORT string
+	Share   bool // sharing or not at the moment
+}
+
+// read the peer configuration file given by the -peers flag.
+// The first line is the local ip:port, the following lines are the peers,
+// followed by S if they should be connected to at startup
+func ReadConnectionConfig(filename string) ([]peerInfo, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var peers []peerInfo
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		s := strings.Fields(scanner.Text())
+		if len(s) == 0 {
+			continue
+		}
+
+		peer := peerInfo{
+			IP_PORT: s[0],
+			Share:   len(s) > 1 && s[1] == "S",
+		}
+
+		peers = append(peers, peer)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		return nil, errors.New(filename + " does not contain the local address")
+	}
+
+	return peers, nil
+}
+
+// InitConnections shares the given buffer with the peers listed in the
+// configuration file given with -peers. The peers marked with S are
+// connected immediately, the others may connect later on.
+func InitConnections(buf *Buffer, config string) {
+	peers, err := ReadConnectionConfig(config)
+	if err != nil {
+		TermMessage("Error reading peer configuration: ", err)
+		return
+	}
+
+	globalSettings["listenaddr"] = peers[0].IP_PORT // peers[0] is now itself
+
+	s, err := ShareBuffer(buf, buf.GetName())
+	if err != nil {
+		TermMessage(err)
+		return
+	}
+
+	for _, peer := range peers[1:] {
+		s.KnowPeer(peer.IP_PORT)
+	}
+
+	for _, peer := range peers[1:] {
+		if peer.Share == false {
+			continue
+		}
+		// asynchronously, does not matter if synchronous.
+		go func(addr string) {
+			// based on the err, do not have to quit
+			if err := s.Connect(addr); err != nil {
+				jobs <- JobFunction{func(string, ...string) {
+					messenger.Error("Unable to connect to ", addr, ": ", err.Error())
+				}, "", nil}
+			}
+		}(peer.IP_PORT)
+	}
+}
+
+// joinRole returns the role given to peers joining a document we own
+func joinRole() session.Role {
+	r, err := session.ParseRole(globalSettings["joinrole"].(string))
+	if err != nil {
+		return session.RoleViewer
+	}
+	return r
+}
+
+// listen makes the local host listen for peers, and applies the storage setting
+// to the documents shared from now on. Discoverable hosts answer the peers
+// looking for sessions on the local network
+func listen() error {
+	if err := localHost.Listen(globalSettings["listenaddr"].(string)); err != nil {
+		return err
+	}
+	if err := localHost.SetStore(globalSettings["storage"].(string)); err != nil {
+		return err
+	}
+	if err := localHost.Trace(globalSettings["trace"].(string)); err != nil {
+		return err
+	}
+	if globalSettings["discoverable"].(bool) {
+		return localHost.Announce(session.DiscoveryGroup)
+	}
+	return nil
+}
+
+// ShareBuffer starts sharing the buffer under the given document ID.
+// If the storage of the document matches the content of the buffer, the
+// stored document is reused together with the undo history
+func ShareBuffer(b *Buffer, docID string) (*session.Session, error) {
+	if b.private {
+		return nil, errors.New(b.GetName() + " cannot be shared")
+	}
+	if b.session != nil {
+		return nil, errors.New(b.GetName() + " is already shared as " + b.session.DocID)
+	}
+	if err := listen(); err != nil {
+		return nil, err
+	}
+
+	if kind := globalSettings["sequence"].(string); b.Document.Kind() != kind {
+		doc, err := crdt.NewSequence(kind, 0, b.Document.Content())
+		if err != nil {
+			return nil, err
+		}
+		// the undo history refers to positions of the previous document
+		b.Document = doc
+		b.forgetOps()
+	}
+
+	s, resumed, err := localHost.Share(docID, b.Document)
+	if err != nil {
+		return nil, err
+	}
+	s.SetJoinRole(joinRole())
+	if resumed {
+		b.Document = s.Document()
+		b.forgetOps()
+		restoreUndo(b, s)
+	}
+	b.attachSession(s)
+	// the peers start with our session-scoped settings
+	for option := range sessionSettings {
+		s.InitSetting(option, fmt.Sprint(b.Settings[option]))
+	}
+	if _, ok := localHost.File(s.DocID); !ok {
+		if _, err := localHost.AddFile(s.DocID, workspacePath(b)); err != nil {
+			messenger.Error(err)
+		}
+	}
+
+	return s, nil
+}
+
+// JoinSession joins the document shared by the peer at addr and returns the
+// buffer holding it. If docID is empty, the peer must share exactly one document.
+func JoinSession(addr, docID string) (*Buffer, error) {
+	if err := listen(); err != nil {
+		return nil, err
+	}
+
+	s, err := localHost.Join(addr, docID)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tabs {
+		for _, v := range t.Views {
+			if v.Buf.Path == s.DocID {
+				s.Unshare()
+				return nil, errors.New(s.DocID + " is already open")
+			}
+		}
+	}
+
+	b := NewBufferFromString(s.Document().Content(), s.DocID)
+	b.Document = s.Document()
+	restoreUndo(b, s)
+	b.attachSession(s)
+
+	if err := s.Connect(addr); err != nil {
+		b.unshare()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// pendingEdit is a change a peer made to the document of a shared buffer,
+// which its lines do not have yet
+type pendingEdit struct {
+	insert bool
+	index  int
+	text   string // inserted
+}
+
+// lockDoc locks the document of a shared buffer and brings the lines up to
+// date with it. The peers change the document from the goroutines serving
+// them, but the lines are read without a lock by the cursors, the search,
+// the highlighting and the plugins, so they are only changed from the main
+// goroutine, when the document is locked there
+// This must be called from the main goroutine
+func (b *Buffer) lockDoc() {
+	b.session.Lock()
+	b.applyRemoteEdits()
+}
+
+// unlockDoc unlocks the document of a shared buffer
+func (b *Buffer) unlockDoc() {
+	b.session.Unlock()
+}
+
+// applyRemoteEdits applies the changes of the peers to the lines, in order
+// Pre: the document is locked, from the main goroutine
+func (b *Buffer) applyRemoteEdits() {
+	for _, e := range b.pending {
+		loc := FromCharPos(e.index, b)
+		text := e.text
+		if e.insert {
+			// This directly inserts to lineArray bypassing the eventsQueue
+			b.LineArray.insert(loc, []byte(text))
+		} else {
+			text = b.LineArray.remove(loc, loc.right(b)) // removing one char at loc
+		}
+		// update numoflines in lineArray
+		b.Update()
+		b.recordRemoteEdit(e.insert, loc, text)
+		if strings.Contains(text, "\n") {
+			b.damageLines(loc.Y, -1)
+		} else {
+			b.damageLines(loc.Y, loc.Y+1)
+		}
+	}
+	b.pending = nil
+}
+
+// attachSession makes the buffer follow what the peers do to the document
+// of the session
+func (b *Buffer) attachSession(s *session.Session) {
+	b.session = s
+	s.Serve(session.Callbacks{
+		RemoteInsert: func(index int, text string) {
+			// the lines follow from the main goroutine
+			b.pending = append(b.pending, pendingEdit{true, index, text})
+		},
+		RemoteDelete: func(index int) {
+			b.pending = append(b.pending, pendingEdit{false, index, ""})
+		},
+		Applied: func(peer string, ops []crdt.Operation) {
+			jobs <- JobFunction{func(string, ...string) {
+				if b.session == s {
+					b.flushRemoteEdits(peer)
+				}
+			}, "", nil}
+		},
+		Changed: func() {
+			// the changes found reconciling with the peers, and our role
+			// may have changed
+			jobs <- JobFunction{func(string, ...string) {
+				if b.session == s {
+					b.updateReadonly()
+					requestRedraw()
+					b.flushRemoteEdits("")
+				}
+			}, "", nil}
+		},
+		Presence: func(peer string, p session.Presence) {
+			// the views belong to the main goroutine
+			jobs <- JobFunction{func(string, ...string) {
+				if peer == following {
+					followPeer()
+				}
+			}, "", nil}
+		},
+		Chat: func(m session.ChatMessage) {
+			// the chat buffer belongs to the main goroutine
+			jobs <- JobFunction{func(string, ...string) {
+				b.receiveChat(m)
+			}, "", nil}
+		},
+		Comment: func(c session.Comment) {
+			jobs <- JobFunction{func(string, ...string) {
+				b.receiveComment(c)
+			}, "", nil}
+		},
+		PeerConnected: func(peer string) {
+			b.pluginEvent("onPeerConnect", peer)
+		},
+		PeerDisconnected: func(peer string) {
+			b.pluginEvent("onPeerDisconnect", peer)
+		},
+		Synced: func(peer string) {
+			b.pluginEvent("onSyncComplete", peer)
+		},
+		PluginMessage: func(m session.PluginMessage) {
+			jobs <- JobFunction{func(string, ...string) {
+				b.receivePluginMessage(m.From, m.Plugin, m.Data)
+			}, "", nil}
+		},
+		Setting: func(st session.Setting) {
+			jobs <- JobFunction{func(string, ...string) {
+				b.receiveSetting(st)
+			}, "", nil}
+		},
+		Claim: func(c session.Claim) {
+			jobs <- JobFunction{func(string, ...string) {
+				b.receiveClaim(c)
+			}, "", nil}
+		},
+		StorageError: func(err error) {
+			jobs <- JobFunction{func(string, ...string) {
+				messenger.Error("Unable to store ", s.DocID, ": ", err.Error())
+			}, "", nil}
+		},
+	})
+}
+
+// receiveSetting applies a session-scoped setting a peer changed
+func (b *Buffer) receiveSetting(st session.Setting) {
+	if !sessionSettings[st.Name] {
+		return
+	}
+	for _, t := range tabs {
+		for _, v := range t.Views {
+			if v.Buf == b {
+				// the session has the value already, it is not sent back
+				if err := SetLocalOption(st.Name, st.Value, v); err != nil {
+					messenger.Error(st.From + " set " + st.Name + ": " + err.Error())
+				}
+				return
+			}
+		}
+	}
+}
+
+// unshare disconnects the buffer from its peers
+func (b *Buffer) unshare() {
+	// the lines keep what the peers did until then
+	b.lockDoc()
+	b.unlockDoc()
+	saveUndo(b)
+	b.session.Unshare()
+	b.session = nil
+	b.updateReadonly()
+}
+
+// releaseSession unshares the buffer if the given view is the last one showing it
+func (b *Buffer) releaseSession(closing *View) {
+	if b.session == nil {
+		return
+	}
+	for _, t := range tabs {
+		for _, v := range t.Views {
+			if v != closing && v.Buf == b {
+				return
+			}
+		}
+	}
+	b.unshare()
+}
+
+// CloseSessions stops sharing every buffer. This is called before exiting
+func CloseSessions() {
+	for _, t := range tabs {
+		for _, v := range t.Views {
+			if v.Buf.session != nil {
+				v.Buf.unshare()
+			}
+		}
+	}
+	localHost.Close()
+}
+
+// restoreUndo loads the undo history stored with the document, if saveundo is on
+func restoreUndo(b *Buffer, s *session.Session) {
+	if !b.Settings["saveundo"].(bool) {
+		return
+	}
+	data := s.LoadUndo()
+	if data == nil {
+		return
+	}
+	var u SerializedUndo
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&u); err != nil {
+		return
+	}
+	b.RestoreUndo(&u, s)
+}
+
+// saveUndo writes the undo history of a shared buffer, if saveundo is on
+func saveUndo(b *Buffer) {
+	if !b.Settings["saveundo"].(bool) {
+		return
+	}
+	var data bytes.Buffer
+	err := gob.NewEncoder(&data).Encode(b.SerializeUndo())
+	if err == nil {
+		err = b.session.SaveUndo(data.Bytes())
+	}
+	if err != nil {
+		messenger.Error("Unable to save the undo history of ", b.GetName(), ": ", err.Error())
+	}
+}
+
+// SavedVersion is written next to a shared file when it is saved, so that
+// one can tell which operations of the peers the file reflects
+type SavedVersion struct {
+	DocID    string
+	Clocks   map[string]uint64 // sequence vector of the saved document
+	Unsynced []string          // peers which had not synced at save time
+	Time     time.Time
+}
+
+// versionPath returns the path of the file holding the version of a saved
+// shared file: .name.version in the same directory
+func versionPath(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".version")
+}
+
+// saveVersion writes the version of a saved shared file
+func saveVersion(filename, docID string, clocks map[string]uint64, unsynced []string) error {
+	data, err := json.MarshalIndent(SavedVersion{docID, clocks, unsynced, time.Now()}, "", "    ")
+	if err != nil {
+		return err
+	}
+	return overwriteFile(versionPath(filename), func(file io.Writer) error {
+		_, err := file.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// updateReadonly updates the views showing the buffer
+func (b *Buffer) updateReadonly() {
+	for _, t := range tabs {
+		for _, v := range t.Views {
+			if v.Buf == b {
+				v.updateReadonly()
+			}
+		}
+	}
+}
+
+// updateReadonly makes the view read-only if it shows a document we are
+// only allowed to view
+func (v *View) updateReadonly() {
+	if v.Type.Kind != vtDefault.Kind {
+		return
+	}
+	s := v.Buf.session
+	v.Type.Readonly = s != nil && !s.CanEdit(s.LocalAddr())
+}
+
+// ReplayTrace replays the trace at path, prints where it diverges if it does,
+// and returns the exit status
+func ReplayTrace(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer f.Close()
+
+	steps, err := session.Replay(f)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(steps, "steps replayed, no divergence")
+	return 0
+}
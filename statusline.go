@@ -41,20 +41,30 @@ func (sline *Statusline) Display() {
 
 	file += " (" + lineNum + "," + columnNum + ")" // cursor (x, y)
 
-	// show online and offline now based on available connections.
-	// here, we will use peerServices, but later will need to have a table of reachable peers
-	// current peerServices cannot indicate offline when other peers quit.
-
-	connectionStatus := ""
-	// currently only one peer
-	if IsOffline() {
-		connectionStatus = "offline"
-	} else {
-		connectionStatus = "online"
+	// show how many peers are connected and whether they have everything
+	// we typed, if shared
+	if s := sline.view.Buf.session; s != nil {
+		connected := 0
+		for _, st := range s.NetStats() {
+			if st.Connected {
+				connected++
+			}
+		}
+		if connected == 0 {
+			file += " offline"
+		} else if s.Synced() {
+			file += " online " + strconv.Itoa(connected) + " peers synced"
+		} else {
+			file += " online " + strconv.Itoa(connected) + " peers syncing"
+		}
+		if !s.CanEdit(s.LocalAddr()) {
+			file += " viewer"
+		}
+		if sline.view.Buf.unread > 0 {
+			file += " " + strconv.Itoa(sline.view.Buf.unread) + " unread"
+		}
 	}
 
-	file += " " + connectionStatus
-
 	// Add the filetype
 	//file += " " + sline.view.Buf.FileType() // this returns "unknown"
 	//file += " " + sline.view.Buf.Settings["fileformat"].(string) // "unix"
@@ -90,7 +100,29 @@ func (sline *Statusline) Display() {
 	fileRunes := []rune(file)
 
 	if sline.view.Type == vtTerm {
-		fileRunes = []rune(sline.view.term.title)
+		fileRunes = []rune(sline.view.term.title + sline.view.term.shareStatus())
+		rightText = ""
+	}
+
+	if sline.view.Type == vtChat {
+		// show who is online and where
+		if owner := sline.view.Buf.chatOf; owner != nil && owner.session != nil {
+			fileRunes = []rune("Chat " + owner.session.PresenceString(owner.Cursor.Y))
+		}
+		rightText = ""
+	}
+
+	if sline.view.Type == vtInfo {
+		if owner := sline.view.Buf.infoOf; owner != nil && owner.session != nil {
+			fileRunes = []rune("Session " + owner.session.DocID)
+		}
+		rightText = ""
+	}
+
+	if sline.view.Type == vtComments {
+		if owner := sline.view.Buf.commentsOf; owner != nil && owner.session != nil {
+			fileRunes = []rune("Comments " + owner.session.DocID)
+		}
 		rightText = ""
 	}
 
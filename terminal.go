@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/zyedidia/clipboard"
+	"github.com/zyedidia/micro/cmd/micro/session"
 	"github.com/zyedidia/tcell"
 	"github.com/zyedidia/terminal"
 )
@@ -32,6 +33,10 @@ type Terminal struct {
 	getOutput bool
 	output    *bytes.Buffer
 	callback  string
+	// shared lets the peers watch the terminal, nil if it is not shared
+	shared *session.SharedTerm
+	// remote is the terminal of a peer shown instead, nil if none
+	remote *remoteTerm
 }
 
 // HasSelection returns whether this terminal has a valid selection
@@ -99,6 +104,9 @@ func (t *Terminal) Start(execCmd []string, view *View, getOutput bool) error {
 
 // Resize informs the terminal of a resize event
 func (t *Terminal) Resize(width, height int) {
+	if t.remote != nil { // the peer decides of the size
+		return
+	}
 	t.term.Resize(width, height)
 }
 
@@ -107,6 +115,10 @@ func (t *Terminal) Resize(width, height int) {
 // does not have mouse support, the emulator will support selections and
 // copy-paste
 func (t *Terminal) HandleEvent(event tcell.Event) {
+	if t.remote != nil {
+		t.handleRemoteEvent(event)
+		return
+	}
 	if e, ok := event.(*tcell.EventKey); ok {
 		if t.status == VTDone {
 			switch e.Key() {
@@ -155,6 +167,7 @@ func (t *Terminal) HandleEvent(event tcell.Event) {
 // Stop stops execution of the terminal and sets the status
 // to VTDone
 func (t *Terminal) Stop() {
+	t.unshareTerm()
 	t.term.File().Close()
 	t.term.Close()
 	if t.wait {
@@ -196,6 +209,10 @@ func (t *Terminal) Display() {
 			screen.SetContent(t.view.x, t.view.y+i, '|', nil, dividerStyle.Reverse(true))
 		}
 	}
+	if t.remote != nil {
+		t.displayRemote(divider)
+		return
+	}
 	t.state.Lock()
 	defer t.state.Unlock()
 
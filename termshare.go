@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/zyedidia/micro/cmd/micro/session"
+	"github.com/zyedidia/tcell"
+	"github.com/zyedidia/terminal"
+)
+
+// remoteTerm is the screen of a terminal a peer shares, shown in a vtTerm view
+type remoteTerm struct {
+	peer, name string
+	lines      map[int][]session.TermCell
+	cursorX    int
+	cursorY    int
+	cursor     bool
+	input      bool // whether we may type in the terminal
+	closed     bool
+	// what we type, sent to the peer in order
+	keys chan string
+}
+
+// TermShare starts a terminal in the current view, running the given
+// command or the shell, which the peers connected in any session can watch
+func TermShare(args []string) error {
+	if err := listen(); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		args = []string{os.Getenv("SHELL"), "-i"}
+	}
+	v := CurView()
+	if err := v.StartTerminal(args, true, false, ""); err != nil {
+		return err
+	}
+	t := v.term
+	shared := localHost.ShareTerm(t.title, func(peer, data string) {
+		jobs <- JobFunction{func(string, ...string) {
+			if t.shared != nil && t.status == VTRunning {
+				t.WriteString(data)
+			}
+		}, "", nil}
+	})
+	t.shared = shared
+	t.publish()
+	messenger.Message("Sharing " + shared.Name() + ", peers watch it with term join " + localHost.Addr())
+	return nil
+}
+
+// publish sends the screen of a shared terminal to the peers watching it
+func (t *Terminal) publish() {
+	t.state.Lock()
+	screen := make([][]session.TermCell, t.view.Height)
+	for y := range screen {
+		screen[y] = make([]session.TermCell, t.view.Width)
+		for x := range screen[y] {
+			c, f, b := t.state.Cell(x, y)
+			fg, bg := int(f), int(b)
+			if f == terminal.DefaultFG {
+				fg = -1
+			}
+			if b == terminal.DefaultBG {
+				bg = -1
+			}
+			screen[y][x] = session.TermCell{Ch: c, Fg: fg, Bg: bg}
+		}
+	}
+	curx, cury := t.state.Cursor()
+	visible := t.state.CursorVisible()
+	t.state.Unlock()
+
+	t.shared.Publish(screen, curx, cury, visible)
+}
+
+// publishTerms sends the screens of the shared terminals to the peers
+// watching them, the lines which changed only
+func publishTerms() {
+	for _, tab := range tabs {
+		for _, v := range tab.Views {
+			if v.Type == vtTerm && v.term.shared != nil {
+				v.term.publish()
+			}
+		}
+	}
+}
+
+// unshareTerm stops sharing the terminal, if it is
+func (t *Terminal) unshareTerm() {
+	if t.shared != nil {
+		t.shared.Close()
+		t.shared = nil
+	}
+}
+
+// TermJoin shows a terminal a peer shares in the current view, read-only
+// unless the peer gives us input rights. Without a name, the peer must
+// share a single terminal
+func TermJoin(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("Usage: term join host:port [name]")
+	}
+	peer := args[0]
+	var name string
+	if len(args) == 2 {
+		name = args[1]
+	} else {
+		names, err := localHost.PeerTerms(peer)
+		if err != nil {
+			return err
+		}
+		switch len(names) {
+		case 0:
+			return errors.New(peer + " shares no terminal")
+		case 1:
+			name = names[0]
+		default:
+			messenger.AddLog("----------------")
+			messenger.AddLog("Terminals shared by " + peer + ":")
+			for _, n := range names {
+				messenger.AddLog("    " + n)
+			}
+			messenger.AddLog("----------------")
+			return errors.New(peer + " shares several terminals, see the log")
+		}
+	}
+
+	v := CurView()
+	if v.Type == vtTerm {
+		return errors.New("the view already shows a terminal")
+	}
+	r := &remoteTerm{peer: peer, name: name, keys: make(chan string, 64)}
+	err := localHost.WatchTerm(peer, name, func(f session.TermFrame) {
+		// the view belongs to the main goroutine
+		jobs <- JobFunction{func(string, ...string) {
+			if v.term.remote == r {
+				r.apply(f)
+			}
+		}, "", nil}
+	})
+	if err != nil {
+		return err
+	}
+	go r.send()
+
+	v.term.remote = r
+	v.term.view = v
+	v.term.vtOld = v.Type
+	v.term.title = peer + " " + name
+	v.Type = vtTerm
+	messenger.Message("Watching " + name + " of " + peer + ", Ctrl-q to stop")
+	return nil
+}
+
+// apply applies a frame of the terminal to the screen
+func (r *remoteTerm) apply(f session.TermFrame) {
+	if f.Full || r.lines == nil {
+		r.lines = make(map[int][]session.TermCell)
+	}
+	for y, line := range f.Lines {
+		r.lines[y] = line
+	}
+	r.cursorX, r.cursorY, r.cursor = f.CursorX, f.CursorY, f.Cursor
+	if f.Input != r.input {
+		r.input = f.Input
+		if r.input {
+			messenger.Message(r.peer + " lets you type in " + r.name)
+		} else {
+			messenger.Message(r.name + " of " + r.peer + " is read-only")
+		}
+	}
+	if f.Closed {
+		r.closed = true
+		messenger.Message(r.peer + " closed " + r.name)
+	}
+}
+
+// send types what we typed in the terminal of the peer, in order
+func (r *remoteTerm) send() {
+	for data := range r.keys {
+		if err := localHost.TermInput(r.peer, r.name, data); err != nil {
+			jobs <- JobFunction{func(string, ...string) {
+				messenger.Error(err)
+			}, "", nil}
+		}
+	}
+}
+
+// stopWatching leaves the terminal of the peer and gives the view back
+func (t *Terminal) stopWatching() {
+	r := t.remote
+	t.remote = nil
+	close(r.keys)
+	if !r.closed {
+		go localHost.UnwatchTerm(r.peer, r.name)
+	}
+	t.view.Type = t.vtOld
+}
+
+// handleRemoteEvent types the keys in the terminal of the peer if we have
+// input rights. Ctrl-q stops watching
+func (t *Terminal) handleRemoteEvent(event tcell.Event) {
+	e, ok := event.(*tcell.EventKey)
+	if !ok {
+		return
+	}
+	r := t.remote
+	switch {
+	case e.Key() == tcell.KeyCtrlQ || r.closed && (e.Key() == tcell.KeyEscape || e.Key() == tcell.KeyEnter):
+		t.stopWatching()
+	case r.input:
+		select {
+		case r.keys <- event.EscSeq():
+		default:
+			messenger.Error("Typing faster than " + r.peer + " receives")
+		}
+	default:
+		messenger.Message(r.name + " of " + r.peer + " is read-only, Ctrl-q to stop watching")
+	}
+}
+
+// displayRemote displays the screen of the terminal of the peer
+func (t *Terminal) displayRemote(divider int) {
+	r := t.remote
+	for y := 0; y < t.view.Height; y++ {
+		line := r.lines[y]
+		for x := 0; x < t.view.Width; x++ {
+			c, st := ' ', defStyle
+			if x < len(line) {
+				cell := line[x]
+				c = cell.Ch
+				fg, bg := tcell.ColorDefault, tcell.ColorDefault
+				if cell.Fg >= 0 {
+					fg = GetColor256(cell.Fg)
+				}
+				if cell.Bg >= 0 {
+					bg = GetColor256(cell.Bg)
+				}
+				st = tcell.StyleDefault.Foreground(fg).Background(bg)
+			}
+			screen.SetContent(t.view.x+x+divider, t.view.y+y, c, nil, st)
+		}
+	}
+	if r.cursor && !r.closed && tabs[curTab].CurView == t.view.Num {
+		screen.ShowCursor(r.cursorX+t.view.x+divider, r.cursorY+t.view.y)
+	}
+}
+
+// shareStatus tells whether the terminal is shared or the one of a peer,
+// for the statusline
+func (t *Terminal) shareStatus() string {
+	switch {
+	case t.shared != nil:
+		peers, _ := t.shared.Watchers()
+		return fmt.Sprintf(" (shared, %d watching)", len(peers))
+	case t.remote != nil && t.remote.closed:
+		return " (closed)"
+	case t.remote != nil && t.remote.input:
+		return " (input)"
+	case t.remote != nil:
+		return " (read-only)"
+	}
+	return ""
+}
+
+// TermGrant gives a peer watching the shared terminals input rights, or
+// takes them back
+func TermGrant(peer string, input bool) error {
+	granted := false
+	for _, tab := range tabs {
+		for _, v := range tab.Views {
+			if v.Type != vtTerm || v.term.shared == nil {
+				continue
+			}
+			if v.term.shared.Grant(peer, input) == nil {
+				granted = true
+			}
+		}
+	}
+	if !granted {
+		return errors.New(peer + " is not watching any shared terminal")
+	}
+	if input {
+		messenger.Message(peer + " can type in the shared terminals")
+	} else {
+		messenger.Message("The shared terminals are read-only for " + peer)
+	}
+	return nil
+}
@@ -18,12 +18,15 @@ type ViewType struct {
 }
 
 var (
-	vtDefault = ViewType{0, false, false}
-	vtHelp    = ViewType{1, true, true}
-	vtLog     = ViewType{2, true, true}
-	vtScratch = ViewType{3, false, true}
-	vtRaw     = ViewType{4, true, true}
-	vtTerm    = ViewType{5, true, true}
+	vtDefault  = ViewType{0, false, false}
+	vtHelp     = ViewType{1, true, true}
+	vtLog      = ViewType{2, true, true}
+	vtScratch  = ViewType{3, false, true}
+	vtRaw      = ViewType{4, true, true}
+	vtTerm     = ViewType{5, true, true}
+	vtChat     = ViewType{6, true, true}
+	vtInfo     = ViewType{7, true, true}
+	vtComments = ViewType{8, true, true}
 )
 
 // The View struct stores information about a view into a buffer.
@@ -281,6 +284,8 @@ func (v *View) OpenBuffer(buf *Buffer) {
 	// is opened
 	v.isOverwriteMode = false
 	v.lastClickTime = time.Time{}
+	// viewers of a shared document cannot edit it
+	v.updateReadonly()
 
 	GlobalPluginCall("onBufferOpen", v.Buf)
 	GlobalPluginCall("onViewOpen", v)
@@ -779,6 +784,7 @@ func (v *View) openHelp(helpPage string) {
 	} else {
 		helpBuffer := NewBufferFromString(string(data), helpPage+".md")
 		helpBuffer.name = "Help" // set buffer name to "Help"
+		helpBuffer.private = true
 
 		if v.Type == vtHelp {
 			v.OpenBuffer(helpBuffer)
@@ -801,14 +807,15 @@ func (v *View) DisplayView() {
 		v.leftCol = 0
 	}
 
-	if v.Type == vtLog || v.Type == vtRaw {
-		// Log or raw views should always follow the cursor...
+	if v.Type == vtLog || v.Type == vtRaw || v.Type == vtChat {
+		// Log, chat or raw views should always follow the cursor...
 		v.Relocate()
 	}
 
 	// We need to know the string length of the largest line number
 	// so we can pad appropriately when displaying line numbers
 	maxLineNumLength := len(strconv.Itoa(v.Buf.NumLines))
+	drawnOffset := v.lineNumOffset
 
 	if v.Buf.Settings["ruler"] == true {
 		// + 1 for the little space after the line number
@@ -838,6 +845,13 @@ func (v *View) DisplayView() {
 	xOffset := v.x + v.lineNumOffset
 	yOffset := v.y
 
+	damage := v.cellview.damage
+	if damage != nil && v.lineNumOffset != drawnOffset {
+		// the text moved sideways
+		damage = nil
+		v.clear()
+	}
+
 	height := v.Height
 	width := v.Width
 	left := v.leftCol
@@ -865,6 +879,13 @@ func (v *View) DisplayView() {
 			realLineN++
 		}
 
+		if damage != nil {
+			if !damage.has(realLineN) {
+				continue
+			}
+			v.clearLine(yOffset + visualLineN)
+		}
+
 		colorcolumn := int(v.Buf.Settings["colorcolumn"].(float64))
 		if colorcolumn != 0 && xOffset+colorcolumn-v.leftCol < v.Width {
 			style := GetColor("color-column")
@@ -1069,6 +1090,13 @@ func (v *View) DisplayView() {
 		}
 	}
 
+	// the lines past the end of the buffer, if it got shorter
+	if damage != nil && damage.has(v.Buf.NumLines) {
+		for y := len(v.cellview.lines); y < v.Height; y++ {
+			v.clearLine(yOffset + y)
+		}
+	}
+
 	if divider != 0 {
 		dividerStyle := defStyle
 		if style, ok := colorscheme["divider"]; ok {
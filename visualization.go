@@ -1,14 +1,18 @@
 package main
 
-import "runtime"
+import (
+	"runtime"
+
+	"github.com/zyedidia/micro/cmd/micro/crdt"
+)
 
 // This function hightlights patches
-func HighlightPatch(patch []Operation) {
+func HighlightPatch(patch []crdt.Operation) {
 
 	buf := CurView().Buf
 	for _, op := range patch { // we already inserted, so they all exists
 		if op.OpType == true { // does not care about deleted changes for now
-			posIdentifier := NewPos(op.Pos)
+			posIdentifier := crdt.NewPos(op.Pos)
 			CRDTIndex, _ := buf.Document.Index(posIdentifier)
 			// converting CRDTIndex to lineArray pos
 			LinePos := FromCharPos(CRDTIndex-1, buf) // off by 1
@@ -23,7 +27,7 @@ func HighlightPatch(patch []Operation) {
 
 // RedrawAll redraws everything -- all the views and the messenger
 // And highlight recently obtained patch as well
-func RedrawAllWithPatchHighlight(patch []Operation) {
+func RedrawAllWithPatchHighlight(patch []crdt.Operation) {
 	messenger.Clear()
 	// clear the screen first
 	w, h := screen.Size()
@@ -34,7 +38,7 @@ func RedrawAllWithPatchHighlight(patch []Operation) {
 	}
 
 	for _, v := range tabs[curTab].Views { // draw all meat in each view
-		v.Display()
+		v.display()
 	}
 	DisplayTabs() // display all tabs if we have multiple
 	messenger.Display()
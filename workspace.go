@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/zyedidia/micro/cmd/micro/session"
+)
+
+// workspacePath returns the path a shared buffer goes to in the workspace.
+// A file outside the working directory goes under its document ID
+func workspacePath(b *Buffer) string {
+	if path := filepath.ToSlash(b.Path); session.ValidPath(path) {
+		return path
+	}
+	return b.session.DocID
+}
+
+// localPath returns where a file of the workspace is saved, which must be
+// under the working directory
+func localPath(f session.File) (string, error) {
+	if !session.ValidPath(f.Path) {
+		return "", errors.New(f.Path + " is outside the workspace")
+	}
+	return filepath.FromSlash(f.Path), nil
+}
+
+// sharedBuffer returns the buffer holding the given document, and the tab it
+// is in, nil if it is not open
+func sharedBuffer(docID string) (*Buffer, int) {
+	for i, t := range tabs {
+		for _, v := range t.Views {
+			if v.Buf.session != nil && v.Buf.session.DocID == docID {
+				return v.Buf, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// openTab opens the buffer in a new tab, like the tab command does
+func openTab(buf *Buffer) {
+	tab := NewTabFromView(NewView(buf))
+	tab.SetNum(len(tabs))
+	tabs = append(tabs, tab)
+	curTab = len(tabs) - 1
+	if len(tabs) == 2 {
+		for _, t := range tabs {
+			for _, v := range t.Views {
+				v.ToggleTabbar()
+			}
+		}
+	}
+}
+
+// openWorkspaceFile opens a file of the workspace in a new tab, joining its
+// document from the peer who added it, or else from any connected peer.
+// A file already open is switched to
+func openWorkspaceFile(f session.File) error {
+	if _, tab := sharedBuffer(f.DocID); tab >= 0 {
+		curTab = tab
+		return nil
+	}
+	path, err := localPath(f)
+	if err != nil {
+		return err
+	}
+
+	messenger.Message("Joining " + f.Path + "...")
+	RedrawAll()
+
+	err = errors.New("no peer shares " + f.Path)
+	for _, addr := range append([]string{f.Owner}, localHost.ConnectedPeers()...) {
+		if addr == localHost.Addr() {
+			continue
+		}
+		var buf *Buffer
+		if buf, err = JoinSession(addr, f.DocID); err != nil {
+			continue
+		}
+		buf.Path = path
+		openTab(buf)
+		messenger.Message("Opened " + f.Path + " from " + addr)
+		return nil
+	}
+	return err
+}
+
+// fileChanged follows a change a peer made to the workspace
+// This must be called from the main goroutine
+func fileChanged(old, f session.File) {
+	b, _ := sharedBuffer(f.DocID)
+	switch {
+	case f.Removed && !old.Removed:
+		messenger.Message(f.From + " removed " + f.Path + " from the workspace")
+	case old.DocID == "" || old.Removed:
+		messenger.Message(f.From + " added " + f.Path + " to the workspace, open it with open " + f.Path)
+	case old.Path != f.Path:
+		path, err := localPath(f)
+		if err != nil {
+			messenger.Error(err)
+			return
+		}
+		if b != nil {
+			b.Path = path
+		}
+		messenger.Message(f.From + " renamed " + old.Path + " to " + f.Path)
+	}
+}
+
+// workspaceCompletions returns the names of the files and directories of the
+// workspace in dir starting with prefix, as FileComplete suggests them
+func workspaceCompletions(dir, prefix string) []string {
+	if localHost == nil {
+		return nil
+	}
+	var names []string
+	dir = filepath.ToSlash(dir)
+	for _, f := range localHost.Files() {
+		if !strings.HasPrefix(f.Path, dir) {
+			continue
+		}
+		name := f.Path[len(dir):]
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i+1]
+		}
+		name = filepath.FromSlash(name)
+		if strings.HasPrefix(name, prefix) && !Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// workspaceTree lists the files of the workspace as a tree, the files of a
+// directory indented below it
+func workspaceTree(files []session.File) []string {
+	var lines []string
+	var dirs []string // the directories of the previous file
+	for _, f := range files {
+		parts := strings.Split(f.Path, "/")
+		same := 0
+		for same < len(dirs) && same < len(parts)-1 && dirs[same] == parts[same] {
+			same++
+		}
+		for i := same; i < len(parts)-1; i++ {
+			lines = append(lines, strings.Repeat("  ", i+1)+parts[i]+"/")
+		}
+		dirs = parts[:len(parts)-1]
+
+		line := strings.Repeat("  ", len(parts)) + parts[len(parts)-1] + " (" + f.Owner
+		if b, _ := sharedBuffer(f.DocID); b != nil {
+			line += ", open"
+		}
+		lines = append(lines, line+")")
+	}
+	return lines
+}
+
+// Workspace lists the shared files, or adds, creates, renames, removes or
+// opens one of them
+func Workspace(args []string) {
+	if len(args) == 0 {
+		files := localHost.Files()
+		if len(files) == 0 {
+			messenger.Message("The workspace is empty, add the current buffer with workspace add")
+			return
+		}
+		messenger.AddLog("----------------")
+		for _, line := range workspaceTree(files) {
+			messenger.AddLog(line)
+		}
+		messenger.AddLog("----------------")
+		messenger.Message(len(files), " files in the workspace, see the log")
+		return
+	}
+
+	var err error
+	switch {
+	case args[0] == "add" && len(args) <= 2:
+		err = addToWorkspace(CurView().Buf, args[1:])
+	case args[0] == "new" && len(args) == 2:
+		b := NewBufferFromString("", args[1])
+		if err = addToWorkspace(b, args[1:]); err == nil {
+			openTab(b)
+		}
+	case args[0] == "rename" && len(args) == 2:
+		b := CurView().Buf
+		if b.session == nil {
+			err = errors.New(b.GetName() + " is not shared")
+			break
+		}
+		var f session.File
+		if f, err = localHost.RenameFile(b.session.DocID, filepath.ToSlash(args[1])); err == nil {
+			b.Path = filepath.FromSlash(f.Path)
+			messenger.Message("Renamed to " + f.Path)
+		}
+	case args[0] == "remove" && len(args) == 1:
+		b := CurView().Buf
+		if b.session == nil {
+			err = errors.New(b.GetName() + " is not shared")
+			break
+		}
+		var f session.File
+		if f, err = localHost.RemoveFile(b.session.DocID); err == nil {
+			messenger.Message("Removed " + f.Path + " from the workspace")
+		}
+	case args[0] == "open" && len(args) == 2:
+		f, ok := localHost.FileAt(filepath.ToSlash(args[1]))
+		if !ok {
+			err = errors.New(args[1] + " is not in the workspace")
+			break
+		}
+		err = openWorkspaceFile(f)
+	default:
+		err = errors.New("Usage: workspace [add [path]|new path|rename path|remove|open path]")
+	}
+	if err != nil {
+		messenger.Error(err)
+	}
+}
+
+// addToWorkspace shares the buffer if it is not yet, and adds it to the
+// workspace at the given path, or at its own
+func addToWorkspace(b *Buffer, args []string) error {
+	if b.session == nil {
+		if _, err := ShareBuffer(b, b.GetName()); err != nil {
+			return err
+		}
+	}
+	path := workspacePath(b)
+	if len(args) > 0 {
+		path = filepath.ToSlash(args[0])
+	}
+	f, err := localHost.AddFile(b.session.DocID, path)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		b.Path = args[0]
+	}
+	messenger.Message("Added " + f.Path + " to the workspace, shared on " + localHost.Addr())
+	return nil
+}